@@ -0,0 +1,72 @@
+package netpuncher
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// ParseUDPAddr parses a "host:port" string with a literal IP address into an
+// address that can be marshaled, e.g. in CReq.
+func ParseUDPAddr(s string) (net.UDPAddr, error) {
+	ip, port, err := parseAddr(s)
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+	return net.UDPAddr{IP: ip, Port: port}, nil
+}
+
+// ParseTCPAddr parses a "host:port" string with a literal IP address into an
+// address that can be marshaled, e.g. in CReqTCP.
+func ParseTCPAddr(s string) (net.TCPAddr, error) {
+	ip, port, err := parseAddr(s)
+	if err != nil {
+		return net.TCPAddr{}, err
+	}
+	return net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// parseAddr parses and validates an address as it is encoded on the wire: a
+// 16 bit port and a 16 byte IP address.
+func parseAddr(s string) (net.IP, int, error) {
+	host, portstr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, 0, fmt.Errorf("netpuncher: invalid address: %v", err)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("netpuncher: invalid IP address %q", host)
+	}
+	port, err := strconv.ParseUint(portstr, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("netpuncher: invalid port %q", portstr)
+	}
+	return ip.To16(), int(port), nil
+}
+
+// RegistrationKey returns a canonical key for the endpoint addr, e.g. to
+// recognize a host reconnecting from the same address and port. IPv4
+// addresses give the same key in their 4 byte and IPv4-mapped 16 byte form.
+// Addresses other than *net.UDPAddr and *net.TCPAddr are keyed by their
+// String().
+func RegistrationKey(addr net.Addr) string {
+	var ip net.IP
+	var port int
+	var zone string
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	case *net.TCPAddr:
+		ip, port, zone = a.IP, a.Port, a.Zone
+	default:
+		return addr.String()
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	host := ip.String()
+	if zone != "" {
+		host += "%" + zone
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,81 @@
+package netpuncher
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		ip   net.IP
+		port int
+	}{
+		{"[2001:db8::1]:11113", net.ParseIP("2001:db8::1"), 11113},
+		{"192.0.2.1:11113", net.IPv4(192, 0, 2, 1), 11113},
+		{"[::ffff:192.0.2.1]:65535", net.IPv4(192, 0, 2, 1), 65535},
+	}
+	for _, test := range tests {
+		udp, err := ParseUDPAddr(test.in)
+		if err != nil {
+			t.Errorf("ParseUDPAddr(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !udp.IP.Equal(test.ip) || len(udp.IP) != net.IPv6len || udp.Port != test.port {
+			t.Errorf("ParseUDPAddr(%q) = %v", test.in, &udp)
+		}
+		tcp, err := ParseTCPAddr(test.in)
+		if err != nil {
+			t.Errorf("ParseTCPAddr(%q) failed: %v", test.in, err)
+			continue
+		}
+		if !tcp.IP.Equal(test.ip) || len(tcp.IP) != net.IPv6len || tcp.Port != test.port {
+			t.Errorf("ParseTCPAddr(%q) = %v", test.in, &tcp)
+		}
+		// The result has to be accepted by the encoder.
+		if _, err := (CReq{Addr: udp}).MarshalBinary(); err != nil {
+			t.Errorf("couldn't marshal CReq for %q: %v", test.in, err)
+		}
+	}
+
+	invalid := []string{
+		"2001:db8::1:11113",   // missing brackets
+		"[2001:db8::1]",       // missing port
+		"example.com:11113",   // not an IP address
+		"192.0.2.1:65536",     // port out of range
+		"192.0.2.1:-1",        // negative port
+		"[fe80::1%eth0]:1234", // zones are not encoded
+		"",
+	}
+	for _, in := range invalid {
+		if addr, err := ParseUDPAddr(in); err == nil {
+			t.Errorf("ParseUDPAddr(%q) = %v, expected error", in, &addr)
+		}
+		if addr, err := ParseTCPAddr(in); err == nil {
+			t.Errorf("ParseTCPAddr(%q) = %v, expected error", in, &addr)
+		}
+	}
+}
+
+func TestRegistrationKey(t *testing.T) {
+	short := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 11113}
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 11113}
+	tcp := &net.TCPAddr{IP: short.IP, Port: 11113}
+	if k1, k2, k3 := RegistrationKey(short), RegistrationKey(mapped), RegistrationKey(tcp); k1 != k2 || k1 != k3 {
+		t.Errorf("keys differ: %q, %q, %q", k1, k2, k3)
+	}
+	others := []net.Addr{
+		&net.UDPAddr{IP: short.IP, Port: 11114},
+		&net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 11113},
+		&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113},
+		&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 11113, Zone: "eth0"},
+	}
+	keys := map[string]bool{RegistrationKey(short): true}
+	for _, addr := range others {
+		k := RegistrationKey(addr)
+		if keys[k] {
+			t.Errorf("%v: duplicate key %q", addr, k)
+		}
+		keys[k] = true
+	}
+}
@@ -0,0 +1,82 @@
+package netpuncher
+
+import "encoding/binary"
+
+// ArrayMarshaler is implemented by the fixed-size message types. Unlike
+// MarshalBinary, MarshalArray returns the encoding by value, so that the
+// buffer can stay on the stack in hot paths. The message occupies the first n
+// bytes of the array.
+//
+// Check with go build -gcflags=-m that the result doesn't escape at the call
+// site, e.g. by passing a slice of it to a function taking an interface.
+type ArrayMarshaler interface {
+	MarshalArray() (buf [MaxPacketSize]byte, n int, err error)
+}
+
+// putHeader writes h of a message of type typ to b followed by the address
+// family in version 2 and returns the number of bytes written.
+func putHeader(b []byte, typ byte, v ProtocolVersion) int {
+	b[0], b[1] = typ, byte(v)
+	if v < 2 {
+		return HeaderSize
+	}
+	b[HeaderSize] = byte(familyIPv6)
+	return HeaderSize + 1
+}
+
+// error is always nil
+func (p AssID) MarshalArray() (b [MaxPacketSize]byte, n int, err error) {
+	n = putHeader(b[:], p.Type(), p.Header.Version)
+	n += putCID(b[n:], p.Header.Version, p.CID)
+	if p.Header.Version >= 2 {
+		if p.Nonce != 0 {
+			b[n] = assidFlagNonce
+			binary.LittleEndian.PutUint64(b[n+1:], p.Nonce)
+			n += 8
+		}
+		n++
+	}
+	return b, n, nil
+}
+
+// error is always nil
+func (p SReq) MarshalArray() (b [MaxPacketSize]byte, n int, err error) {
+	n = putHeader(b[:], p.Type(), p.Header.Version)
+	return b, n + putCID(b[n:], p.Header.Version, p.CID), nil
+}
+
+// error is always nil
+func (p SReqTCP) MarshalArray() (b [MaxPacketSize]byte, n int, err error) {
+	n = putHeader(b[:], p.Type(), p.Header.Version)
+	return b, n + putCID(b[n:], p.Header.Version, p.CID), nil
+}
+
+// Fails if Message is too long or Code has the high bit set
+func (p Error) MarshalArray() (b [MaxPacketSize]byte, n int, err error) {
+	if len(p.Message) > MaxErrorMessageSize {
+		return b, 0, errErrorMessageSize(len(p.Message))
+	}
+	if p.Code&errorFlagMessage != 0 {
+		return b, 0, p.Code.validate()
+	}
+	n = putHeader(b[:], p.Type(), p.Header.Version)
+	b[n] = byte(p.Code)
+	binary.LittleEndian.PutUint32(b[n+1:], p.CID)
+	n += 5
+	if p.Message != "" {
+		b[n-5] |= errorFlagMessage
+		b[n] = byte(len(p.Message))
+		n += 1 + copy(b[n+1:], p.Message)
+	}
+	return b, n, nil
+}
+
+// error is always nil
+func (p PunchResult) MarshalArray() (b [MaxPacketSize]byte, n int, err error) {
+	n = putHeader(b[:], p.Type(), p.Header.Version)
+	binary.LittleEndian.PutUint32(b[n:], p.CID)
+	if p.Success {
+		b[n+4] = 1
+	}
+	return b, n + 5, nil
+}
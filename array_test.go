@@ -0,0 +1,52 @@
+package netpuncher
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarshalArray(t *testing.T) {
+	n := 0
+	for _, pkt := range samplePackets {
+		m, ok := pkt.(ArrayMarshaler)
+		if !ok {
+			continue
+		}
+		n++
+		expected, _ := pkt.MarshalBinary()
+		buf, l, err := m.MarshalArray()
+		if err != nil {
+			t.Errorf("%T: %v", pkt, err)
+		} else if !bytes.Equal(buf[:l], expected) {
+			t.Errorf("%T: got %x, expected %x", pkt, buf[:l], expected)
+		}
+	}
+	if n == 0 {
+		t.Error("no sample packet implements ArrayMarshaler")
+	}
+}
+
+func TestMarshalArrayAllocs(t *testing.T) {
+	p := AssID{Header: Header{Version: 2}, CID: 1337, Nonce: 42}
+	var sum byte
+	allocs := testing.AllocsPerRun(100, func() {
+		buf, n, _ := p.MarshalArray()
+		sum += buf[n-1]
+	})
+	if allocs != 0 {
+		t.Errorf("MarshalArray allocated %v times", allocs)
+	}
+}
+
+// go test -gcflags=-m reports no "moved to heap" for buf here.
+func BenchmarkMarshalArray(b *testing.B) {
+	p := AssID{Header: Header{Version: 2}, CID: 1337}
+	b.ReportAllocs()
+	var sum byte
+	for i := 0; i < b.N; i++ {
+		p.CID = uint32(i)
+		buf, n, _ := p.MarshalArray()
+		sum += buf[n-1]
+	}
+	assidSink = []byte{sum}
+}
@@ -89,6 +89,11 @@ func (c *Conn) punch(timeout, interval time.Duration) error {
 			log.WithField("raddr", c.raddr.String()).Debug("punch: timeout")
 			return fmt.Errorf("timeout")
 		case r := <-c.rfuchan:
+			if r.err != nil && isPortUnreachable(r.err) {
+				// Keep trying until the timeout.
+				log.WithError(r.err).WithField("raddr", c.raddr.String()).Debug("punch: port unreachable")
+				continue
+			}
 			if r.err != nil {
 				return r.err
 			}
@@ -444,11 +449,11 @@ func (c *Conn) Close() error {
 		return ErrConnectionClosed(c.closereason)
 	default:
 	}
-	close(c.quit)
-
+	// Readers woken by quit read closereason.
 	if c.closereason == "" {
 		c.closereason = "connection closed locally"
 	}
+	close(c.quit)
 	if !c.noclosepacket {
 		// Send IPID_Close packet to server
 		closePacket := NewClosePacket(*c.raddr)
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"net"
 	"time"
+
+	"github.com/apex/log"
 )
 
 const connTimeout = 5 * time.Second // initial connection timeout (ConnPacket to ConnOkPacket)
@@ -86,6 +88,12 @@ func (l *Listener) handlePackets() {
 		case c := <-l.dialchan:
 			dials[addrkey(c.raddr)] = c
 		case r := <-rfuchan:
+			if r.err != nil && isPortUnreachable(r.err) {
+				// Transient, e.g. while punching, and not attributable to
+				// a connection on an unconnected socket.
+				log.WithError(r.err).Debug("listener: port unreachable")
+				continue
+			}
 			if r.err != nil {
 				l.errchan <- r.err
 				continue
@@ -1,7 +1,9 @@
 package c4netioudp
 
 import (
+	"errors"
 	"net"
+	"os"
 	"testing"
 	"time"
 )
@@ -99,3 +101,59 @@ func TestReconnecting(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+// Port unreachable errors while punching don't abort it.
+func TestPunchPortUnreachable(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	punch := func(errs ...error) error {
+		c := newConn()
+		c.udp = udp
+		c.raddr = udp.LocalAddr().(*net.UDPAddr)
+		for _, err := range errs {
+			c.rfuchan <- rfu{err: err}
+		}
+		return c.punch(time.Second, 10*time.Millisecond)
+	}
+	unreachable := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", errnoPortUnreachable)}
+	if err := punch(unreachable, unreachable, nil); err != nil {
+		t.Errorf("port unreachable: punch failed with %v", err)
+	}
+	fatal := errors.New("fatal")
+	if err := punch(unreachable, fatal); err != fatal {
+		t.Errorf("fatal error: punch returned %v", err)
+	}
+}
+
+// Readers woken by Close see the close reason. Run with -race to catch
+// closereason being written after quit was closed.
+func TestCloseWhileReading(t *testing.T) {
+	listener, err := Listen("udp", &net.UDPAddr{IP: net.IPv6loopback, Port: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go listener.AcceptConn()
+
+	c, err := Dial("udp", nil, listener.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		errs <- err
+	}()
+	c.Close()
+	select {
+	case err := <-errs:
+		if err != ErrConnectionClosed("connection closed locally") {
+			t.Errorf("got %v, expected local close", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package c4netioudp
+
+import "syscall"
+
+// Unix systems report ICMP port unreachable messages on UDP sockets as
+// ECONNREFUSED.
+const errnoPortUnreachable = syscall.ECONNREFUSED
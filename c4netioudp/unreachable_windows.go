@@ -0,0 +1,7 @@
+package c4netioudp
+
+import "syscall"
+
+// Windows reports ICMP port unreachable messages on UDP sockets as
+// WSAECONNRESET.
+const errnoPortUnreachable = syscall.WSAECONNRESET
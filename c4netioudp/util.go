@@ -1,6 +1,10 @@
 package c4netioudp
 
-import "net"
+import (
+	"errors"
+	"net"
+	"syscall"
+)
 
 // Return value from ReadFromUDP
 type rfu struct {
@@ -32,3 +36,11 @@ type writerToUDP struct {
 func (w writerToUDP) Write(b []byte) (n int, err error) {
 	return w.udp.WriteToUDP(b, w.addr)
 }
+
+// isPortUnreachable returns whether err reports an ICMP port unreachable
+// message. While punching, this only means that the peer's NAT hasn't opened
+// yet.
+func isPortUnreachable(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && errno == errnoPortUnreachable
+}
@@ -0,0 +1,62 @@
+package netpuncher
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// ChecksumSize is the size of the CRC appended by MarshalChecksummed.
+const ChecksumSize = 4
+
+// ErrChecksum is returned by UnmarshalChecksummed if the message was
+// corrupted in transit.
+var ErrChecksum = fmt.Errorf("netpuncher: checksum mismatch: %w", ErrProtocol)
+
+// MarshalChecksummed marshals p followed by the CRC-32 (IEEE, little endian)
+// of the message, so that corruption which passes the UDP checksum, e.g. by
+// broken middleboxes, is detected with UnmarshalChecksummed. This doesn't
+// protect against deliberate modification. As the CRC follows the message,
+// Unmarshal also accepts checksummed messages without checking them. Only
+// version 2 messages can be checksummed. Peers request checksums with the
+// Checksum field of IDReq or SReqV2, see also ExpectChecksum.
+func MarshalChecksummed(p PuncherPacket) ([]byte, error) {
+	if v := HeaderOf(p).Version; v < 2 {
+		return nil, fmt.Errorf("netpuncher: can't checksum version %d message", v)
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	var crc [ChecksumSize]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(b))
+	return append(b, crc[:]...), nil
+}
+
+// checksumValid returns whether the message b[:n] is followed by its CRC.
+func checksumValid(b []byte, n int) bool {
+	return binary.LittleEndian.Uint32(b[n:]) == crc32.ChecksumIEEE(b[:n])
+}
+
+// UnmarshalChecksummed decodes a datagram marshaled with MarshalChecksummed.
+// Returns ErrChecksum if the CRC doesn't match.
+func UnmarshalChecksummed(b []byte) (PuncherPacket, error) {
+	n, err := MessageLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < n+ChecksumSize {
+		return nil, ErrNotReadEnough(len(b))
+	}
+	if !checksumValid(b, n) {
+		return nil, ErrChecksum
+	}
+	p, err := unmarshal(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	if v := HeaderOf(p).Version; v < 2 {
+		return nil, InvalidMessageError{Err: fmt.Errorf("checksummed version %d message", v)}
+	}
+	return p, nil
+}
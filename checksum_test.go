@@ -0,0 +1,125 @@
+package netpuncher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalChecksummed(t *testing.T) {
+	for _, pkt := range samplePackets {
+		if HeaderOf(pkt).Version < 2 {
+			if _, err := MarshalChecksummed(pkt); err == nil {
+				t.Errorf("%T: version 1 message checksummed", pkt)
+			}
+			continue
+		}
+		buf, err := MarshalChecksummed(pkt)
+		if err != nil {
+			t.Errorf("MarshalChecksummed(%T) failed: %v", pkt, err)
+			continue
+		}
+		for _, unmarshal := range []func([]byte) (PuncherPacket, error){UnmarshalChecksummed, Unmarshal} {
+			cpy, err := unmarshal(buf)
+			if err != nil {
+				t.Errorf("decoding checksummed %T failed: %v", pkt, err)
+			} else if !reflect.DeepEqual(pkt, cpy) {
+				t.Errorf("packets not equal: %+v != %+v", pkt, cpy)
+			}
+		}
+	}
+}
+
+func TestUnmarshalChecksummedCorrupted(t *testing.T) {
+	creq := &CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}}
+	buf, _ := MarshalChecksummed(creq)
+	// Flip a bit of the address.
+	buf[HeaderSize+1+2+15] ^= 0x01
+	if _, err := UnmarshalChecksummed(buf); err != ErrChecksum || !errors.Is(err, ErrProtocol) {
+		t.Errorf("corrupted body: got %v, expected ErrChecksum", err)
+	}
+	// Without checksum mode, the corruption goes unnoticed.
+	if p, err := Unmarshal(buf); err != nil || p.(*CReq).Addr.IP.Equal(creq.Addr.IP) {
+		t.Errorf("checksum disabled: got %+v, %v, expected corrupted CReq", p, err)
+	}
+
+	// Corrupted checksum
+	buf, _ = MarshalChecksummed(creq)
+	buf[len(buf)-1] ^= 0x80
+	if _, err := UnmarshalChecksummed(buf); err != ErrChecksum {
+		t.Errorf("corrupted checksum: got %v, expected ErrChecksum", err)
+	}
+
+	// Missing checksum
+	plain, _ := creq.MarshalBinary()
+	if _, err := UnmarshalChecksummed(plain); !errors.Is(err, ErrProtocol) {
+		t.Errorf("missing checksum: got %v, expected protocol error", err)
+	}
+}
+
+func TestReadFromChecksummed(t *testing.T) {
+	for _, pkt := range samplePackets {
+		if HeaderOf(pkt).Version < 2 {
+			continue
+		}
+		buf, _ := MarshalChecksummed(pkt)
+		r := datagramReader{buf}
+		cpy, err := ReadFrom(&r)
+		if err != nil {
+			t.Errorf("ReadFrom(checksummed %T) failed: %v", pkt, err)
+		} else if !reflect.DeepEqual(pkt, cpy) {
+			t.Errorf("packets not equal: %+v != %+v", pkt, cpy)
+		}
+	}
+}
+
+func TestDecoderChecksum(t *testing.T) {
+	var expected []PuncherPacket
+	var stream, prefixed bytes.Buffer
+	for _, pkt := range samplePackets {
+		if HeaderOf(pkt).Version < 2 {
+			continue
+		}
+		buf, err := MarshalChecksummed(pkt)
+		if err != nil {
+			t.Fatalf("MarshalChecksummed(%T) failed: %v", pkt, err)
+		}
+		expected = append(expected, pkt)
+		stream.Write(buf)
+		prefixed.Write([]byte{byte(len(buf)), byte(len(buf) >> 8)})
+		prefixed.Write(buf)
+	}
+	raw := stream.Bytes()
+	for _, d := range []*Decoder{
+		NewDecoder(bytes.NewReader(raw), ExpectChecksum()),
+		NewDecoder(&prefixed, ExpectChecksum(), ExpectLengthPrefix()),
+	} {
+		for _, pkt := range expected {
+			cpy, err := d.Decode()
+			if err != nil {
+				t.Fatalf("Decode failed: %v", err)
+			}
+			if !reflect.DeepEqual(pkt, cpy) {
+				t.Errorf("packets not equal: %+v != %+v", pkt, cpy)
+			}
+		}
+		if _, err := d.Decode(); err != io.EOF {
+			t.Errorf("expected io.EOF, got %v", err)
+		}
+	}
+
+	corrupted := append([]byte(nil), raw...)
+	corrupted[HeaderSize] ^= 0x01
+	d := NewDecoder(bytes.NewReader(corrupted), ExpectChecksum())
+	if _, err := d.Decode(); err != ErrChecksum {
+		t.Errorf("corrupted message: got %v, expected ErrChecksum", err)
+	}
+	n, _ := MessageLen(raw)
+	d = NewDecoder(bytes.NewReader(raw[:n+ChecksumSize-1]), ExpectChecksum())
+	if _, err := d.Decode(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated checksum: got %v, expected io.ErrUnexpectedEOF", err)
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "time"
+
+// recentAddrs remembers addresses for a short time so that duplicate CReqs
+// (retransmissions by the server) don't start redundant punch attempts.
+type recentAddrs struct {
+	ttl  time.Duration
+	now  func() time.Time
+	seen map[string]time.Time
+}
+
+func newRecentAddrs(ttl time.Duration) *recentAddrs {
+	return &recentAddrs{ttl: ttl, now: time.Now, seen: make(map[string]time.Time)}
+}
+
+// first returns whether addr was not seen within the TTL and remembers it.
+func (r *recentAddrs) first(addr string) bool {
+	now := r.now()
+	for a, t := range r.seen {
+		if now.Sub(t) >= r.ttl {
+			delete(r.seen, a)
+		}
+	}
+	if _, ok := r.seen[addr]; ok {
+		return false
+	}
+	r.seen[addr] = now
+	return true
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+// datagramReader returns one of its datagrams per Read, then io.EOF.
+type datagramReader [][]byte
+
+func (r *datagramReader) Read(b []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, (*r)[0])
+	*r = (*r)[1:]
+	return n, nil
+}
+
+func TestHandleMessagesDedup(t *testing.T) {
+	punched := make(chan string, 10)
+	punchUDPFunc = func(_ *c4netioudp.Listener, raddr *net.UDPAddr, _ bool) error {
+		punched <- raddr.String()
+		return nil
+	}
+	defer func() { punchUDPFunc = punchUDP }()
+
+	header := netpuncher.Header{Version: 2}
+	a := net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	b := net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 11113}
+	var r datagramReader
+	for _, p := range []netpuncher.PuncherPacket{
+		&netpuncher.CReq{Header: header, Addr: a},
+		&netpuncher.CReq{Header: header, Addr: a},
+		&netpuncher.CReq{Header: header, Addr: b},
+		&netpuncher.CReqRelay{Header: header, Direct: &a},
+		&netpuncher.CReq{Header: header, Addr: b},
+	} {
+		buf, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = append(r, buf)
+	}
+	if err := handleMessages(nil, &r, newHandshake(), false); err != io.EOF {
+		t.Fatalf("got %v, expected io.EOF", err)
+	}
+
+	// Punching runs in the background.
+	attempts := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case addr := <-punched:
+			attempts[addr]++
+		case <-time.After(time.Second):
+			t.Fatalf("punch attempts %v, expected one per address", attempts)
+		}
+	}
+	select {
+	case addr := <-punched:
+		attempts[addr]++
+	case <-time.After(50 * time.Millisecond):
+	}
+	if len(attempts) != 2 || attempts[a.String()] != 1 || attempts[b.String()] != 1 {
+		t.Errorf("punch attempts %v, expected one per address", attempts)
+	}
+}
+
+func TestRecentAddrs(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := newRecentAddrs(punchTimeout)
+	r.now = func() time.Time { return now }
+
+	a := net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	if !r.first(a.String()) || r.first(a.String()) {
+		t.Error("address not remembered")
+	}
+	now = now.Add(punchTimeout)
+	if !r.first(a.String()) {
+		t.Error("address still ignored after TTL")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// errHandshakeTimeout is returned if the netpuncher didn't reply in time.
+type errHandshakeTimeout struct {
+	phase  string // reply which didn't arrive, "AssID" or "CReq"
+	waited time.Duration
+}
+
+func (e errHandshakeTimeout) Error() string {
+	return fmt.Sprintf("no %s received within %v", e.phase, e.waited)
+}
+
+// handshake lets the main goroutine wait for the replies which
+// handleMessages receives.
+type handshake struct {
+	assid chan uint32
+	creq  chan struct{}
+	after func(time.Duration) <-chan time.Time
+}
+
+func newHandshake() *handshake {
+	return &handshake{
+		assid: make(chan uint32, 1),
+		creq:  make(chan struct{}, 1),
+		after: time.After,
+	}
+}
+
+// gotAssID signals that an AssID arrived. Doesn't block.
+func (h *handshake) gotAssID(cid uint32) {
+	select {
+	case h.assid <- cid:
+	default:
+	}
+}
+
+// gotCReq signals that a CReq or one of its TCP or relay variants arrived.
+// Doesn't block.
+func (h *handshake) gotCReq() {
+	select {
+	case h.creq <- struct{}{}:
+	default:
+	}
+}
+
+// waitAssID waits for the AssID in reply to an IDReq.
+func (h *handshake) waitAssID(timeout time.Duration) (uint32, error) {
+	select {
+	case cid := <-h.assid:
+		return cid, nil
+	case <-h.after(timeout):
+		return 0, errHandshakeTimeout{"AssID", timeout}
+	}
+}
+
+// waitCReq calls send and waits for a CReq. As the CReq depends on the host
+// answering the netpuncher as well, send is repeated up to retries times,
+// doubling the wait each time.
+func (h *handshake) waitCReq(send func() error, timeout time.Duration, retries int) error {
+	var waited time.Duration
+	for i := 0; ; i++ {
+		if err := send(); err != nil {
+			return err
+		}
+		select {
+		case <-h.creq:
+			return nil
+		case <-h.after(timeout):
+		}
+		waited += timeout
+		if i == retries {
+			return errHandshakeTimeout{"CReq", waited}
+		}
+		timeout *= 2
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expire makes waits time out immediately and records their durations.
+func expire(h *handshake) *[]time.Duration {
+	var waits []time.Duration
+	h.after = func(d time.Duration) <-chan time.Time {
+		waits = append(waits, d)
+		c := make(chan time.Time, 1)
+		c <- time.Time{}
+		return c
+	}
+	return &waits
+}
+
+func TestHandshakeAssIDTimeout(t *testing.T) {
+	h := newHandshake()
+	h.gotAssID(1337)
+	if cid, err := h.waitAssID(time.Second); err != nil || cid != 1337 {
+		t.Errorf("got %d, %v, expected 1337", cid, err)
+	}
+
+	expire(h)
+	_, err := h.waitAssID(time.Second)
+	if e, ok := err.(errHandshakeTimeout); !ok || e.phase != "AssID" {
+		t.Errorf("got %v, expected AssID timeout", err)
+	}
+}
+
+func TestHandshakeCReqTimeout(t *testing.T) {
+	h := newHandshake()
+	waits := expire(h)
+	sent := 0
+	send := func() error {
+		sent++
+		return nil
+	}
+	err := h.waitCReq(send, time.Second, 2)
+	if e, ok := err.(errHandshakeTimeout); !ok || e.phase != "CReq" || e.waited != 7*time.Second {
+		t.Errorf("got %v, expected CReq timeout after 7s", err)
+	}
+	if sent != 3 {
+		t.Errorf("SReq sent %d times, expected 3", sent)
+	}
+	if expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !reflect.DeepEqual(*waits, expected) {
+		t.Errorf("waited %v, expected %v", *waits, expected)
+	}
+
+	// The CReq arrives after the first retransmission.
+	h = newHandshake()
+	sent = 0
+	send = func() error {
+		sent++
+		if sent == 2 {
+			h.gotCReq()
+		}
+		return nil
+	}
+	h.after = func(d time.Duration) <-chan time.Time {
+		if sent == 1 {
+			return time.After(0)
+		}
+		return time.After(time.Hour)
+	}
+	if err := h.waitCReq(send, time.Second, 2); err != nil || sent != 2 {
+		t.Errorf("got %v after %d requests, expected success after 2", err, sent)
+	}
+}
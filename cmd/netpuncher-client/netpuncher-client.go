@@ -2,8 +2,10 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/signal"
@@ -27,6 +29,9 @@ var port = flag.Int("port", 0, "local port to use (default: random)")
 var v4 = flag.Bool("4", false, "use IPv4")
 var v6 = flag.Bool("6", false, "use IPv6")
 var verbose = flag.Bool("v", false, "more log output")
+var assidTimeout = flag.Duration("assid-timeout", 5*time.Second, "time to wait for an id as host")
+var creqTimeout = flag.Duration("creq-timeout", time.Second, "initial time to wait for the punch request as client, doubled on each retry")
+var creqRetries = flag.Int("creq-retries", 3, "number of times to repeat the punch request as client")
 
 func main() {
 	flag.Usage = func() {
@@ -76,25 +81,40 @@ func main() {
 	// The following uses version 1 of the netpuncher protocol.
 	header := netpuncher.Header{Version: 1}
 
+	hs := newHandshake()
 	if *client >= 0 {
-		// Request punching for the given host id.
-		sreq := netpuncher.SReq{Header: header, CID: uint32(*client)}
-		b, err := sreq.MarshalBinary()
-		if err != nil {
-			log.WithError(err).Fatal("SReq.MarshalBinary failed")
-		}
-		conn.Write(b)
-		log.WithField("packet", fmt.Sprintf("%+v", sreq)).Infof("-> %T", sreq)
-		go handleMessages(listener, conn, false)
-		if *v6 {
-			// IPv6 => also request TCP punching
-			sreqtcp := netpuncher.SReqTCP{Header: header, CID: uint32(*client)}
-			b, err = sreqtcp.MarshalBinary()
+		// Request punching for the given host id, repeating the request
+		// until the netpuncher replies.
+		go func() {
+			err := handleMessages(listener, conn, hs, false)
+			log.WithError(err).Fatal("reading from netpuncher failed")
+		}()
+		send := func() error {
+			sreq := netpuncher.SReq{Header: header, CID: uint32(*client)}
+			b, err := sreq.MarshalBinary()
 			if err != nil {
-				log.WithError(err).Fatal("SReqTCP.MarshalBinary failed")
+				log.WithError(err).Fatal("SReq.MarshalBinary failed")
+			}
+			if _, err := conn.Write(b); err != nil {
+				return err
 			}
-			conn.Write(b)
-			log.WithField("packet", fmt.Sprintf("%+v", sreqtcp)).Infof("-> %T", sreqtcp)
+			log.WithField("packet", fmt.Sprintf("%+v", sreq)).Infof("-> %T", sreq)
+			if *v6 {
+				// IPv6 => also request TCP punching
+				sreqtcp := netpuncher.SReqTCP{Header: header, CID: uint32(*client)}
+				b, err = sreqtcp.MarshalBinary()
+				if err != nil {
+					log.WithError(err).Fatal("SReqTCP.MarshalBinary failed")
+				}
+				if _, err := conn.Write(b); err != nil {
+					return err
+				}
+				log.WithField("packet", fmt.Sprintf("%+v", sreqtcp)).Infof("-> %T", sreqtcp)
+			}
+			return nil
+		}
+		if err := hs.waitCReq(send, *creqTimeout, *creqRetries); err != nil {
+			log.WithError(err).Fatal("punch request failed")
 		}
 		time.Sleep(10 * time.Second)
 	}
@@ -105,8 +125,14 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+		go func() {
+			err := handleMessages(listener, conn, hs, true)
+			log.WithError(err).Fatal("reading from netpuncher failed")
+		}()
 		conn.Write(b)
-		go handleMessages(listener, conn, true)
+		if _, err := hs.waitAssID(*assidTimeout); err != nil {
+			log.WithError(err).Fatal("id request failed")
+		}
 		go handleConn(listener)
 		// Wait for an interrupt. Without this special handling, the connection
 		// would not be closed properly.
@@ -116,73 +142,124 @@ func main() {
 	}
 }
 
-// Handle and print incoming messages.
-func handleMessages(listener *c4netioudp.Listener, npconn *c4netioudp.Conn, isHost bool) {
+// punchUDPFunc starts punching for CReqs, replaced by tests.
+var punchUDPFunc = punchUDP
+
+// Handle and print incoming messages until reading from npconn fails.
+func handleMessages(listener *c4netioudp.Listener, npconn io.Reader, hs *handshake, isHost bool) error {
+	recent := newRecentAddrs(punchTimeout)
 	for {
 		msg, err := netpuncher.ReadFrom(npconn)
+		if future, ok := err.(netpuncher.ErrFutureVersion); ok {
+			log.WithError(err).Warnf("ignoring message 0x%x from newer netpuncher", future.Type)
+			continue
+		}
 		if err != nil {
-			log.WithError(err).Fatal("reading from netpuncher failed")
+			return err
+		}
+		if err := msg.Validate(); err != nil {
+			log.WithError(err).WithField("packet", fmt.Sprintf("%+v", msg)).Warnf("ignoring invalid %T", msg)
+			continue
 		}
 		switch np := msg.(type) {
 		case *netpuncher.AssID:
 			log.Warnf("CID = %d", np.CID)
+			hs.gotAssID(np.CID)
 		case *netpuncher.CReq:
 			log.WithField("packet", fmt.Sprintf("%+v", msg)).Infof("<- %T", msg)
+			hs.gotCReq()
+			if !recent.first(np.Addr.String()) {
+				log.WithField("raddr", np.Addr.String()).Debug("ignoring duplicate CReq")
+				continue
+			}
 			go func() {
-				// Try to establish communication.
-				if err = listener.Punch(&np.Addr, punchTimeout, punchInterval); err != nil {
+				if err := punchUDPFunc(listener, np.UDPAddr(), isHost); err != nil {
 					log.WithError(err).WithField("raddr", np.Addr.String()).Error("punching failed")
-					return
-				}
-				if !isHost {
-					log.WithField("raddr", np.Addr.String()).Info("connecting...")
-					hostconn, err := listener.Dial(&np.Addr)
-					if err != nil {
-						log.WithError(err).Error("couldn't connect to host")
-						return
-					}
-					defer hostconn.Close()
-					log.WithField("raddr", np.Addr.String()).Info("connected successfully")
-					_, err = hostconn.Write([]byte("Hello world!"))
-					if err != nil {
-						log.WithError(err).WithField("raddr", np.Addr.String()).Error("couldn't send message to host")
-					}
 				}
 			}()
-		case *netpuncher.CReqTCP:
+		case *netpuncher.CReqRelay:
 			log.WithField("packet", fmt.Sprintf("%+v", msg)).Infof("<- %T", msg)
+			hs.gotCReq()
+			if !recent.first(relayKey(np)) {
+				log.WithField("key", relayKey(np)).Debug("ignoring duplicate CReqRelay")
+				continue
+			}
 			go func() {
-				log.WithField("raddr", np.DestAddr.String()).Info("connecting TCP...")
-				conn, err := net.DialTCP("tcp6", &np.SourceAddr, &np.DestAddr)
-				if err != nil {
-					log.WithError(err).WithField("raddr", np.DestAddr.String()).Error("couldn't dial")
-					return
-				}
-				defer conn.Close()
-				log.WithField("raddr", np.DestAddr.String()).Info("connected TCP successfully")
-				if !isHost {
-					// send a message
-					_, err = conn.Write([]byte("Hello TCP world!\n"))
-					if err != nil {
-						log.WithError(err).WithField("raddr", np.DestAddr.String()).Error("couldn't send TCP message to host")
-					}
-				} else {
-					// receive message
-					r := bufio.NewReader(conn)
-					msg, err := r.ReadString('\n')
-					if err != nil {
-						log.WithError(err).WithField("raddr", np.DestAddr.String()).Error("couldn't read TCP message from client")
-						return
-					}
-					log.WithField("raddr", np.DestAddr.String()).Infof("received: %s", msg)
+				if err := punchOrRelay(listener, np, isHost); err != nil {
+					log.WithError(err).WithField("key", relayKey(np)).Error("punching failed")
 				}
 			}()
+		case *netpuncher.CReqTCP:
+			log.WithField("packet", fmt.Sprintf("%+v", msg)).Infof("<- %T", msg)
+			hs.gotCReq()
+			go punchTCP([]netpuncher.CReqTCP{*np}, isHost)
+		case *netpuncher.CReqTCPMulti:
+			log.WithField("packet", fmt.Sprintf("%+v", msg)).Infof("<- %T", msg)
+			hs.gotCReq()
+			go punchTCP(np.CReqTCPs(), isHost)
 		default:
 			log.WithField("packet", fmt.Sprintf("%+v", msg)).Infof("<- %T", msg)
 		}
 	}
 }
 
+// Punches towards raddr and, if not the host, connects to it. Returns an
+// error only if punching fails.
+func punchUDP(listener *c4netioudp.Listener, raddr *net.UDPAddr, isHost bool) error {
+	// Try to establish communication.
+	if err := listener.Punch(raddr, punchTimeout, punchInterval); err != nil {
+		return err
+	}
+	if !isHost {
+		log.WithField("raddr", raddr.String()).Info("connecting...")
+		hostconn, err := listener.Dial(raddr)
+		if err != nil {
+			log.WithError(err).Error("couldn't connect to host")
+			return nil
+		}
+		defer hostconn.Close()
+		log.WithField("raddr", raddr.String()).Info("connected successfully")
+		_, err = hostconn.Write([]byte("Hello world!"))
+		if err != nil {
+			log.WithError(err).WithField("raddr", raddr.String()).Error("couldn't send message to host")
+		}
+	}
+	return nil
+}
+
+// Tries TCP simultaneous open for each request in order until one succeeds.
+func punchTCP(reqs []netpuncher.CReqTCP, isHost bool) {
+	for _, np := range reqs {
+		log.WithField("raddr", np.DestAddr.String()).Info("connecting TCP...")
+		ctx, cancel := context.WithTimeout(context.Background(), punchTimeout)
+		conn, err := np.Dial(ctx)
+		cancel()
+		if err != nil {
+			log.WithError(err).WithField("raddr", np.DestAddr.String()).Error("couldn't dial")
+			continue
+		}
+		defer conn.Close()
+		log.WithField("raddr", np.DestAddr.String()).Info("connected TCP successfully")
+		if !isHost {
+			// send a message
+			_, err = conn.Write([]byte("Hello TCP world!\n"))
+			if err != nil {
+				log.WithError(err).WithField("raddr", np.DestAddr.String()).Error("couldn't send TCP message to host")
+			}
+		} else {
+			// receive message
+			r := bufio.NewReader(conn)
+			msg, err := r.ReadString('\n')
+			if err != nil {
+				log.WithError(err).WithField("raddr", np.DestAddr.String()).Error("couldn't read TCP message from client")
+				return
+			}
+			log.WithField("raddr", np.DestAddr.String()).Infof("received: %s", msg)
+		}
+		return
+	}
+}
+
 // Handles new host connections.
 func handleConn(listener *c4netioudp.Listener) {
 	for {
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+
+	"github.com/apex/log"
+)
+
+// relayKey returns the key for deduplicating np, see recentAddrs. CReqRelay
+// with a direct address shares the key with a CReq for the same address.
+func relayKey(np *netpuncher.CReqRelay) string {
+	if np.Direct != nil {
+		return np.Direct.String()
+	}
+	return fmt.Sprintf("relay %v %x", np.Relay, np.Token)
+}
+
+// Punches towards the direct address of np and falls back to its relay if
+// that fails or there is no direct address.
+func punchOrRelay(listener *c4netioudp.Listener, np *netpuncher.CReqRelay, isHost bool) error {
+	if np.Direct != nil {
+		err := punchUDPFunc(listener, np.Direct, isHost)
+		if err == nil || np.Relay == nil {
+			return err
+		}
+		log.WithError(err).WithField("raddr", np.Direct.String()).Warn("punching failed, falling back to relay")
+	}
+	return useRelay(listener, np.Relay, np.Token, isHost)
+}
+
+// Connects to the relay, identifies with token and then exchanges a message
+// like over a punched connection.
+func useRelay(listener *c4netioudp.Listener, relay *net.UDPAddr, token uint64, isHost bool) error {
+	log.WithField("relay", relay.String()).Info("connecting to relay...")
+	conn, err := listener.Dial(relay)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], token)
+	if _, err := conn.Write(b[:]); err != nil {
+		return err
+	}
+	log.WithField("relay", relay.String()).Info("connected to relay successfully")
+	if !isHost {
+		if _, err := conn.Write([]byte("Hello world!")); err != nil {
+			log.WithError(err).WithField("relay", relay.String()).Error("couldn't send message to host")
+		}
+		return nil
+	}
+	var buf [100]byte
+	n, err := conn.Read(buf[:])
+	if err != nil {
+		log.WithError(err).WithField("relay", relay.String()).Error("couldn't read message from client")
+		return nil
+	}
+	log.WithField("relay", relay.String()).Infof("received: %s", string(buf[0:n]))
+	return nil
+}
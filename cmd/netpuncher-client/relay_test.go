@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+func TestRelayKey(t *testing.T) {
+	direct := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	relay := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 11115}
+	r := newRecentAddrs(punchTimeout)
+	if !r.first(direct.String()) {
+		t.Fatal("first CReq ignored")
+	}
+	if r.first(relayKey(&netpuncher.CReqRelay{Direct: direct, Relay: relay, Token: 1})) {
+		t.Error("CReqRelay for the same direct address not ignored")
+	}
+	if !r.first(relayKey(&netpuncher.CReqRelay{Relay: relay, Token: 1})) {
+		t.Error("relay-only CReqRelay ignored")
+	}
+	if r.first(relayKey(&netpuncher.CReqRelay{Relay: relay, Token: 1})) {
+		t.Error("duplicate relay-only CReqRelay not ignored")
+	}
+	if !r.first(relayKey(&netpuncher.CReqRelay{Relay: relay, Token: 2})) {
+		t.Error("CReqRelay with other token ignored")
+	}
+}
+
+func TestPunchOrRelay(t *testing.T) {
+	relay, err := c4netioudp.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer relay.Close()
+	listener, err := c4netioudp.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	// As host, the relayed connection is used to receive a message.
+	np := &netpuncher.CReqRelay{Relay: relay.Addr().(*net.UDPAddr), Token: 0x0123456789abcdef}
+	errs := make(chan error, 1)
+	go func() { errs <- punchOrRelay(listener, np, true) }()
+
+	tokens := make(chan []byte, 1)
+	go func() {
+		conn, err := relay.AcceptConn()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 100)
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		tokens <- buf[:n]
+		conn.Write([]byte("Hello world!"))
+	}()
+	select {
+	case b := <-tokens:
+		if len(b) != 8 || binary.LittleEndian.Uint64(b) != np.Token {
+			t.Errorf("relay received %x, expected token %x", b, np.Token)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for token")
+	}
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("punchOrRelay: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for message")
+	}
+}
@@ -1,12 +1,17 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/openclonk/netpuncher"
 	"github.com/openclonk/netpuncher/c4netioudp"
@@ -33,6 +38,10 @@ var (
 		Name: "netpuncher_creq_total",
 		Help: "Number of CReq messages processed by the netpuncher",
 	}, []string{"protocol"})
+	punchResultCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "netpuncher_punch_results_total",
+		Help: "Number of punch results reported by clients",
+	}, []string{"protocol", "result"})
 	errorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "netpuncher_errors_total",
 		Help: "Number of non-fatal errors during packet handling",
@@ -44,6 +53,7 @@ func init() {
 	prometheus.MustRegister(disconnectCounter)
 	prometheus.MustRegister(hostCounter)
 	prometheus.MustRegister(creqCounter)
+	prometheus.MustRegister(punchResultCounter)
 	prometheus.MustRegister(errorCounter)
 }
 
@@ -58,6 +68,68 @@ func protocol(addr net.Addr) string {
 	return "unknown"
 }
 
+// envInt returns the integer in the environment variable name, def if it's
+// unset.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return i
+}
+
+// envDuration returns the duration in the environment variable name, def if
+// it's unset.
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// envBool returns the boolean in the environment variable name, def if it's
+// unset.
+func envBool(name string, def bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return b
+}
+
+// writeFileAtomic replaces the file name with b via a temporary file, so that
+// a crash while writing doesn't leave a truncated file behind.
+func writeFileAtomic(name string, b []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
 func main() {
 	listenaddr := net.UDPAddr{IP: net.IPv6unspecified, Port: 11115}
 	if p, err := strconv.Atoi(os.Getenv("PORT")); err == nil {
@@ -97,11 +169,55 @@ func main() {
 			// anyways.
 			creqCounter.With(prometheus.Labels{"protocol": protocol(clientaddr)}).Inc()
 		},
+		RejectPunch: func(host, client *server.Conn, code netpuncher.ErrorCode) {
+			clientaddr := client.NetIOConn.RemoteAddr()
+			log.Printf("rejected punch: client %v <--> host %v #%d (%v)\n", clientaddr, host.NetIOConn.RemoteAddr(), host.ID, code)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(clientaddr), "reason": "rejected punch"}).Inc()
+		},
+		PunchResult: func(c *server.Conn, cid uint32, success bool) {
+			addr := c.NetIOConn.RemoteAddr()
+			result := "failure"
+			if success {
+				result = "success"
+			}
+			log.Printf("result:  %v #%d -> #%d: %s\n", addr, c.ID, cid, result)
+			punchResultCounter.With(prometheus.Labels{"protocol": protocol(addr), "result": result}).Inc()
+		},
+		DropCReq: func(dest net.Addr) {
+			log.Printf("dropped CReq to %v: rate limit exceeded\n", dest)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(dest), "reason": "rate limited"}).Inc()
+		},
+		SendErr: func(c *server.Conn, err error) {
+			addr := c.NetIOConn.RemoteAddr()
+			log.Printf("send:    %v #%d: %v\n", addr, c.ID, err)
+			errorCounter.With(prometheus.Labels{"protocol": protocol(addr), "reason": "send failed"}).Inc()
+		},
+		DropMessage: func(c *server.Conn, p netpuncher.PuncherPacket) {
+			errorCounter.With(prometheus.Labels{"protocol": protocol(c.NetIOConn.RemoteAddr()), "reason": "queue full"}).Inc()
+		},
+		DenySource: func(src net.Addr) {
+			errorCounter.With(prometheus.Labels{"protocol": protocol(src), "reason": "denied"}).Inc()
+		},
 		CloseConn: func(c *server.Conn, err *c4netioudp.ErrConnectionClosed) {
 			addr := c.NetIOConn.RemoteAddr()
 			log.Printf("close:   %v #%d (%s)\n", addr, c.ID, err)
 			disconnectCounter.With(prometheus.Labels{"protocol": protocol(addr)}).Inc()
 		},
+		QueueSize:        envInt("QUEUE_SIZE", 1024),
+		CReqLimit:        envInt("CREQ_LIMIT", 60),
+		CReqLimitWindow:  envDuration("CREQ_LIMIT_WINDOW", time.Minute),
+		DetectLocalAddrs: envBool("DETECT_LOCAL_ADDRS", true),
+	}
+
+	registryFile := os.Getenv("REGISTRY_FILE")
+	if registryFile != "" {
+		if b, err := ioutil.ReadFile(registryFile); err == nil {
+			if err := server.Registry().Import(b); err != nil {
+				log.Printf("couldn't restore registry: %v", err)
+			}
+		} else if !os.IsNotExist(err) {
+			log.Printf("couldn't restore registry: %v", err)
+		}
 	}
 
 	err := server.Listen("udp", &listenaddr)
@@ -114,12 +230,27 @@ func main() {
 	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
 		log.Printf("metrics listening on %s", addr)
 		http.Handle("/metrics", promhttp.Handler())
-		go log.Fatal(http.ListenAndServe(addr, nil))
+		http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(server.Registry().Snapshot())
+		})
+		go func() {
+			log.Fatal(http.ListenAndServe(addr, nil))
+		}()
 	}
 
-	// Wait for an interrupt. Without this special handling, the connection
-	// would not be closed properly.
+	// Wait for an interrupt, or termination by a service manager on restart.
+	// Without this special handling, the connection would not be closed
+	// properly.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
+
+	// Save the registrations so that hosts get their CIDs back after a
+	// restart.
+	if registryFile != "" {
+		if err := writeFileAtomic(registryFile, server.Registry().Export()); err != nil {
+			log.Printf("couldn't save registry: %v", err)
+		}
+	}
 }
@@ -0,0 +1,37 @@
+package netpuncher
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// CompressedWriter is an Encoder for capture files that compresses the
+// message stream with DEFLATE. This is not part of the wire protocol.
+type CompressedWriter struct {
+	*Encoder
+	fw *flate.Writer
+}
+
+// NewCompressedWriter returns a CompressedWriter writing to w.
+func NewCompressedWriter(w io.Writer) *CompressedWriter {
+	// flate.NewWriter only fails for invalid compression levels.
+	fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+	return &CompressedWriter{Encoder: NewEncoder(fw), fw: fw}
+}
+
+// Flush writes any pending compressed data to the underlying writer.
+func (w *CompressedWriter) Flush() error {
+	return w.fw.Flush()
+}
+
+// Close flushes and terminates the compressed stream. It does not close the
+// underlying writer.
+func (w *CompressedWriter) Close() error {
+	return w.fw.Close()
+}
+
+// NewCompressedReader returns a Decoder reading a stream written by a
+// CompressedWriter.
+func NewCompressedReader(r io.Reader) *Decoder {
+	return NewDecoder(flate.NewReader(r))
+}
@@ -0,0 +1,43 @@
+package netpuncher
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestCompressedRoundtrip(t *testing.T) {
+	var packets []PuncherPacket
+	for i := 0; i < 1000; i++ {
+		packets = append(packets, samplePackets[i%len(samplePackets)])
+	}
+
+	var buf bytes.Buffer
+	w := NewCompressedWriter(&buf)
+	for _, pkt := range packets {
+		if err := w.Encode(pkt); err != nil {
+			t.Fatalf("Encode(%T) failed: %v", pkt, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if uncompressed := len(marshalAll(t, packets)); buf.Len() >= uncompressed {
+		t.Errorf("compressed size %d not smaller than uncompressed size %d", buf.Len(), uncompressed)
+	}
+
+	r := NewCompressedReader(&buf)
+	for i, expected := range packets {
+		pkt, err := r.Decode()
+		if err != nil {
+			t.Fatalf("Decode of packet %d failed: %v", i, err)
+		}
+		if !reflect.DeepEqual(pkt, expected) {
+			t.Fatalf("packet %d not equal: %+v != %+v", i, pkt, expected)
+		}
+	}
+	if _, err := r.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
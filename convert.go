@@ -0,0 +1,89 @@
+package netpuncher
+
+import "fmt"
+
+// Convert returns a copy of p for protocol version to, e.g. for a proxy
+// between version 1 and version 2 peers. Fields added in a newer version are
+// left zero when upgrading. Downgrading fails if the message type or one of
+// the fields in use doesn't exist in the target version. BigEndianPorts is
+// only an encoding detail and dropped silently.
+func Convert(p PuncherPacket, to ProtocolVersion) (PuncherPacket, error) {
+	p = Unwrap(p)
+	if !to.Supported() {
+		return nil, ErrUnsupportedVersion(to)
+	}
+	if min, _ := minVersion(p.Type()); to < min {
+		return nil, fmt.Errorf("netpuncher: can't convert %T to %v, it requires %v: %w", p, to, min, ErrUnsupportedVersion(to))
+	}
+	if to < 2 {
+		if field := v2Field(p); field != "" {
+			return nil, fmt.Errorf("netpuncher: can't convert %T to %v, field %s requires v2: %w", p, to, field, ErrUnsupportedVersion(to))
+		}
+	}
+	// Decoding a fresh encoding gives a copy which shares no memory with p.
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	q, err := unmarshal(b)
+	if err != nil {
+		return nil, err
+	}
+	q.(headerPacket).header().Version = to
+	if to < 2 {
+		clearBigEndianPorts(q)
+	}
+	return q, nil
+}
+
+// v2Field returns the name of a field set in p which doesn't exist in version
+// 1, or "" if there is none.
+func v2Field(p PuncherPacket) string {
+	switch p := p.(type) {
+	case *IDReq:
+		switch {
+		case p.Transports != 0:
+			return "Transports"
+		case p.PreferredAddr != nil:
+			return "PreferredAddr"
+		case p.Padding:
+			return "Padding"
+		case len(p.Metadata) > 0:
+			return "Metadata"
+		case len(p.Identity) > 0:
+			return "Identity"
+		case p.Nonce != 0:
+			return "Nonce"
+		}
+	case *AssID:
+		if p.Nonce != 0 {
+			return "Nonce"
+		}
+	case *CReq:
+		switch {
+		case p.Timestamp != 0:
+			return "Timestamp"
+		case p.Nonce != 0:
+			return "Nonce"
+		}
+	case *CReqTCP:
+		switch {
+		case p.Retry != nil:
+			return "Retry"
+		case p.Nonce != 0:
+			return "Nonce"
+		}
+	}
+	return ""
+}
+
+func clearBigEndianPorts(p PuncherPacket) {
+	switch p := p.(type) {
+	case *IDReq:
+		p.BigEndianPorts = false
+	case *CReq:
+		p.BigEndianPorts = false
+	case *CReqTCP:
+		p.BigEndianPorts = false
+	}
+}
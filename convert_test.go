@@ -0,0 +1,60 @@
+package netpuncher
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	v1 := &CReq{Header: Header{PID_Puncher_CReq, 1}, Addr: addr}
+	p, err := Convert(v1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: addr}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("got %+v, expected %+v", p, expected)
+	}
+	// The result is a copy.
+	p.(*CReq).Addr.IP[0] = 0
+	if v1.Addr.IP[0] == 0 {
+		t.Error("converted packet shares memory with the original")
+	}
+
+	// And back again.
+	if p, err = Convert(expected, 1); err != nil || !reflect.DeepEqual(p, v1) {
+		t.Errorf("downgrade: got %+v, %v, expected %+v", p, err, v1)
+	}
+	be := *expected
+	be.BigEndianPorts = true
+	if p, err = Convert(&be, 1); err != nil || !reflect.DeepEqual(p, v1) {
+		t.Errorf("downgrade with big-endian ports: got %+v, %v, expected %+v", p, err, v1)
+	}
+}
+
+func TestConvertErrors(t *testing.T) {
+	tests := []struct {
+		p    PuncherPacket
+		to   ProtocolVersion
+		want string
+	}{
+		{&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 1337}, 1, "*netpuncher.SReqV2 to v1, it requires v2"},
+		{&CReq{Header: Header{PID_Puncher_CReq, 2}, Timestamp: 42}, 1, "field Timestamp requires v2"},
+		{&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Metadata: []byte("x")}, 1, "field Metadata requires v2"},
+		{&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Identity: []byte("x")}, 1, "field Identity requires v2"},
+		{&AssID{Header: Header{PID_Puncher_AssID, 1}}, 7, "unsupported protocol version v?(7)"},
+	}
+	for _, test := range tests {
+		_, err := Convert(test.p, test.to)
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%T to %v: got error %v, expected %q", test.p, test.to, err, test.want)
+		}
+		if !errors.Is(err, ErrUnsupportedVersion(test.to)) {
+			t.Errorf("%T to %v: error %v isn't ErrUnsupportedVersion", test.p, test.to, err)
+		}
+	}
+}
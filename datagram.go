@@ -0,0 +1,112 @@
+package netpuncher
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// DatagramConn is a message-oriented connection which preserves message
+// boundaries, e.g. a QUIC connection with unreliable datagrams enabled. The
+// method set matches quic-go's Connection, so it can be used directly without
+// this package depending on a QUIC library.
+type DatagramConn interface {
+	SendDatagram(b []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// MsgReader reads netpuncher messages together with the address of their
+// sender. Unlike ReadFrom, this works for transports where one reader
+// receives from several peers.
+type MsgReader interface {
+	ReadMsg() (PuncherPacket, net.Addr, error)
+}
+
+// ErrPartialDatagram is returned for a datagram which holds only the start of
+// a message, e.g. because the sender split it across several datagrams.
+// Messages always have to fit into a single datagram, so this indicates a
+// misbehaving sender rather than corruption. Unwraps to ErrNotReadEnough.
+type ErrPartialDatagram struct {
+	Type     byte
+	Len      int // length of the datagram
+	Expected int // length of the message
+}
+
+func (e ErrPartialDatagram) Error() string {
+	return fmt.Sprintf("netpuncher: datagram of %d byte holds partial message type 0x%x of %d byte", e.Len, e.Type, e.Expected)
+}
+
+func (e ErrPartialDatagram) Unwrap() error { return ErrNotReadEnough(e.Len) }
+
+// UnmarshalDatagram is like Unmarshal for a whole received datagram. It
+// returns ErrPartialDatagram if the datagram is too short for the message
+// type and flags in it.
+func UnmarshalDatagram(b []byte) (PuncherPacket, error) {
+	if len(b) >= HeaderSize {
+		if n, err := MessageLen(b); err == nil && len(b) < n {
+			return nil, ErrPartialDatagram{b[0], len(b), n}
+		}
+	}
+	return Unmarshal(b)
+}
+
+// MessageConn sends and receives netpuncher messages over a DatagramConn.
+// Each datagram carries exactly one message, as with UDP.
+type MessageConn struct {
+	c DatagramConn
+}
+
+// NewMessageConn returns a MessageConn using c.
+func NewMessageConn(c DatagramConn) *MessageConn {
+	return &MessageConn{c: c}
+}
+
+// WriteMessage sends p in a single datagram.
+func (m *MessageConn) WriteMessage(p PuncherPacket) error {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return m.c.SendDatagram(buf)
+}
+
+// ReadMessage receives a single datagram and decodes the message in it.
+func (m *MessageConn) ReadMessage(ctx context.Context) (PuncherPacket, error) {
+	buf, err := m.c.ReceiveDatagram(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return UnmarshalDatagram(buf)
+}
+
+// ReadMsg implements MsgReader. The address is the DatagramConn's
+// RemoteAddr if it has such a method, nil otherwise.
+func (m *MessageConn) ReadMsg() (PuncherPacket, net.Addr, error) {
+	var addr net.Addr
+	if a, ok := m.c.(interface{ RemoteAddr() net.Addr }); ok {
+		addr = a.RemoteAddr()
+	}
+	p, err := m.ReadMessage(context.Background())
+	return p, addr, err
+}
+
+// DecodeResult is a message decoded by DecodeChan, or the error decoding it.
+type DecodeResult struct {
+	Packet PuncherPacket
+	Err    error
+}
+
+// DecodeChan decodes each datagram received on in and sends the result on the
+// returned channel in order. The output is closed once in is closed, so the
+// caller has to keep receiving until then.
+func DecodeChan(in <-chan []byte) <-chan DecodeResult {
+	out := make(chan DecodeResult)
+	go func() {
+		defer close(out)
+		for b := range in {
+			p, err := UnmarshalDatagram(b)
+			out <- DecodeResult{p, err}
+		}
+	}()
+	return out
+}
@@ -0,0 +1,110 @@
+package netpuncher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// chanDatagramConn is a DatagramConn connected to its peer via channels.
+type chanDatagramConn struct {
+	in, out chan []byte
+}
+
+func (c chanDatagramConn) SendDatagram(b []byte) error {
+	c.out <- append([]byte(nil), b...)
+	return nil
+}
+
+func (c chanDatagramConn) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case b := <-c.in:
+		return b, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestMessageConn(t *testing.T) {
+	ch := make(chan []byte, len(samplePackets))
+	a := NewMessageConn(chanDatagramConn{out: ch})
+	b := NewMessageConn(chanDatagramConn{in: ch})
+	ctx := context.Background()
+	for _, pkt := range samplePackets {
+		if err := a.WriteMessage(pkt); err != nil {
+			t.Fatalf("WriteMessage(%T) failed: %v", pkt, err)
+		}
+		cpy, err := b.ReadMessage(ctx)
+		if err != nil {
+			t.Fatalf("ReadMessage for %T failed: %v", pkt, err)
+		}
+		if !reflect.DeepEqual(pkt, cpy) {
+			t.Errorf("%T packets not equal: %+v != %+v", pkt, pkt, cpy)
+		}
+	}
+
+	// A truncated datagram is rejected.
+	ch <- []byte{PID_Puncher_AssID, 1, 0}
+	if _, err := b.ReadMessage(ctx); err != (ErrPartialDatagram{PID_Puncher_AssID, 3, HeaderSize + 4}) {
+		t.Errorf("unexpected error for truncated datagram: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := b.ReadMessage(ctx); err != context.Canceled {
+		t.Errorf("unexpected error for canceled context: %v", err)
+	}
+}
+
+func TestDecodeChan(t *testing.T) {
+	in := make(chan []byte)
+	out := DecodeChan(in)
+	go func() {
+		for _, pkt := range samplePackets {
+			buf, _ := pkt.MarshalBinary()
+			in <- buf
+			in <- buf[:len(buf)-1]
+		}
+		close(in)
+	}()
+	for _, pkt := range samplePackets {
+		if r := <-out; r.Err != nil || !reflect.DeepEqual(r.Packet, pkt) {
+			t.Errorf("%T: got %+v, %v", pkt, r.Packet, r.Err)
+		}
+		if r := <-out; r.Err == nil || r.Packet != nil {
+			t.Errorf("%T truncated: got %+v, %v", pkt, r.Packet, r.Err)
+		}
+	}
+	if r, ok := <-out; ok {
+		t.Errorf("unexpected result %+v after closing the input", r)
+	}
+}
+
+func TestPartialDatagram(t *testing.T) {
+	p := CReqTCP{Header: Header{Version: 2}, SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1")}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::2")}}
+	buf, _ := p.MarshalBinary()
+	for _, half := range [][]byte{buf[:len(buf)/2], buf[len(buf)/2:]} {
+		_, err := UnmarshalDatagram(half)
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("%x: %v isn't a protocol error", half, err)
+		}
+	}
+	_, err := UnmarshalDatagram(buf[:len(buf)/2])
+	expected := ErrPartialDatagram{PID_Puncher_CReqTCP, len(buf) / 2, len(buf)}
+	if err != expected {
+		t.Errorf("first half: got %v, expected %v", err, expected)
+	}
+	var short ErrNotReadEnough
+	if !errors.As(err, &short) || int(short) != len(buf)/2 {
+		t.Errorf("%v doesn't wrap ErrNotReadEnough", err)
+	}
+	if _, err := ReadFrom(bytes.NewReader(buf[:len(buf)/2])); err != expected {
+		t.Errorf("ReadFrom: got %v, expected %v", err, expected)
+	}
+	if p, err := UnmarshalDatagram(buf); err != nil || p.(*CReqTCP).DestAddr.Port != 0xff22 {
+		t.Errorf("whole datagram: got %+v, %v", p, err)
+	}
+}
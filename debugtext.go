@@ -0,0 +1,229 @@
+package netpuncher
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MarshalDebugText formats p as a single line of the form
+//
+//	CReq v=2 addr=[2001:db8::1]:11113 timestamp=1234
+//
+// for logging and human-editable test fixtures, see ParseDebugText. Fields
+// are named after the struct fields in lower case and omitted if zero. Byte
+// slices are hex-encoded, strings quoted with spaces escaped, RetryHint is
+// written as count/interval and TCP pairs as source>dest separated by commas.
+// This is unrelated to the wire format.
+func MarshalDebugText(p PuncherPacket) string {
+	p = Unwrap(p)
+	v := reflect.ValueOf(p).Elem()
+	var b strings.Builder
+	b.WriteString(v.Type().Name())
+	fmt.Fprintf(&b, " v=%d", HeaderOf(p).Version)
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Anonymous || v.Field(i).IsZero() {
+			continue
+		}
+		fmt.Fprintf(&b, " %s=%s", strings.ToLower(f.Name), formatDebugValue(v.Field(i).Interface()))
+	}
+	return b.String()
+}
+
+func formatDebugValue(x interface{}) string {
+	switch x := x.(type) {
+	case bool:
+		return strconv.FormatBool(x)
+	case string:
+		// Escape spaces so that the value stays a single token.
+		return strings.Replace(strconv.QuoteToASCII(x), " ", `\x20`, -1)
+	case []byte:
+		return hex.EncodeToString(x)
+	case net.UDPAddr:
+		return x.String()
+	case *net.UDPAddr:
+		return x.String()
+	case net.TCPAddr:
+		return x.String()
+	case *RetryHint:
+		return fmt.Sprintf("%d/%v", x.Count, x.Interval)
+	case []TCPPair:
+		pairs := make([]string, len(x))
+		for i, pair := range x {
+			pairs[i] = pair.SourceAddr.String() + ">" + pair.DestAddr.String()
+		}
+		return strings.Join(pairs, ",")
+	}
+	if v := reflect.ValueOf(x); v.Kind() >= reflect.Uint && v.Kind() <= reflect.Uint64 {
+		// Numeric even if the type has a String method like ErrorCode.
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return fmt.Sprint(x)
+}
+
+// debugTypes maps type names to message types for ParseDebugText.
+var debugTypes = func() map[string]byte {
+	types := make(map[string]byte)
+	for typ := 0; typ <= 0xff; typ++ {
+		if p, err := newPacket(byte(typ)); err == nil {
+			types[reflect.TypeOf(p).Elem().Name()] = byte(typ)
+		}
+	}
+	return types
+}()
+
+// ParseDebugText parses a message formatted with MarshalDebugText. Omitted
+// fields are left zero.
+func ParseDebugText(s string) (PuncherPacket, error) {
+	tokens := strings.Fields(s)
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("netpuncher: empty debug text")
+	}
+	typ, ok := debugTypes[tokens[0]]
+	if !ok {
+		return nil, fmt.Errorf("netpuncher: unknown message type %q", tokens[0])
+	}
+	p, _ := newPacket(typ)
+	v := reflect.ValueOf(p).Elem()
+	h := p.(headerPacket).header()
+	h.Type = typ
+	for _, token := range tokens[1:] {
+		i := strings.IndexByte(token, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("netpuncher: expected field=value, got %q", token)
+		}
+		name, value := token[:i], token[i+1:]
+		if name == "v" {
+			version, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("netpuncher: invalid version %q", value)
+			}
+			h.Version = ProtocolVersion(version)
+			continue
+		}
+		field := v.FieldByNameFunc(func(f string) bool { return strings.ToLower(f) == name })
+		if !field.IsValid() || name == "header" {
+			return nil, fmt.Errorf("netpuncher: %s has no field %q", tokens[0], name)
+		}
+		if err := parseDebugValue(field, value); err != nil {
+			return nil, fmt.Errorf("netpuncher: field %s: %v", name, err)
+		}
+	}
+	return p, nil
+}
+
+func parseDebugValue(field reflect.Value, s string) error {
+	switch field.Interface().(type) {
+	case []byte:
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return err
+		}
+		field.SetBytes(b)
+	case net.UDPAddr:
+		addr, err := parseDebugAddr(s)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(net.UDPAddr(addr)))
+	case *net.UDPAddr:
+		addr, err := parseDebugAddr(s)
+		if err != nil {
+			return err
+		}
+		udpaddr := net.UDPAddr(addr)
+		field.Set(reflect.ValueOf(&udpaddr))
+	case net.TCPAddr:
+		addr, err := parseDebugAddr(s)
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(addr))
+	case *RetryHint:
+		i := strings.IndexByte(s, '/')
+		if i < 0 {
+			return fmt.Errorf("expected count/interval, got %q", s)
+		}
+		count, err := strconv.ParseUint(s[:i], 10, 8)
+		if err != nil {
+			return err
+		}
+		interval, err := time.ParseDuration(s[i+1:])
+		if err != nil {
+			return err
+		}
+		field.Set(reflect.ValueOf(&RetryHint{uint8(count), interval}))
+	case []TCPPair:
+		var pairs []TCPPair
+		for _, pair := range strings.Split(s, ",") {
+			i := strings.IndexByte(pair, '>')
+			if i < 0 {
+				return fmt.Errorf("expected source>dest, got %q", pair)
+			}
+			src, err := parseDebugAddr(pair[:i])
+			if err != nil {
+				return err
+			}
+			dest, err := parseDebugAddr(pair[i+1:])
+			if err != nil {
+				return err
+			}
+			pairs = append(pairs, TCPPair{src, dest})
+		}
+		field.Set(reflect.ValueOf(pairs))
+	default:
+		switch field.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(s)
+			if err != nil {
+				return err
+			}
+			field.SetBool(b)
+		case reflect.String:
+			str, err := strconv.Unquote(s)
+			if err != nil {
+				return err
+			}
+			field.SetString(str)
+		case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			n, err := strconv.ParseUint(s, 10, field.Type().Bits())
+			if err != nil {
+				return err
+			}
+			field.SetUint(n)
+		default:
+			return fmt.Errorf("unsupported type %v", field.Type())
+		}
+	}
+	return nil
+}
+
+// parseDebugAddr parses an address formatted by net.UDPAddr.String. IPv4
+// addresses are returned in their 4 byte form.
+func parseDebugAddr(s string) (net.TCPAddr, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return net.TCPAddr{}, err
+	}
+	var zone string
+	if i := strings.LastIndexByte(host, '%'); i >= 0 {
+		host, zone = host[:i], host[i+1:]
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return net.TCPAddr{}, fmt.Errorf("invalid IP %q", host)
+	}
+	if v4 := ip.To4(); v4 != nil && !strings.Contains(host, ":") {
+		ip = v4
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return net.TCPAddr{}, err
+	}
+	return net.TCPAddr{IP: ip, Port: int(n), Zone: zone}, nil
+}
@@ -0,0 +1,53 @@
+package netpuncher
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDebugTextRoundTrip(t *testing.T) {
+	for _, pkt := range samplePackets {
+		text := MarshalDebugText(pkt)
+		p, err := ParseDebugText(text)
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+			continue
+		}
+		// IPv4 addresses may come back in a different form, so compare the
+		// wire format.
+		b1, _ := p.MarshalBinary()
+		b2, _ := pkt.MarshalBinary()
+		if !bytes.Equal(b1, b2) {
+			t.Errorf("%q: packets not equal: %+v != %+v", text, p, pkt)
+		}
+	}
+}
+
+func TestDebugText(t *testing.T) {
+	creq := &CReq{Header: Header{PID_Puncher_CReq, 1}, Addr: net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}}
+	text := "CReq v=1 addr=[2001:db8::1]:11113"
+	if s := MarshalDebugText(creq); s != text {
+		t.Errorf("got %q, expected %q", s, text)
+	}
+	p, err := ParseDebugText(text)
+	if err != nil || !reflect.DeepEqual(p, creq) {
+		t.Errorf("got %+v, %v, expected %+v", p, err, creq)
+	}
+
+	for _, s := range []string{
+		"",
+		"Foo v=2",
+		"CReq v=x",
+		"CReq addr",
+		"CReq port=3",
+		"CReq header=3",
+		"CReq addr=2001:db8::1",
+		"AssID cid=-1",
+	} {
+		if p, err := ParseDebugText(s); err == nil {
+			t.Errorf("%q: expected error, got %+v", s, p)
+		}
+	}
+}
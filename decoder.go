@@ -0,0 +1,444 @@
+package netpuncher
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Decoder reads consecutive messages from a stream. Each message is sized
+// according to its own header, so messages of different types and protocol
+// versions may be mixed freely.
+type Decoder struct {
+	r            io.Reader
+	buf          *[MaxPacketSize]byte
+	pooled       bool
+	lengthPrefix bool
+	padded       bool
+	checksummed  bool
+	onRaw        func(b []byte, p PuncherPacket, err error)
+	preserve     bool
+	extensions   bool
+	desyncAfter  int
+	errs         int // consecutive protocol errors
+	idleTimeout  time.Duration
+}
+
+// DecoderOption configures a Decoder, see NewDecoder.
+type DecoderOption func(*Decoder)
+
+// WithBufferPool makes the Decoder take its buffer from a pool shared by all
+// Decoders. The buffer is returned to the pool on Close. This is useful for
+// servers creating many short-lived Decoders.
+func WithBufferPool() DecoderOption {
+	return func(d *Decoder) { d.pooled = true }
+}
+
+// ExpectLengthPrefix makes the Decoder read a 2-byte little-endian length
+// before each message, as written by stream transports. Decode fails if the
+// prefix doesn't match the length of the message that follows.
+func ExpectLengthPrefix() DecoderOption {
+	return func(d *Decoder) { d.lengthPrefix = true }
+}
+
+// ExpectPadding makes the Decoder read messages padded with MarshalPadded.
+func ExpectPadding() DecoderOption {
+	return func(d *Decoder) { d.padded = true }
+}
+
+// ExpectChecksum makes the Decoder read messages checksummed with
+// MarshalChecksummed and verify them. Decode returns ErrChecksum for
+// corrupted messages. It can't be combined with ExpectPadding or
+// PreserveExtensions. With ExpectLengthPrefix, the prefix covers the checksum.
+func ExpectChecksum() DecoderOption {
+	return func(d *Decoder) { d.checksummed = true }
+}
+
+// OnRaw makes the Decoder call f after each decode attempt with the raw bytes
+// of the message (without length prefix) and the result of decoding it. After
+// an error, b holds the bytes read so far. b is only valid during the call.
+// f isn't called if the stream ends cleanly.
+func OnRaw(f func(b []byte, p PuncherPacket, err error)) DecoderOption {
+	return func(d *Decoder) { d.onRaw = f }
+}
+
+// PreserveWireForm makes Decode return *WirePacket, which marshals to exactly
+// the bytes it was decoded from. Re-encoding a decoded packet may otherwise
+// differ, e.g. IPv4 addresses sent with the IPv6 address family are encoded
+// compactly. This is meant for proxies forwarding messages transparently.
+func PreserveWireForm() DecoderOption {
+	return func(d *Decoder) { d.preserve = true }
+}
+
+// WirePacket is a decoded message together with its encoding, see
+// PreserveWireForm. MarshalBinary returns Raw, so changes to PuncherPacket
+// are not reflected.
+type WirePacket struct {
+	PuncherPacket
+	Raw []byte
+}
+
+func (p *WirePacket) header() *Header { return p.PuncherPacket.(headerPacket).header() }
+
+func (p *WirePacket) unwrap() PuncherPacket { return p.PuncherPacket }
+
+// error is always nil
+func (p *WirePacket) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), p.Raw...), nil
+}
+
+// UnmarshalBinary decodes b into PuncherPacket, which must be set, and keeps
+// the message bytes in Raw.
+func (p *WirePacket) UnmarshalBinary(b []byte) error {
+	n, err := MessageLen(b)
+	if err != nil {
+		return err
+	}
+	if len(b) < n {
+		return ErrNotReadEnough(len(b))
+	}
+	if err := p.PuncherPacket.UnmarshalBinary(b); err != nil {
+		return err
+	}
+	p.Raw = append([]byte(nil), b[:n]...)
+	return nil
+}
+
+// PreserveExtensions makes Decode return *ExtendedPacket. With
+// ExpectLengthPrefix, a prefix exceeding the message length is accepted and
+// the remaining bytes are kept as Extensions. Otherwise, the stream's framing
+// only covers the known fields, so Extensions is always empty.
+func PreserveExtensions() DecoderOption {
+	return func(d *Decoder) { d.extensions = true }
+}
+
+// ExtendedPacket is a decoded message together with trailing bytes the
+// decoder didn't recognize, e.g. extension fields of a newer protocol version.
+// MarshalBinary appends Extensions to the message, so that an intermediary
+// can relay messages it only partially understands.
+type ExtendedPacket struct {
+	PuncherPacket
+	Extensions []byte
+}
+
+func (p *ExtendedPacket) header() *Header { return p.PuncherPacket.(headerPacket).header() }
+
+func (p *ExtendedPacket) unwrap() PuncherPacket { return p.PuncherPacket }
+
+func (p *ExtendedPacket) MarshalBinary() ([]byte, error) {
+	b, err := p.PuncherPacket.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return append(b, p.Extensions...), nil
+}
+
+// UnmarshalBinary decodes b into PuncherPacket, which must be set, and keeps
+// the bytes following the message in Extensions.
+func (p *ExtendedPacket) UnmarshalBinary(b []byte) error {
+	n, err := MessageLen(b)
+	if err != nil {
+		return err
+	}
+	if len(b) < n {
+		return ErrNotReadEnough(len(b))
+	}
+	if err := p.PuncherPacket.UnmarshalBinary(b); err != nil {
+		return err
+	}
+	p.Extensions = nil
+	if len(b) > n {
+		p.Extensions = append([]byte(nil), b[n:]...)
+	}
+	return nil
+}
+
+// wrappedPacket is implemented by WirePacket and ExtendedPacket.
+type wrappedPacket interface {
+	unwrap() PuncherPacket
+}
+
+// Unwrap returns the message inside p if it is a WirePacket or
+// ExtendedPacket, or p itself otherwise. Type switches on decoded messages
+// should use the result, as the wrappers hide the message type.
+func Unwrap(p PuncherPacket) PuncherPacket {
+	for {
+		w, ok := p.(wrappedPacket)
+		if !ok {
+			return p
+		}
+		p = w.unwrap()
+	}
+}
+
+// UnmarshalExtended decodes a datagram like UnmarshalDatagram, but keeps any
+// bytes following the message as Extensions.
+func UnmarshalExtended(b []byte) (*ExtendedPacket, error) {
+	p, err := UnmarshalDatagram(b)
+	if err != nil {
+		return nil, err
+	}
+	n, _ := MessageLen(b)
+	e := &ExtendedPacket{PuncherPacket: p}
+	if len(b) > n {
+		e.Extensions = append([]byte(nil), b[n:]...)
+	}
+	return e, nil
+}
+
+// ErrDesync is returned by Decode after too many consecutive protocol errors,
+// see DesyncAfter. The stream can't be recovered and should be closed.
+var ErrDesync = fmt.Errorf("netpuncher: stream out of sync: %w", ErrProtocol)
+
+// DesyncAfter makes the Decoder return ErrDesync instead of the n-th
+// consecutive protocol error and on all following calls. Once framing is lost
+// on a stream, decoding would otherwise fail indefinitely.
+func DesyncAfter(n int) DecoderOption {
+	return func(d *Decoder) { d.desyncAfter = n }
+}
+
+// ErrIdleTimeout is returned by Decode if no message arrived within the idle
+// timeout, see IdleTimeout.
+var ErrIdleTimeout = errors.New("netpuncher: connection idle")
+
+// IdleTimeout makes the Decoder close connections which don't deliver a
+// complete message within d of calling Decode, so that dead peers don't tie
+// up resources. Decode then returns ErrIdleTimeout. The reader has to
+// implement SetReadDeadline and Close like net.Conn, the option is ignored
+// otherwise.
+func IdleTimeout(d time.Duration) DecoderOption {
+	return func(dec *Decoder) { dec.idleTimeout = d }
+}
+
+// deadlineConn is the part of net.Conn needed for IdleTimeout.
+type deadlineConn interface {
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new([MaxPacketSize]byte) },
+}
+
+var errDecoderClosed = errors.New("netpuncher: Decoder closed")
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader, opts ...DecoderOption) *Decoder {
+	d := &Decoder{r: r}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.pooled {
+		d.buf = bufferPool.Get().(*[MaxPacketSize]byte)
+	} else {
+		d.buf = new([MaxPacketSize]byte)
+	}
+	return d
+}
+
+// Close releases the Decoder's buffer. It does not close the underlying
+// reader.
+func (d *Decoder) Close() error {
+	if d.buf == nil {
+		return errDecoderClosed
+	}
+	if d.pooled {
+		bufferPool.Put(d.buf)
+	}
+	d.buf = nil
+	return nil
+}
+
+// Decode reads the next message. Returns io.EOF if the stream ends cleanly
+// between messages and io.ErrUnexpectedEOF if it ends within a message.
+func (d *Decoder) Decode() (PuncherPacket, error) {
+	if d.buf == nil {
+		return nil, errDecoderClosed
+	}
+	if d.desyncAfter > 0 && d.errs >= d.desyncAfter {
+		return nil, ErrDesync
+	}
+	conn, idle := d.r.(deadlineConn)
+	idle = idle && d.idleTimeout > 0
+	if idle {
+		conn.SetReadDeadline(time.Now().Add(d.idleTimeout))
+	}
+	p, raw, err := d.decode()
+	if ne, ok := err.(net.Error); idle && ok && ne.Timeout() {
+		conn.Close()
+		err = ErrIdleTimeout
+	}
+	if d.onRaw != nil && (len(raw) > 0 || err != io.EOF) {
+		d.onRaw(raw, p, err)
+	}
+	if errors.Is(err, ErrProtocol) {
+		d.errs++
+		if d.desyncAfter > 0 && d.errs >= d.desyncAfter {
+			return nil, ErrDesync
+		}
+	} else if err == nil {
+		d.errs = 0
+	}
+	if _, ok := p.(*ExtendedPacket); d.extensions && err == nil && !ok {
+		p = &ExtendedPacket{PuncherPacket: p}
+	}
+	if d.preserve && err == nil {
+		// Padded messages are stored without padding.
+		n, _ := MessageLen(raw)
+		p = &WirePacket{p, append([]byte(nil), raw[:n]...)}
+	}
+	return p, err
+}
+
+// decode reads the next message and also returns its raw bytes, or the bytes
+// read before an error.
+func (d *Decoder) decode() (PuncherPacket, []byte, error) {
+	var prefix uint16
+	if d.lengthPrefix {
+		var b [2]byte
+		if _, err := io.ReadFull(d.r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		prefix = binary.LittleEndian.Uint16(b[:])
+	}
+	if d.padded {
+		return d.decodePadded(prefix)
+	}
+	// Read the header first, then continue until MessageLen is satisfied.
+	have, n := 0, HeaderSize
+	for have < n {
+		if m, err := io.ReadFull(d.r, d.buf[have:n]); err != nil {
+			if err == io.EOF && (have > 0 || d.lengthPrefix) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, d.buf[:have+m], err
+		}
+		have = n
+		var err error
+		if n, err = MessageLen(d.buf[:have]); err != nil {
+			return nil, d.buf[:have], err
+		}
+	}
+	if d.checksummed {
+		return d.decodeChecksum(prefix, n)
+	}
+	if d.extensions && d.lengthPrefix && int(prefix) > n {
+		ext := make([]byte, int(prefix)-n)
+		if _, err := io.ReadFull(d.r, ext); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, d.buf[:n], err
+		}
+		p, err := unmarshal(d.buf[:n])
+		if err != nil {
+			return nil, d.buf[:n], err
+		}
+		return &ExtendedPacket{p, ext}, d.buf[:n], nil
+	}
+	if d.lengthPrefix && int(prefix) != n {
+		return nil, d.buf[:n], InvalidMessageError{Err: fmt.Errorf("length prefix %d doesn't match message length %d", prefix, n)}
+	}
+	p, err := unmarshal(d.buf[:n])
+	return p, d.buf[:n], err
+}
+
+func (d *Decoder) decodePadded(prefix uint16) (PuncherPacket, []byte, error) {
+	b := make([]byte, PaddedSize)
+	if m, err := io.ReadFull(d.r, b); err != nil {
+		if err == io.EOF && d.lengthPrefix {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, b[:m], err
+	}
+	if d.lengthPrefix && prefix != PaddedSize {
+		return nil, b, InvalidMessageError{Err: fmt.Errorf("length prefix %d doesn't match padded length %d", prefix, PaddedSize)}
+	}
+	p, err := UnmarshalPadded(b)
+	return p, b, err
+}
+
+// decodeChecksum reads the checksum following the n byte message in d.buf and
+// decodes the message if it matches.
+func (d *Decoder) decodeChecksum(prefix uint16, n int) (PuncherPacket, []byte, error) {
+	var crc [ChecksumSize]byte
+	if _, err := io.ReadFull(d.r, crc[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, d.buf[:n], err
+	}
+	if d.lengthPrefix && int(prefix) != n+ChecksumSize {
+		return nil, d.buf[:n], InvalidMessageError{Err: fmt.Errorf("length prefix %d doesn't match checksummed length %d", prefix, n+ChecksumSize)}
+	}
+	b := append(d.buf[:n:n], crc[:]...)
+	p, err := UnmarshalChecksummed(b)
+	return p, d.buf[:n], err
+}
+
+// UnmarshalAt decodes the message at offset off in r, e.g. a capture file with
+// an index of message offsets. It also returns the length of the message.
+func UnmarshalAt(r io.ReaderAt, off int64) (PuncherPacket, int, error) {
+	var buf [MaxPacketSize]byte
+	have, n := 0, HeaderSize
+	for have < n {
+		m, err := r.ReadAt(buf[have:n], off+int64(have))
+		if m < n-have {
+			if err == io.EOF && (have > 0 || m > 0) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, 0, err
+		}
+		have = n
+		if n, err = MessageLen(buf[:have]); err != nil {
+			return nil, 0, err
+		}
+	}
+	p, err := unmarshal(buf[:n])
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, n, nil
+}
+
+// ReadAll decodes all messages concatenated in b.
+func ReadAll(b []byte) ([]PuncherPacket, error) {
+	var packets []PuncherPacket
+	for len(b) > 0 {
+		n, err := MessageLen(b)
+		if err != nil {
+			return packets, err
+		}
+		if len(b) < n {
+			return packets, ErrNotReadEnough(len(b))
+		}
+		p, err := unmarshal(b[:n])
+		if err != nil {
+			return packets, err
+		}
+		packets = append(packets, p)
+		b = b[n:]
+	}
+	return packets, nil
+}
+
+// UnmarshalBuffers decodes the message at the start of bufs, e.g. filled by a
+// scatter read. The buffers are only copied if the message isn't fully
+// contained in the first one.
+func UnmarshalBuffers(bufs net.Buffers) (PuncherPacket, error) {
+	if len(bufs) > 0 {
+		if n, err := MessageLen(bufs[0]); err == nil && n <= len(bufs[0]) {
+			return Unmarshal(bufs[0])
+		}
+	}
+	var buf [MaxPacketSize]byte
+	n := 0
+	for _, b := range bufs {
+		n += copy(buf[n:], b)
+	}
+	return Unmarshal(buf[:n])
+}
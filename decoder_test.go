@@ -0,0 +1,463 @@
+package netpuncher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// A v1 message followed by v2 messages in the same buffer.
+var mixedPackets = []PuncherPacket{
+	&CReq{Header: Header{PID_Puncher_CReq, 1}, Addr: net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 1337, Transport: TransportTCP},
+	&CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::2")}, Timestamp: 1234},
+}
+
+func marshalAll(t *testing.T, packets []PuncherPacket) []byte {
+	t.Helper()
+	var buf []byte
+	for _, pkt := range packets {
+		b, err := pkt.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T.MarshalBinary() failed: %v", pkt, err)
+		}
+		buf = append(buf, b...)
+	}
+	return buf
+}
+
+func TestReadAllMixedVersions(t *testing.T) {
+	buf := marshalAll(t, mixedPackets)
+	packets, err := ReadAll(buf)
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if !reflect.DeepEqual(packets, mixedPackets) {
+		t.Errorf("packets not equal: %+v != %+v", packets, mixedPackets)
+	}
+
+	_, err = ReadAll(buf[:len(buf)-1])
+	if _, ok := err.(ErrNotReadEnough); !ok {
+		t.Errorf("unexpected error for truncated buffer: %v", err)
+	}
+}
+
+func TestDecoderMixedVersions(t *testing.T) {
+	buf := marshalAll(t, mixedPackets)
+	d := NewDecoder(bytes.NewReader(buf))
+	for _, expected := range mixedPackets {
+		pkt, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if !reflect.DeepEqual(pkt, expected) {
+			t.Errorf("packets not equal: %+v != %+v", pkt, expected)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	d = NewDecoder(bytes.NewReader(buf[:len(buf)-1]))
+	var err error
+	for err == nil {
+		_, err = d.Decode()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestUnmarshalBuffers(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		splits := []net.Buffers{
+			{buf},
+			{buf[:1], buf[1:]},
+			{buf[:len(buf)-1], buf[len(buf)-1:]},
+		}
+		if len(buf) > 3 {
+			splits = append(splits, net.Buffers{buf[:2], buf[2:3], nil, buf[3:]})
+		}
+		for _, bufs := range splits {
+			cpy, err := UnmarshalBuffers(bufs)
+			if err != nil {
+				t.Errorf("UnmarshalBuffers for %T failed: %v", pkt, err)
+				continue
+			}
+			if !reflect.DeepEqual(pkt, cpy) {
+				t.Errorf("%T packets not equal: %+v != %+v", pkt, pkt, cpy)
+			}
+		}
+	}
+	if _, err := UnmarshalBuffers(nil); err != ErrNotReadEnough(0) {
+		t.Errorf("unexpected error for empty buffers: %v", err)
+	}
+}
+
+func TestDecoderClose(t *testing.T) {
+	buf := marshalAll(t, mixedPackets)
+	for _, opts := range [][]DecoderOption{nil, {WithBufferPool()}} {
+		d := NewDecoder(bytes.NewReader(buf), opts...)
+		if _, err := d.Decode(); err != nil {
+			t.Errorf("Decode failed: %v", err)
+		}
+		if err := d.Close(); err != nil {
+			t.Errorf("Close failed: %v", err)
+		}
+		if _, err := d.Decode(); err != errDecoderClosed {
+			t.Errorf("Decode after Close: unexpected error %v", err)
+		}
+		if err := d.Close(); err != errDecoderClosed {
+			t.Errorf("second Close: unexpected error %v", err)
+		}
+	}
+}
+
+func TestDecoderLengthPrefix(t *testing.T) {
+	var prefixed []byte
+	for _, p := range mixedPackets {
+		buf, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T.MarshalBinary() failed: %v", p, err)
+		}
+		prefixed = append(prefixed, byte(len(buf)), byte(len(buf)>>8))
+		prefixed = append(prefixed, buf...)
+	}
+	d := NewDecoder(bytes.NewReader(prefixed), ExpectLengthPrefix())
+	for _, expected := range mixedPackets {
+		pkt, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if !reflect.DeepEqual(pkt, expected) {
+			t.Errorf("packets not equal: %+v != %+v", pkt, expected)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	// Mismatched prefix
+	mismatched := append([]byte(nil), prefixed...)
+	mismatched[0]++
+	d = NewDecoder(bytes.NewReader(mismatched), ExpectLengthPrefix())
+	if _, err := d.Decode(); !errors.Is(err, ErrProtocol) {
+		t.Errorf("mismatched prefix: expected protocol error, got %v", err)
+	}
+
+	// Prefix without message
+	d = NewDecoder(bytes.NewReader(prefixed[:2]), ExpectLengthPrefix())
+	if _, err := d.Decode(); err != io.ErrUnexpectedEOF {
+		t.Errorf("missing message: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// Unprefixed stream in prefix mode
+	d = NewDecoder(bytes.NewReader(marshalAll(t, mixedPackets)), ExpectLengthPrefix())
+	if _, err := d.Decode(); err == nil {
+		t.Error("absent prefix: expected error")
+	}
+}
+
+func TestUnmarshalAt(t *testing.T) {
+	buf := marshalAll(t, mixedPackets)
+	r := bytes.NewReader(buf)
+	// Decode in reverse order to make sure no state is kept between calls.
+	var offsets []int64
+	for off := 0; off < len(buf); {
+		n, err := MessageLen(buf[off:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		offsets = append(offsets, int64(off))
+		off += n
+	}
+	for i := len(offsets) - 1; i >= 0; i-- {
+		pkt, n, err := UnmarshalAt(r, offsets[i])
+		if err != nil {
+			t.Fatalf("UnmarshalAt(%d) failed: %v", offsets[i], err)
+		}
+		if !reflect.DeepEqual(pkt, mixedPackets[i]) {
+			t.Errorf("packets not equal: %+v != %+v", pkt, mixedPackets[i])
+		}
+		end := int64(len(buf))
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+		if int64(n) != end-offsets[i] {
+			t.Errorf("UnmarshalAt(%d) consumed %d byte, expected %d", offsets[i], n, end-offsets[i])
+		}
+	}
+
+	if _, _, err := UnmarshalAt(r, int64(len(buf))); err != io.EOF {
+		t.Errorf("at end: expected io.EOF, got %v", err)
+	}
+	if _, _, err := UnmarshalAt(bytes.NewReader(buf[:len(buf)-1]), offsets[len(offsets)-1]); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestDecoderOnRaw(t *testing.T) {
+	type frame struct {
+		b   []byte
+		p   PuncherPacket
+		err error
+	}
+	var frames []frame
+	onRaw := OnRaw(func(b []byte, p PuncherPacket, err error) {
+		frames = append(frames, frame{append([]byte(nil), b...), p, err})
+	})
+	buf := marshalAll(t, samplePackets)
+	d := NewDecoder(bytes.NewReader(buf[:len(buf)-1]), onRaw)
+	var err error
+	for err == nil {
+		_, err = d.Decode()
+	}
+	if len(frames) != len(samplePackets) {
+		t.Fatalf("got %d frames, expected %d", len(frames), len(samplePackets))
+	}
+	for i, f := range frames[:len(frames)-1] {
+		expected, _ := samplePackets[i].MarshalBinary()
+		if !bytes.Equal(f.b, expected) || f.err != nil {
+			t.Errorf("frame %d: got %x (%v), expected %x", i, f.b, f.err, expected)
+		}
+		if !reflect.DeepEqual(f.p, samplePackets[i]) {
+			t.Errorf("frame %d: packets not equal: %+v != %+v", i, f.p, samplePackets[i])
+		}
+	}
+	last := frames[len(frames)-1]
+	expected, _ := samplePackets[len(samplePackets)-1].MarshalBinary()
+	if last.err != io.ErrUnexpectedEOF || last.p != nil || !bytes.Equal(last.b, expected[:len(expected)-1]) {
+		t.Errorf("truncated frame: got %x, %v, %v", last.b, last.p, last.err)
+	}
+}
+
+func benchmarkDecoderLifecycle(b *testing.B, opts ...DecoderOption) {
+	buf, _ := samplePackets[0].MarshalBinary()
+	r := bytes.NewReader(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf)
+		d := NewDecoder(r, opts...)
+		if _, err := d.Decode(); err != nil {
+			b.Fatal(err)
+		}
+		d.Close()
+	}
+}
+
+func BenchmarkDecoderLifecycle(b *testing.B)       { benchmarkDecoderLifecycle(b) }
+func BenchmarkDecoderLifecyclePooled(b *testing.B) { benchmarkDecoderLifecycle(b, WithBufferPool()) }
+
+func TestDecoderPreserveWireForm(t *testing.T) {
+	var inputs [][]byte
+	for _, pkt := range samplePackets {
+		switch pkt.(type) {
+		case *CReq, *CReqTCP, *IDReq, *SReqV2:
+			b, _ := pkt.MarshalBinary()
+			inputs = append(inputs, b)
+		}
+	}
+	// An IPv4 address encoded with the IPv6 family is re-encoded compactly
+	// without the option.
+	mapped, _ := CReq{Header: Header{Version: 2}, Addr: net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}}.MarshalBinary()
+	copy(mapped[HeaderSize+1+2:], net.ParseIP("::ffff:192.0.2.1"))
+	if p, _ := Unmarshal(mapped); p != nil {
+		if b, _ := p.MarshalBinary(); bytes.Equal(b, mapped) {
+			t.Error("mapped address unexpectedly re-encoded identically")
+		}
+	}
+	inputs = append(inputs, mapped)
+
+	for _, in := range inputs {
+		d := NewDecoder(bytes.NewReader(in), PreserveWireForm())
+		p, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode(%x) failed: %v", in, err)
+		}
+		w, ok := p.(*WirePacket)
+		if !ok {
+			t.Fatalf("got %T, expected *WirePacket", p)
+		}
+		if expected, _ := Unmarshal(in); !reflect.DeepEqual(w.PuncherPacket, expected) {
+			t.Errorf("decoded %+v, expected %+v", w.PuncherPacket, expected)
+		}
+		if b, _ := p.MarshalBinary(); !bytes.Equal(b, in) {
+			t.Errorf("%T: re-encoded as %x, expected %x", w.PuncherPacket, b, in)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	ext := []byte{0x42, 0x00, 0x13, 0x37}
+	var prefixed []byte
+	for _, pkt := range samplePackets {
+		b, _ := pkt.MarshalBinary()
+		in := append(b, ext...)
+		e, err := UnmarshalExtended(in)
+		if err != nil {
+			t.Errorf("UnmarshalExtended(%x) failed: %v", in, err)
+			continue
+		}
+		if !reflect.DeepEqual(e.PuncherPacket, pkt) || !bytes.Equal(e.Extensions, ext) {
+			t.Errorf("decoded %+v with extensions %x", e.PuncherPacket, e.Extensions)
+		}
+		if out, _ := e.MarshalBinary(); !bytes.Equal(out, in) {
+			t.Errorf("%T: re-encoded as %x, expected %x", pkt, out, in)
+		}
+		prefixed = append(prefixed, byte(len(in)), byte(len(in)>>8))
+		prefixed = append(prefixed, in...)
+	}
+
+	d := NewDecoder(bytes.NewReader(prefixed), ExpectLengthPrefix(), PreserveExtensions())
+	for _, pkt := range samplePackets {
+		p, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		e, ok := p.(*ExtendedPacket)
+		if !ok {
+			t.Fatalf("got %T, expected *ExtendedPacket", p)
+		}
+		if !reflect.DeepEqual(e.PuncherPacket, pkt) || !bytes.Equal(e.Extensions, ext) {
+			t.Errorf("decoded %+v with extensions %x", e.PuncherPacket, e.Extensions)
+		}
+	}
+
+	// Without extensions
+	b, _ := (&AssID{Header: Header{Version: 2}, CID: 1337}).MarshalBinary()
+	e, err := UnmarshalExtended(b)
+	if err != nil || e.Extensions != nil {
+		t.Errorf("got %+v, %v, expected no extensions", e, err)
+	}
+	d = NewDecoder(bytes.NewReader(b), PreserveExtensions())
+	if p, err := d.Decode(); err != nil {
+		t.Error(err)
+	} else if e, ok := p.(*ExtendedPacket); !ok || e.Extensions != nil {
+		t.Errorf("got %+v, expected *ExtendedPacket without extensions", p)
+	}
+	e = &ExtendedPacket{PuncherPacket: new(AssID)}
+	if err := e.UnmarshalBinary(append(b, ext...)); err != nil || !bytes.Equal(e.Extensions, ext) {
+		t.Errorf("UnmarshalBinary: got %+v, %v", e, err)
+	}
+}
+
+func TestWrappedPackets(t *testing.T) {
+	sreq := &SReqV2{Header: Header{Type: PID_Puncher_SReqV2, Version: 2}, CID: 1337, Transport: TransportTCP}
+	b, _ := sreq.MarshalBinary()
+	d := NewDecoder(bytes.NewReader(b), PreserveExtensions(), PreserveWireForm())
+	p, err := d.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.(*WirePacket); !ok {
+		t.Fatalf("got %T, expected *WirePacket", p)
+	}
+	if u := Unwrap(p); !reflect.DeepEqual(u, sreq) {
+		t.Errorf("Unwrap: got %+v, expected %+v", u, sreq)
+	}
+	if h := HeaderOf(p); h != sreq.Header {
+		t.Errorf("HeaderOf: got %+v, expected %+v", h, sreq.Header)
+	}
+	if req, ok := UnifySReq(p); !ok || req.CID != sreq.CID {
+		t.Errorf("UnifySReq: got %+v, %v", req, ok)
+	}
+	if !IsTCP(p) {
+		t.Error("IsTCP: got false")
+	}
+	if s, expected := MarshalDebugText(p), MarshalDebugText(sreq); s != expected {
+		t.Errorf("MarshalDebugText: got %q, expected %q", s, expected)
+	}
+	if _, err := MarshalChecksummed(p); err != nil {
+		t.Errorf("MarshalChecksummed: %v", err)
+	}
+	if _, err := Convert(p, 1); err == nil {
+		t.Error("Convert of SReqV2 to v1 succeeded")
+	}
+}
+
+func TestDecoderDesync(t *testing.T) {
+	valid, _ := AssID{Header: Header{Version: 1}, CID: 1337}.MarshalBinary()
+	garbage := bytes.Repeat([]byte{0xff}, 20)
+	// Errors followed by a valid message don't count.
+	stream := append(append(append([]byte(nil), garbage[:4]...), valid...), garbage...)
+	d := NewDecoder(bytes.NewReader(stream), DesyncAfter(3))
+	expected := []error{ErrUnknownType(0xff), ErrUnknownType(0xff), nil, ErrUnknownType(0xff), ErrUnknownType(0xff), ErrDesync, ErrDesync}
+	for i, e := range expected {
+		if _, err := d.Decode(); err != e {
+			t.Errorf("Decode %d: got error %v, expected %v", i, err, e)
+		}
+	}
+	if !errors.Is(ErrDesync, ErrProtocol) {
+		t.Error("ErrDesync doesn't wrap ErrProtocol")
+	}
+
+	// Without the option, errors are returned indefinitely.
+	d = NewDecoder(bytes.NewReader(garbage))
+	for i := 0; i < len(garbage)/HeaderSize; i++ {
+		if _, err := d.Decode(); err != ErrUnknownType(0xff) {
+			t.Errorf("Decode %d without DesyncAfter: got error %v", i, err)
+		}
+	}
+}
+
+func TestDecoderIdleTimeout(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	dec := NewDecoder(local, IdleTimeout(50*time.Millisecond))
+	go remote.Write(marshalAll(t, mixedPackets[:1]))
+	if _, err := dec.Decode(); err != nil {
+		t.Fatalf("active connection: %v", err)
+	}
+
+	// The peer goes silent.
+	start := time.Now()
+	if _, err := dec.Decode(); err != ErrIdleTimeout {
+		t.Fatalf("silent connection: got %v, expected ErrIdleTimeout", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("reaped after %v", d)
+	}
+	if _, err := remote.Write([]byte{0}); err != io.ErrClosedPipe {
+		t.Errorf("connection not closed, Write returned %v", err)
+	}
+}
+
+func TestAppendBuffers(t *testing.T) {
+	var bufs net.Buffers
+	for _, pkt := range mixedPackets {
+		var err error
+		if bufs, err = AppendBuffers(bufs, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(bufs) != len(mixedPackets) {
+		t.Fatalf("got %d buffers, expected %d", len(bufs), len(mixedPackets))
+	}
+	if _, err := AppendBuffers(bufs, &CReq{}); err == nil {
+		t.Error("CReq without address: expected error")
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		bufs.WriteTo(w)
+		w.Close()
+	}()
+	dec := NewDecoder(r)
+	for _, pkt := range mixedPackets {
+		p, err := dec.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(p, pkt) {
+			t.Errorf("packets not equal: %+v != %+v", p, pkt)
+		}
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+}
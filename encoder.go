@@ -0,0 +1,38 @@
+package netpuncher
+
+import (
+	"io"
+	"net"
+)
+
+// Encoder writes consecutive messages to a stream, to be read back with a
+// Decoder.
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an Encoder writing to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes a single message.
+func (e *Encoder) Encode(p PuncherPacket) error {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(buf)
+	return err
+}
+
+// AppendBuffers appends the encoding of p to bufs as a separate buffer, so
+// that several messages can be written to a stream at once with
+// bufs.WriteTo, which uses a single vectored write on TCP connections.
+func AppendBuffers(bufs net.Buffers, p PuncherPacket) (net.Buffers, error) {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return bufs, err
+	}
+	return append(bufs, buf), nil
+}
@@ -0,0 +1,158 @@
+package netpuncher
+
+import (
+	"sort"
+	"time"
+)
+
+// CapturedPacket is a decoded message from a capture, see FlowReconstructor.
+type CapturedPacket struct {
+	Time     time.Time
+	Endpoint string // where the message was captured, e.g. "host" or "client"
+	Packet   PuncherPacket
+}
+
+// Flow is the sequence of messages belonging to a host's CID, from its
+// registration to the punches of its clients, in time order.
+type Flow struct {
+	CID     uint32
+	Packets []CapturedPacket
+	Gaps    []FlowGap
+}
+
+// FlowGap is a message which didn't receive the expected reply.
+type FlowGap struct {
+	After   CapturedPacket
+	Missing string // description of the missing reply, e.g. "CReq at host"
+}
+
+// FlowReconstructor correlates messages captured at several endpoints, e.g.
+// host and client, into the logical flow for post-mortem analysis. Messages
+// without CID are attributed by their endpoint: IDReq to the CID of the
+// following AssID, CReq messages to the last SReq sent from the endpoint or
+// else the CID registered from it.
+type FlowReconstructor struct {
+	packets []CapturedPacket
+}
+
+// Add adds a captured message. Messages may be added in any order.
+func (r *FlowReconstructor) Add(p CapturedPacket) {
+	r.packets = append(r.packets, p)
+}
+
+// Flows returns the flows ordered by CID. Messages which can't be attributed
+// are collected in a Flow with CID zero.
+func (r *FlowReconstructor) Flows() []Flow {
+	packets := append([]CapturedPacket(nil), r.packets...)
+	sort.SliceStable(packets, func(i, j int) bool { return packets[i].Time.Before(packets[j].Time) })
+
+	flows := make(map[uint32]*Flow)
+	flow := func(cid uint32) *Flow {
+		f, ok := flows[cid]
+		if !ok {
+			f = &Flow{CID: cid}
+			flows[cid] = f
+		}
+		return f
+	}
+	hostCID := make(map[string]uint32)          // by endpoint
+	lastSReq := make(map[string]uint32)         // by endpoint
+	idreqs := make(map[string][]CapturedPacket) // waiting for AssID, by endpoint
+	for _, c := range packets {
+		switch p := Unwrap(c.Packet).(type) {
+		case *IDReq:
+			idreqs[c.Endpoint] = append(idreqs[c.Endpoint], c)
+		case *AssID:
+			if pending := idreqs[c.Endpoint]; len(pending) > 0 {
+				hostCID[c.Endpoint] = p.CID
+				f := flow(p.CID)
+				f.Packets = append(f.Packets, pending...)
+				f.Packets = append(f.Packets, c)
+				delete(idreqs, c.Endpoint)
+			} else if cid, ok := lastSReq[c.Endpoint]; ok {
+				// Nonce challenge in reply to SReqV2.
+				flow(cid).Packets = append(flow(cid).Packets, c)
+			} else {
+				flow(p.CID).Packets = append(flow(p.CID).Packets, c)
+			}
+		case *CReq, *CReqTCP, *CReqTCPMulti, *CReqRelay:
+			cid, ok := lastSReq[c.Endpoint]
+			if !ok {
+				cid = hostCID[c.Endpoint]
+			}
+			flow(cid).Packets = append(flow(cid).Packets, c)
+		case *Error:
+			flow(p.CID).Packets = append(flow(p.CID).Packets, c)
+		case *PunchResult:
+			flow(p.CID).Packets = append(flow(p.CID).Packets, c)
+		case *Heartbeat:
+			flow(p.CID).Packets = append(flow(p.CID).Packets, c)
+		default:
+			if sreq, ok := UnifySReq(p); ok {
+				lastSReq[c.Endpoint] = sreq.CID
+				flow(sreq.CID).Packets = append(flow(sreq.CID).Packets, c)
+			} else {
+				flow(0).Packets = append(flow(0).Packets, c)
+			}
+		}
+	}
+	for _, pending := range idreqs {
+		f := flow(0)
+		for _, c := range pending {
+			f.Packets = append(f.Packets, c)
+			f.Gaps = append(f.Gaps, FlowGap{c, "AssID at " + c.Endpoint})
+		}
+	}
+
+	result := make([]Flow, 0, len(flows))
+	for _, f := range flows {
+		sort.SliceStable(f.Packets, func(i, j int) bool { return f.Packets[i].Time.Before(f.Packets[j].Time) })
+		f.Gaps = append(f.Gaps, punchGaps(f, hostCID)...)
+		sort.SliceStable(f.Gaps, func(i, j int) bool { return f.Gaps[i].After.Time.Before(f.Gaps[j].After.Time) })
+		result = append(result, *f)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CID < result[j].CID })
+	return result
+}
+
+// punchGaps finds punch requests in f without CReq at the client or at the
+// host's endpoint. A client receiving an Error or AssID instead doesn't
+// expect a CReq.
+func punchGaps(f *Flow, hostCID map[string]uint32) []FlowGap {
+	var gaps []FlowGap
+	for i, c := range f.Packets {
+		if _, ok := UnifySReq(c.Packet); !ok {
+			continue
+		}
+		answered, rejected := false, false
+		creqAt := make(map[string]bool)
+		for _, later := range f.Packets[i+1:] {
+			switch Unwrap(later.Packet).(type) {
+			case *CReq, *CReqTCP, *CReqTCPMulti, *CReqRelay:
+				creqAt[later.Endpoint] = true
+				answered = answered || later.Endpoint == c.Endpoint
+			case *Error, *AssID:
+				if later.Endpoint == c.Endpoint {
+					answered, rejected = true, true
+				}
+			}
+		}
+		if !answered {
+			gaps = append(gaps, FlowGap{c, "CReq at " + c.Endpoint})
+		}
+		if rejected || f.CID == 0 {
+			continue
+		}
+		var hosts []string
+		for endpoint, cid := range hostCID {
+			if cid == f.CID && !creqAt[endpoint] {
+				hosts = append(hosts, endpoint)
+			}
+		}
+		sort.Strings(hosts)
+		for _, endpoint := range hosts {
+			gaps = append(gaps, FlowGap{c, "CReq at " + endpoint})
+		}
+	}
+	return gaps
+}
@@ -0,0 +1,58 @@
+package netpuncher
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlowReconstructor(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	v2 := Header{Version: 2}
+	haddr := net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	caddr := net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 11114}
+	capture := []CapturedPacket{
+		{start, "host", &IDReq{Header: v2}},
+		{start.Add(1 * time.Second), "host", &AssID{Header: v2, CID: 42}},
+		{start.Add(2 * time.Second), "client", &SReqV2{Header: v2, CID: 42}},
+		{start.Add(3 * time.Second), "host", &CReq{Header: v2, Addr: caddr}},
+		{start.Add(3500 * time.Millisecond), "client", &CReq{Header: v2, Addr: haddr}},
+		{start.Add(4 * time.Second), "client", &PunchResult{Header: v2, CID: 42}},
+		// The CReq to the host got lost.
+		{start.Add(5 * time.Second), "client", &SReqV2{Header: v2, CID: 42}},
+		{start.Add(6 * time.Second), "client", &CReq{Header: v2, Addr: haddr}},
+		// Unknown host without any reply.
+		{start.Add(7 * time.Second), "client", &SReqV2{Header: v2, CID: 7}},
+		{start.Add(8 * time.Second), "host2", &IDReq{Header: v2}},
+	}
+	var r FlowReconstructor
+	// The capture of both sides is added separately.
+	for _, endpoint := range []string{"client", "host", "host2"} {
+		for _, c := range capture {
+			if c.Endpoint == endpoint {
+				r.Add(c)
+			}
+		}
+	}
+	expected := []Flow{
+		{0, []CapturedPacket{capture[9]}, []FlowGap{{capture[9], "AssID at host2"}}},
+		{7, []CapturedPacket{capture[8]}, []FlowGap{{capture[8], "CReq at client"}}},
+		{42, capture[:8], []FlowGap{{capture[6], "CReq at host"}}},
+	}
+	flows := r.Flows()
+	if len(flows) != len(expected) {
+		t.Fatalf("got %d flows, expected %d: %+v", len(flows), len(expected), flows)
+	}
+	for i, f := range flows {
+		if f.CID != expected[i].CID {
+			t.Errorf("flow %d has CID %d, expected %d", i, f.CID, expected[i].CID)
+		}
+		if !reflect.DeepEqual(f.Packets, expected[i].Packets) {
+			t.Errorf("CID %d: got packets %+v, expected %+v", f.CID, f.Packets, expected[i].Packets)
+		}
+		if !reflect.DeepEqual(f.Gaps, expected[i].Gaps) {
+			t.Errorf("CID %d: got gaps %+v, expected %+v", f.CID, f.Gaps, expected[i].Gaps)
+		}
+	}
+}
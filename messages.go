@@ -41,27 +41,65 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"time"
 )
 
 const (
-	PID_Puncher_AssID   = 0x51 // Puncher announcing ID to client
-	PID_Puncher_SReq    = 0x52 // Client requesting to be served with punching (for an ID)
-	PID_Puncher_CReq    = 0x53 // Puncher requesting clients to punch (towards an address)
-	PID_Puncher_IDReq   = 0x54 // Client requesting an ID
-	PID_Puncher_SReqTCP = 0x62 // Client requesting to be served with TCP-punching (for an ID)
-	PID_Puncher_CReqTCP = 0x63 // Puncher requesting clients to TCP-punch (towards an address)
+	PID_Puncher_AssID        = 0x51 // Puncher announcing ID to client
+	PID_Puncher_SReq         = 0x52 // Client requesting to be served with punching (for an ID)
+	PID_Puncher_CReq         = 0x53 // Puncher requesting clients to punch (towards an address)
+	PID_Puncher_IDReq        = 0x54 // Client requesting an ID
+	PID_Puncher_SReqV2       = 0x55 // Client requesting to be served with UDP- or TCP-punching (for an ID), version 2 only
+	PID_Puncher_Error        = 0x56 // Puncher rejecting a request, version 2 only
+	PID_Puncher_Result       = 0x57 // Client reporting whether punching succeeded, version 2 only
+	PID_Puncher_CReqRelay    = 0x58 // Puncher requesting clients to punch (towards an address) or to use a relay, version 2 only
+	PID_Puncher_Heartbeat    = 0x59 // Host refreshing its registration (for an ID), version 2 only
+	PID_Puncher_SReqTCP      = 0x62 // Client requesting to be served with TCP-punching (for an ID)
+	PID_Puncher_CReqTCP      = 0x63 // Puncher requesting clients to TCP-punch (towards an address)
+	PID_Puncher_CReqTCPMulti = 0x64 // Puncher requesting clients to TCP-punch (towards one of several addresses), version 2 only
 )
 
-// 2 byte header, CReqTCP is largest (two port and IP)
-const MaxPacketSize = 2 + 36
+// Size of the Header preceding every message, i.e. the smallest valid message.
+// In version 2, the address family byte follows.
+const HeaderSize = 2
+
+// CReqTCPMulti with MaxTCPPairs IPv6 address pairs is largest (address family,
+// count and pairs), followed by IDReq (address family, transports, flags,
+// preferred address and length-prefixed metadata and identity)
+const MaxPacketSize = HeaderSize + 1 + 1 + MaxTCPPairs*2*18
+
+// MaxDatagramSize is the size of the largest datagram holding a message,
+// which is a checksummed one. Padded messages are a byte shorter.
+const MaxDatagramSize = MaxPacketSize + ChecksumSize
+
+// MaxMetadataSize is the maximum length of IDReq.Metadata.
+const MaxMetadataSize = 64
+
+// MaxErrorMessageSize is the maximum length of Error.Message.
+const MaxErrorMessageSize = 64
+
+// MaxIdentitySize is the maximum length of IDReq.Identity.
+const MaxIdentitySize = 32
 
 type PuncherPacket interface {
 	Type() byte
 	encoding.BinaryMarshaler
 	encoding.BinaryUnmarshaler
+	// Validate checks that the message is usable beyond being well-formed,
+	// e.g. that addresses can be punched towards and CIDs are set. Decoding
+	// doesn't check this, so that invalid messages can still be inspected.
+	// The header isn't checked, see Header.Validate.
+	Validate() error
 }
 
+var errZeroCID = errors.New("netpuncher: zero CID")
+
+// ErrProtocol is wrapped by all errors returned while decoding messages. Use
+// errors.Is(err, ErrProtocol) to check whether a peer sent something invalid.
+var ErrProtocol = errors.New("netpuncher: protocol error")
+
 // Encountered an unknown message type while decoding.
 type ErrUnknownType byte
 
@@ -69,18 +107,69 @@ func (t ErrUnknownType) Error() string {
 	return fmt.Sprintf("netpuncher: unknown message type 0x%x", byte(t))
 }
 
+func (ErrUnknownType) Is(target error) bool { return target == ErrProtocol }
+
 // Message has an unsupported protocol version
 type ErrUnsupportedVersion ProtocolVersion
 
 func (v ErrUnsupportedVersion) Error() string {
-	return fmt.Sprintf("netpuncher: unsupported protocol version %d", int(v))
+	return fmt.Sprintf("netpuncher: unsupported protocol version %v", ProtocolVersion(v))
+}
+
+func (ErrUnsupportedVersion) Is(target error) bool { return target == ErrProtocol }
+
+// Message of a known type has a protocol version newer than
+// NewestProtocolVersion, e.g. from a newer peer. Unlike ErrUnsupportedVersion,
+// the type is known so that callers can log and ignore such messages. Unwraps
+// to ErrUnsupportedVersion.
+type ErrFutureVersion struct {
+	Type    byte
+	Version ProtocolVersion
+}
+
+func (e ErrFutureVersion) Error() string {
+	return fmt.Sprintf("netpuncher: unsupported protocol version %v of message type 0x%x", e.Version, e.Type)
+}
+
+func (e ErrFutureVersion) Unwrap() error { return ErrUnsupportedVersion(e.Version) }
+
+// Message type doesn't match the packet passed to UnmarshalInto, or a decoded
+// packet's header doesn't match its type.
+type ErrTypeMismatch struct {
+	Type, Expected byte
+}
+
+func (e ErrTypeMismatch) Error() string {
+	return fmt.Sprintf("netpuncher: message type 0x%x, expected 0x%x", e.Type, e.Expected)
+}
+
+func (ErrTypeMismatch) Is(target error) bool { return target == ErrProtocol }
+
+// ErrInvalidMessage is wrapped by all errors for messages which aren't
+// properly formatted, see InvalidMessageError.
+var ErrInvalidMessage = errors.New("netpuncher: invalid message")
+
+// Message not properly formatted. Err is the underlying decoding error. If
+// known, PID is the type of the message and Offset the position of the field
+// which failed to decode. PID is zero otherwise. Matches ErrInvalidMessage
+// and ErrProtocol with errors.Is.
+type InvalidMessageError struct {
+	Err    error
+	PID    byte
+	Offset int
+}
+
+func (e InvalidMessageError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("netpuncher: %v", e.Err)
+	}
+	return fmt.Sprintf("netpuncher: %v (message type 0x%x, offset %d)", e.Err, e.PID, e.Offset)
 }
 
-// Message not properly formatted.
-type ErrInvalidMessage string
+func (e InvalidMessageError) Unwrap() error { return e.Err }
 
-func (msg ErrInvalidMessage) Error() string {
-	return fmt.Sprintf("netpuncher: %s", string(msg))
+func (InvalidMessageError) Is(target error) bool {
+	return target == ErrProtocol || target == ErrInvalidMessage
 }
 
 // Not read enough bytes for a full message.
@@ -90,47 +179,356 @@ func (n ErrNotReadEnough) Error() string {
 	return fmt.Sprintf("netpuncher: message not long enough, read %d byte", n)
 }
 
-// Reads one puncher message.
+func (ErrNotReadEnough) Is(target error) bool { return target == ErrProtocol }
+
+// MessageLen returns the encoded length of the message at the start of b as
+// determined by its header and flags. If b ends before the flags of a message
+// with optional fields, the returned length is the minimum length required to
+// determine the full length, so callers should retry with more data while the
+// result exceeds len(b).
+func MessageLen(b []byte) (int, error) {
+	if len(b) < HeaderSize {
+		return 0, ErrNotReadEnough(len(b))
+	}
+	v := ProtocolVersion(b[1])
+	if err := (Header{b[0], v}).Validate(); err != nil {
+		return 0, err
+	}
+	// flag checks whether a flags byte at offset n-1 is present and has the given bit set.
+	flag := func(n int, bit byte) bool {
+		return len(b) >= n && b[n-1]&bit != 0
+	}
+	hs, a := HeaderSize, familyIPv6.addrLen()
+	if v >= 2 {
+		hs++
+		if len(b) < hs {
+			return hs, nil
+		}
+		family := addrFamily(b[HeaderSize])
+		if err := family.validate(); err != nil {
+			return 0, err
+		}
+		a = family.addrLen()
+	}
+	var n int
+	switch b[0] {
+	case PID_Puncher_IDReq:
+		n = hs
+		if v >= 2 {
+			n += 2
+			flags := n
+			if flag(flags, idreqFlagPreferredAddr) {
+				n += a
+			}
+			if flag(flags, idreqFlagMetadata) {
+				n++
+				if len(b) >= n {
+					l := int(b[n-1])
+					if l > MaxMetadataSize {
+						return 0, errMetadataSize(l)
+					}
+					n += l
+				}
+			}
+			if flag(flags, idreqFlagIdentity) {
+				n++
+				if len(b) >= n {
+					l := int(b[n-1])
+					if l > MaxIdentitySize {
+						return 0, errIdentitySize(l)
+					}
+					n += l
+				}
+			}
+			if flag(flags, idreqFlagNonce) {
+				n += 8
+			}
+		}
+	case PID_Puncher_AssID:
+		n = hs + 4
+		if v >= 2 {
+			l, err := cidLen(b[hs:])
+			if err != nil {
+				return 0, err
+			}
+			n = hs + l + 1
+			if flag(n, assidFlagNonce) {
+				n += 8
+			}
+		}
+	case PID_Puncher_SReq, PID_Puncher_SReqTCP:
+		n = hs + 4
+		if v >= 2 {
+			l, err := cidLen(b[hs:])
+			if err != nil {
+				return 0, err
+			}
+			n = hs + l
+		}
+	case PID_Puncher_CReq:
+		n = hs + a
+		if v >= 2 {
+			n++
+			flags := n
+			if flag(flags, creqFlagTimestamp) {
+				n += 8
+			}
+			if flag(flags, creqFlagNonce) {
+				n += 8
+			}
+		}
+	case PID_Puncher_CReqTCP:
+		n = hs + 2*a
+		if v >= 2 {
+			n++
+			flags := n
+			if flag(flags, creqtcpFlagRetry) {
+				n += 3
+			}
+			if flag(flags, creqtcpFlagNonce) {
+				n += 8
+			}
+		}
+	case PID_Puncher_SReqV2:
+		n = hs + 4 + 1
+		if flag(n, sreqFlagTimestamp) {
+			n += 8
+		}
+		if flag(hs+4+1, sreqFlagPreferredAddr) {
+			n += a
+		}
+		if flag(hs+4+1, sreqFlagNonce) {
+			n += 8
+		}
+	case PID_Puncher_Error:
+		n = hs + 1 + 4
+		if flag(hs+1, errorFlagMessage) {
+			n++
+			if len(b) >= n {
+				l := int(b[n-1])
+				if l > MaxErrorMessageSize {
+					return 0, errErrorMessageSize(l)
+				}
+				n += l
+			}
+		}
+	case PID_Puncher_Result:
+		n = hs + 4 + 1
+	case PID_Puncher_Heartbeat:
+		n = hs + 4 + 2 + 1
+	case PID_Puncher_CReqRelay:
+		n = hs + 1
+		if flag(hs+1, creqrelayFlagDirect) {
+			n += a
+		}
+		if flag(hs+1, creqrelayFlagRelay) {
+			n += a + 8
+		}
+	case PID_Puncher_CReqTCPMulti:
+		n = hs + 1
+		if len(b) >= n {
+			count := int(b[n-1])
+			if count > MaxTCPPairs {
+				return 0, errTCPPairCount(count)
+			}
+			n += count * 2 * a
+		}
+	default:
+		return 0, ErrUnknownType(b[0])
+	}
+	return n, nil
+}
+
+// PeekMessageLen reports whether b starts with a complete, recognized puncher
+// message and its length, so that datagrams on a socket shared with game
+// traffic can be routed. Any bytes after length belong to the game layer. pid
+// is the first byte of b, or zero if b is empty.
+func PeekMessageLen(b []byte) (pid byte, length int, isPuncher bool) {
+	if len(b) == 0 {
+		return 0, 0, false
+	}
+	n, err := MessageLen(b)
+	if err != nil || n > len(b) {
+		return b[0], 0, false
+	}
+	return b[0], n, true
+}
+
+// IsPuncherMessage reports whether the datagram b consists of exactly one
+// puncher message, optionally padded with MarshalPadded or checksummed with
+// MarshalChecksummed. Only the header, length and checksum are checked
+// without decoding the message, so this is cheap enough to classify mixed
+// traffic, but Unmarshal may still fail.
+func IsPuncherMessage(b []byte) bool {
+	if len(b) == PaddedSize && isPadded(b) {
+		return true
+	}
+	n, err := MessageLen(b)
+	if err != nil {
+		return false
+	}
+	return n == len(b) || n+ChecksumSize == len(b) && b[1] >= 2 && checksumValid(b, n)
+}
+
+// isPadded returns whether b of PaddedSize is a message padded with
+// MarshalPadded.
+func isPadded(b []byte) bool {
+	l := int(b[PaddedSize-1])
+	if l > MaxPacketSize {
+		return false
+	}
+	for _, c := range b[l : PaddedSize-1] {
+		if c != 0 {
+			return false
+		}
+	}
+	n, err := MessageLen(b[:l])
+	return err == nil && n == l
+}
+
+// Reads one puncher message. Each Read has to return a whole datagram, see
+// UnmarshalDatagram.
 func ReadFrom(r io.Reader) (PuncherPacket, error) {
-	buf := make([]byte, MaxPacketSize)
+	buf := make([]byte, MaxDatagramSize)
 	n, err := r.Read(buf)
 	if err != nil {
 		return nil, err
 	}
-	if n < 2 {
-		return nil, ErrNotReadEnough(n)
+	// Readers like c4netioudp.Conn return the length of a datagram which
+	// didn't fit.
+	if n > len(buf) {
+		return nil, InvalidMessageError{Err: fmt.Errorf("datagram of %d byte exceeds %d", n, len(buf))}
+	}
+	return UnmarshalDatagram(buf[:n])
+}
+
+// Unmarshal decodes the message at the start of b, e.g. a received datagram.
+// Any bytes following the message are ignored.
+func Unmarshal(b []byte) (PuncherPacket, error) {
+	if len(b) < HeaderSize {
+		return nil, ErrNotReadEnough(len(b))
+	}
+	// Reject short messages early instead of failing somewhere in the decoder.
+	n, err := MessageLen(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < n {
+		return nil, ErrNotReadEnough(len(b))
+	}
+	return unmarshal(b)
+}
+
+// UnmarshalInto decodes the message at the start of b into p, which must have
+// the same type, so that decode loops can reuse packets instead of allocating
+// a new one per message.
+func UnmarshalInto(b []byte, p PuncherPacket) error {
+	if len(b) < HeaderSize {
+		return ErrNotReadEnough(len(b))
+	}
+	if b[0] != p.Type() {
+		return ErrTypeMismatch{b[0], p.Type()}
+	}
+	n, err := MessageLen(b)
+	if err != nil {
+		return err
+	}
+	if len(b) < n {
+		return ErrNotReadEnough(len(b))
+	}
+	return p.UnmarshalBinary(b)
+}
+
+// UnmarshalLenient is like Unmarshal, but also accepts truncated messages
+// from legacy peers as long as they are recoverable: a CReqTCP with only the
+// source address is decoded with DestAddr left zero.
+func UnmarshalLenient(b []byte) (PuncherPacket, error) {
+	p, err := Unmarshal(b)
+	if _, short := err.(ErrNotReadEnough); short && len(b) >= HeaderSize && b[0] == PID_Puncher_CReqTCP {
+		var req CReqTCP
+		if req.unmarshalSourceOnly(b) == nil {
+			return &req, nil
+		}
+	}
+	return p, err
+}
+
+// unmarshal decodes a message of any type from b.
+func unmarshal(b []byte) (PuncherPacket, error) {
+	p, err := newPacket(b[0])
+	if err != nil {
+		return nil, err
+	}
+	if err = p.UnmarshalBinary(b); err != nil {
+		return nil, err
+	}
+	// Guard against newPacket and the decoders disagreeing.
+	if h := HeaderOf(p); h.Type != p.Type() {
+		return nil, ErrTypeMismatch{h.Type, p.Type()}
 	}
-	var p PuncherPacket
-	switch buf[0] {
+	return p, nil
+}
+
+// newPacket returns an empty packet of the given message type.
+func newPacket(typ byte) (PuncherPacket, error) {
+	switch typ {
 	case PID_Puncher_AssID:
-		p = &AssID{}
+		return &AssID{}, nil
 	case PID_Puncher_SReq:
-		p = &SReq{}
+		return &SReq{}, nil
 	case PID_Puncher_CReq:
-		p = &CReq{}
+		return &CReq{}, nil
 	case PID_Puncher_IDReq:
-		p = &IDReq{}
+		return &IDReq{}, nil
 	case PID_Puncher_SReqTCP:
-		p = &SReqTCP{}
+		return &SReqTCP{}, nil
 	case PID_Puncher_CReqTCP:
-		p = &CReqTCP{}
-	default:
-		return nil, ErrUnknownType(buf[0])
+		return &CReqTCP{}, nil
+	case PID_Puncher_SReqV2:
+		return &SReqV2{}, nil
+	case PID_Puncher_Error:
+		return &Error{}, nil
+	case PID_Puncher_Result:
+		return &PunchResult{}, nil
+	case PID_Puncher_CReqTCPMulti:
+		return &CReqTCPMulti{}, nil
+	case PID_Puncher_CReqRelay:
+		return &CReqRelay{}, nil
+	case PID_Puncher_Heartbeat:
+		return &Heartbeat{}, nil
 	}
-	if err = p.UnmarshalBinary(buf); err != nil {
-		return nil, err
+	return nil, ErrUnknownType(typ)
+}
+
+// minVersion returns the first protocol version supporting the message type.
+func minVersion(typ byte) (ProtocolVersion, bool) {
+	switch typ {
+	case PID_Puncher_AssID, PID_Puncher_SReq, PID_Puncher_CReq, PID_Puncher_IDReq,
+		PID_Puncher_SReqTCP, PID_Puncher_CReqTCP:
+		return 1, true
+	case PID_Puncher_SReqV2, PID_Puncher_Error, PID_Puncher_Result, PID_Puncher_CReqTCPMulti,
+		PID_Puncher_CReqRelay, PID_Puncher_Heartbeat:
+		return 2, true
 	}
-	return p, nil
+	return 0, false
 }
 
 type ProtocolVersion byte
 
 // Newest version supported
-var NewestProtocolVersion = ProtocolVersion(1)
+var NewestProtocolVersion = ProtocolVersion(2)
 
 // Returns whether the implementation supports the protocol version.
 func (v ProtocolVersion) Supported() bool {
-	return v == 1
+	return v >= 1 && v <= NewestProtocolVersion
+}
+
+// String returns e.g. "v2", or "v?(7)" for unsupported versions.
+func (v ProtocolVersion) String() string {
+	if !v.Supported() {
+		return fmt.Sprintf("v?(%d)", byte(v))
+	}
+	return fmt.Sprintf("v%d", byte(v))
 }
 
 // Header preceding all messages.
@@ -146,65 +544,528 @@ func (h Header) MarshalBinary() ([]byte, error) {
 }
 
 func (h *Header) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
+	b := newMsgReader(buf)
 	err := binary.Read(b, binary.LittleEndian, h)
 	if err != nil {
-		return ErrInvalidMessage(err.Error())
+		return b.invalid(err)
+	}
+	return h.Validate()
+}
+
+// msgReader reads the fields of a message and tracks the offset of the field
+// read last, so that decoding errors can tell where they occurred.
+type msgReader struct {
+	bytes.Reader
+	pid     byte
+	size    int
+	start   int
+	partial bool // the last Read was short, so the next continues the field
+}
+
+func newMsgReader(buf []byte) *msgReader {
+	r := &msgReader{size: len(buf)}
+	r.Reset(buf)
+	if len(buf) > 0 {
+		r.pid = buf[0]
+	}
+	return r
+}
+
+func (r *msgReader) Read(b []byte) (int, error) {
+	if !r.partial {
+		r.start = r.size - r.Len()
+	}
+	n, err := r.Reader.Read(b)
+	r.partial = n < len(b)
+	return n, err
+}
+
+func (r *msgReader) ReadByte() (byte, error) {
+	r.start = r.size - r.Len()
+	r.partial = false
+	return r.Reader.ReadByte()
+}
+
+// invalid wraps err from reading the last field in InvalidMessageError.
+func (r *msgReader) invalid(err error) error {
+	return r.locate(InvalidMessageError{Err: err})
+}
+
+// locate adds the message type and the offset of the last field to err if
+// it is an InvalidMessageError without them.
+func (r *msgReader) locate(err error) error {
+	if e, ok := err.(InvalidMessageError); ok && e.PID == 0 {
+		e.PID, e.Offset = r.pid, r.start
+		return e
+	}
+	return err
+}
+
+// headerPacket is implemented by all packets through the embedded Header.
+type headerPacket interface {
+	header() *Header
+}
+
+func (h *Header) header() *Header { return h }
+
+// HeaderOf returns the header of p.
+func HeaderOf(p PuncherPacket) Header {
+	return *p.(headerPacket).header()
+}
+
+// Validate checks that the header describes a known message type in a
+// supported protocol version. Known types with a newer version result in
+// ErrFutureVersion.
+func (h Header) Validate() error {
+	min, ok := minVersion(h.Type)
+	if !ok {
+		return ErrUnknownType(h.Type)
 	}
-	if !h.Version.Supported() {
+	if h.Version > NewestProtocolVersion {
+		return ErrFutureVersion{h.Type, h.Version}
+	}
+	if !h.Version.Supported() || h.Version < min {
 		return ErrUnsupportedVersion(h.Version)
 	}
 	return nil
 }
 
+// addrFamily selects the encoding of all addresses in a version 2 message. It
+// follows the header as a single byte. Version 1 always uses IPv6.
+//
+// The encoding only depends on the logical address: an IPv4 address is
+// written the same whether the net.IP holds 4 bytes or the IPv4-mapped 16
+// byte form, i.e. as ::ffff:a.b.c.d with familyIPv6 and a.b.c.d with
+// familyIPv4.
+//
+// The familyBigEndianPorts bit selects big-endian ports for all addresses in
+// the message instead of the default little endian. Peers announce it in
+// IDReq or SReqV2 and the server answers them in the same byte order.
+type addrFamily byte
+
+const (
+	familyIPv6 addrFamily = 0 // 16 byte address, IPv4 is mapped
+	familyIPv4 addrFamily = 1 // 4 byte address, also for IPv4-mapped IPv6 addresses, decoded as 4 byte net.IP
+
+	familyBigEndianPorts addrFamily = 0x80
+)
+
+func (f addrFamily) validate() error {
+	if f&^familyBigEndianPorts > familyIPv4 {
+		return InvalidMessageError{Err: fmt.Errorf("unknown address family %d", f)}
+	}
+	return nil
+}
+
+// addrLen returns the encoded length of an address including the port.
+func (f addrFamily) addrLen() int {
+	if f.isIPv4() {
+		return 2 + 4
+	}
+	return 2 + 16
+}
+
+func (f addrFamily) isIPv4() bool {
+	return f&^familyBigEndianPorts == familyIPv4
+}
+
+// portOrder returns the byte order of ports in addresses of family f.
+func (f addrFamily) portOrder() binary.ByteOrder {
+	if f&familyBigEndianPorts != 0 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// familyOf returns the most compact family able to encode all of ips in a
+// message of version v, with big-endian ports if requested. Version 1 always
+// uses IPv6 and little-endian ports.
+func familyOf(v ProtocolVersion, bigEndianPorts bool, ips ...net.IP) addrFamily {
+	if v < 2 {
+		return familyIPv6
+	}
+	family := familyIPv4
+	if len(ips) == 0 {
+		family = familyIPv6
+	}
+	for _, ip := range ips {
+		if ip.To4() == nil {
+			family = familyIPv6
+		}
+	}
+	if bigEndianPorts {
+		family |= familyBigEndianPorts
+	}
+	return family
+}
+
+// Since version 2, the CID of AssID, SReq and SReqTCP is encoded as unsigned
+// varint, see binary.PutUvarint, as most CIDs are small. Version 1 uses 32
+// bit little endian.
+
+// cidLen returns the length of the varint CID at the start of b. If b ends
+// before the CID, the result is one byte more than available.
+func cidLen(b []byte) (int, error) {
+	for i := 0; i < len(b); i++ {
+		if i == binary.MaxVarintLen32 {
+			break
+		}
+		if b[i] < 0x80 {
+			return i + 1, nil
+		}
+	}
+	if len(b) < binary.MaxVarintLen32 {
+		return len(b) + 1, nil
+	}
+	return 0, errCIDOverflow
+}
+
+var errCIDOverflow = InvalidMessageError{Err: errors.New("varint CID overflows 32 bit")}
+
+// writeCID writes cid in the encoding of version v.
+func writeCID(b *bytes.Buffer, v ProtocolVersion, cid uint32) {
+	if v < 2 {
+		binary.Write(b, binary.LittleEndian, cid)
+		return
+	}
+	var buf [binary.MaxVarintLen32]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], uint64(cid))])
+}
+
+// putCID is writeCID for a byte slice and returns the number of bytes
+// written.
+func putCID(b []byte, v ProtocolVersion, cid uint32) int {
+	if v < 2 {
+		binary.LittleEndian.PutUint32(b, cid)
+		return 4
+	}
+	return binary.PutUvarint(b, uint64(cid))
+}
+
+// readCID reads a CID in the encoding of version v.
+func readCID(r *msgReader, v ProtocolVersion, cid *uint32) error {
+	if v < 2 {
+		if err := binary.Read(r, binary.LittleEndian, cid); err != nil {
+			return r.invalid(err)
+		}
+		return nil
+	}
+	r.start = r.size - r.Len()
+	x, err := binary.ReadUvarint(&r.Reader)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return r.invalid(err)
+	}
+	if x > math.MaxUint32 {
+		return r.locate(errCIDOverflow)
+	}
+	*cid = uint32(x)
+	return nil
+}
+
+// writeHeader writes h followed by the address family in version 2.
+func writeHeader(b *bytes.Buffer, h Header, family addrFamily) {
+	binary.Write(b, binary.LittleEndian, h)
+	if h.Version >= 2 {
+		b.WriteByte(byte(family))
+	}
+}
+
+// readHeader reads and validates h and returns the address family of the
+// message.
+func readHeader(r *msgReader, h *Header) (addrFamily, error) {
+	if err := binary.Read(r, binary.LittleEndian, h); err != nil {
+		return 0, r.invalid(err)
+	}
+	if err := h.Validate(); err != nil {
+		return 0, err
+	}
+	if h.Version < 2 {
+		return familyIPv6, nil
+	}
+	var family addrFamily
+	if err := binary.Read(r, binary.LittleEndian, &family); err != nil {
+		return 0, r.invalid(err)
+	}
+	return family, r.locate(family.validate())
+}
+
+// Since version 2, the transports offered by the host follow as a single byte,
+// followed by a flags byte, the optional preferred address, the optional
+// metadata and identity, each prefixed with its length as a single byte, and
+// the optional nonce.
 type IDReq struct {
 	Header
+	Transports Transports // version 2 only
+	// Address of the host to advertise to clients behind the same NAT, e.g.
+	// its LAN address. Version 2 only, omitted if nil.
+	PreferredAddr *net.UDPAddr
+	Padding       bool // version 2 only: request padded replies, see MarshalPadded
+	// Information about the host's game for directory services, opaque to the
+	// puncher. Version 2 only, at most MaxMetadataSize byte, omitted if empty.
+	Metadata []byte
+	// Version 2 only: announces big-endian ports, see addrFamily. The server
+	// then uses them in all messages to the host.
+	BigEndianPorts bool
+	// Secret token of the host from which the server derives its CID, so
+	// that it gets the same CID after reconnecting. See Server.IdentityKey.
+	// Version 2 only, at most MaxIdentitySize byte, omitted if empty.
+	Identity []byte
+	// Version 2 only: request checksummed replies, see MarshalChecksummed.
+	// Can't be combined with Padding.
+	Checksum bool
+	Nonce    uint64 // version 2 only: echoed from AssID, omitted if zero
+}
+
+const (
+	idreqFlagPreferredAddr = 0x01
+	idreqFlagPadding       = 0x02
+	idreqFlagMetadata      = 0x04
+	idreqFlagIdentity      = 0x08
+	idreqFlagChecksum      = 0x10
+	idreqFlagNonce         = 0x20
+)
+
+// errPaddingChecksum is returned by Validate for messages requesting both
+// padded and checksummed replies.
+var errPaddingChecksum = InvalidMessageError{Err: errors.New("padding and checksum requested together")}
+
+func errMetadataSize(n int) error {
+	return InvalidMessageError{Err: fmt.Errorf("metadata of %d byte exceeds %d byte", n, MaxMetadataSize)}
+}
+
+func errIdentitySize(n int) error {
+	return InvalidMessageError{Err: fmt.Errorf("identity of %d byte exceeds %d byte", n, MaxIdentitySize)}
 }
 
 func (*IDReq) Type() byte { return PID_Puncher_IDReq }
 
+// Validate checks the sizes of Metadata and Identity and that Padding and
+// Checksum aren't both set. PreferredAddr isn't checked, as the server falls
+// back to the observed address.
+func (p *IDReq) Validate() error {
+	if len(p.Metadata) > MaxMetadataSize {
+		return errMetadataSize(len(p.Metadata))
+	}
+	if len(p.Identity) > MaxIdentitySize {
+		return errIdentitySize(len(p.Identity))
+	}
+	if p.Padding && p.Checksum {
+		return errPaddingChecksum
+	}
+	return nil
+}
+
+// NewIDReq returns an IDReq using the newest protocol version.
+func NewIDReq() *IDReq {
+	return &IDReq{Header: Header{PID_Puncher_IDReq, NewestProtocolVersion}}
+}
+
+// Fails if PreferredAddr is set without IP or Metadata or Identity is too large
 func (p IDReq) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	var ips []net.IP
+	if p.PreferredAddr != nil {
+		ips = append(ips, p.PreferredAddr.IP)
+	}
+	family := familyOf(p.Header.Version, p.BigEndianPorts, ips...)
+	writeHeader(&b, p.Header, family)
+	if p.Header.Version >= 2 {
+		b.WriteByte(byte(p.Transports))
+		var flags byte
+		if p.PreferredAddr != nil {
+			flags |= idreqFlagPreferredAddr
+		}
+		if p.Padding {
+			flags |= idreqFlagPadding
+		}
+		if len(p.Metadata) > 0 {
+			flags |= idreqFlagMetadata
+		}
+		if len(p.Identity) > 0 {
+			flags |= idreqFlagIdentity
+		}
+		if p.Checksum {
+			flags |= idreqFlagChecksum
+		}
+		if p.Nonce != 0 {
+			flags |= idreqFlagNonce
+		}
+		b.WriteByte(flags)
+		if p.PreferredAddr != nil {
+			if err := writeTCPAddr(&b, net.TCPAddr(*p.PreferredAddr), family); err != nil {
+				return nil, err
+			}
+		}
+		if len(p.Metadata) > 0 {
+			if len(p.Metadata) > MaxMetadataSize {
+				return nil, errMetadataSize(len(p.Metadata))
+			}
+			b.WriteByte(byte(len(p.Metadata)))
+			b.Write(p.Metadata)
+		}
+		if len(p.Identity) > 0 {
+			if len(p.Identity) > MaxIdentitySize {
+				return nil, errIdentitySize(len(p.Identity))
+			}
+			b.WriteByte(byte(len(p.Identity)))
+			b.Write(p.Identity)
+		}
+		if p.Nonce != 0 {
+			binary.Write(&b, binary.LittleEndian, p.Nonce)
+		}
+	}
 	return b.Bytes(), nil
 }
 
 func (p *IDReq) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
 	if err != nil {
-		return ErrInvalidMessage(err.Error())
+		return err
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	p.Transports = 0
+	p.PreferredAddr = nil
+	p.Padding = false
+	p.Metadata = nil
+	p.Identity = nil
+	p.Checksum = false
+	p.Nonce = 0
+	if p.Header.Version >= 2 {
+		if err := binary.Read(b, binary.LittleEndian, &p.Transports); err != nil {
+			return b.invalid(err)
+		}
+		var flags byte
+		if err := binary.Read(b, binary.LittleEndian, &flags); err != nil {
+			return b.invalid(err)
+		}
+		p.Padding = flags&idreqFlagPadding != 0
+		p.Checksum = flags&idreqFlagChecksum != 0
+		if flags&idreqFlagPreferredAddr != 0 {
+			addr, err := readTCPAddr(b, family)
+			if err != nil {
+				return err
+			}
+			udpaddr := net.UDPAddr(addr)
+			p.PreferredAddr = &udpaddr
+		}
+		if flags&idreqFlagMetadata != 0 {
+			var l byte
+			if err := binary.Read(b, binary.LittleEndian, &l); err != nil {
+				return b.invalid(err)
+			}
+			if int(l) > MaxMetadataSize {
+				return b.locate(errMetadataSize(int(l)))
+			}
+			p.Metadata = make([]byte, l)
+			if err := binary.Read(b, binary.LittleEndian, p.Metadata); err != nil {
+				return b.invalid(err)
+			}
+		}
+		if flags&idreqFlagIdentity != 0 {
+			var l byte
+			if err := binary.Read(b, binary.LittleEndian, &l); err != nil {
+				return b.invalid(err)
+			}
+			if int(l) > MaxIdentitySize {
+				return b.locate(errIdentitySize(int(l)))
+			}
+			p.Identity = make([]byte, l)
+			if err := binary.Read(b, binary.LittleEndian, p.Identity); err != nil {
+				return b.invalid(err)
+			}
+		}
+		if flags&idreqFlagNonce != 0 {
+			if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+				return b.invalid(err)
+			}
+		}
 	}
 	return nil
 }
 
+// Since version 2, a flags byte follows the CID which indicates optional
+// fields.
 type AssID struct {
 	Header
 	CID uint32
+	// Version 2 only: to be echoed in IDReq or SReqV2 and included in CReq
+	// to bind them to the connection, omitted if zero. See
+	// Server.RequireNonce.
+	Nonce uint64
 }
 
+const assidFlagNonce = 0x01
+
 func (*AssID) Type() byte { return PID_Puncher_AssID }
 
+// Validate checks that CID is set.
+func (p *AssID) Validate() error {
+	if p.CID == 0 {
+		return errZeroCID
+	}
+	return nil
+}
+
 // error is always nil
 func (p AssID) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	writeHeader(&b, p.Header, familyIPv6)
+	writeCID(&b, p.Header.Version, p.CID)
+	if p.Header.Version >= 2 {
+		var flags byte
+		if p.Nonce != 0 {
+			flags |= assidFlagNonce
+		}
+		b.WriteByte(flags)
+		if p.Nonce != 0 {
+			binary.Write(&b, binary.LittleEndian, p.Nonce)
+		}
+	}
 	return b.Bytes(), nil
 }
 
+// MarshalAssID returns the encoding of AssID{Header{PID_Puncher_AssID, v}, cid, 0}
+// without going through MarshalBinary. Replying to IDReq is the server's most
+// frequent operation.
+func MarshalAssID(v ProtocolVersion, cid uint32) []byte {
+	if v < 2 {
+		b := make([]byte, HeaderSize+4)
+		b[0], b[1] = PID_Puncher_AssID, byte(v)
+		binary.LittleEndian.PutUint32(b[HeaderSize:], cid)
+		return b
+	}
+	// The flags byte at the end stays zero.
+	b := make([]byte, HeaderSize+1+binary.MaxVarintLen32+1)
+	b[0], b[1], b[2] = PID_Puncher_AssID, byte(v), byte(familyIPv6)
+	n := HeaderSize + 1 + binary.PutUvarint(b[HeaderSize+1:], uint64(cid))
+	return b[:n+1]
+}
+
 func (p *AssID) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
-		return ErrInvalidMessage(err.Error())
+	b := newMsgReader(buf)
+	if _, err := readHeader(b, &p.Header); err != nil {
+		return err
+	}
+	if err := readCID(b, p.Header.Version, &p.CID); err != nil {
+		return err
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.Nonce = 0
+	if p.Header.Version >= 2 {
+		var flags byte
+		if err := binary.Read(b, binary.LittleEndian, &flags); err != nil {
+			return b.invalid(err)
+		}
+		if flags&assidFlagNonce != 0 {
+			if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+				return b.invalid(err)
+			}
+		}
 	}
 	return nil
 }
@@ -216,65 +1077,160 @@ type SReq struct {
 
 func (*SReq) Type() byte { return PID_Puncher_SReq }
 
+// Validate checks that CID is set.
+func (p *SReq) Validate() error {
+	if p.CID == 0 {
+		return errZeroCID
+	}
+	return nil
+}
+
+// NewSReq returns an SReq for cid using the newest protocol version.
+func NewSReq(cid uint32) *SReq {
+	return &SReq{Header{PID_Puncher_SReq, NewestProtocolVersion}, cid}
+}
+
 // error is always nil
 func (p SReq) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	writeHeader(&b, p.Header, familyIPv6)
+	writeCID(&b, p.Header.Version, p.CID)
 	return b.Bytes(), nil
 }
 
 func (p *SReq) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
-		return ErrInvalidMessage(err.Error())
-	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	b := newMsgReader(buf)
+	if _, err := readHeader(b, &p.Header); err != nil {
+		return err
 	}
-	return nil
+	return readCID(b, p.Header.Version, &p.CID)
 }
 
-// Addr is encoded as 16 bit port (little endian) and 16 byte IPv6 address.
+// Addr is encoded as 16 bit port (little endian unless BigEndianPorts) and IP
+// address, see addrFamily. Since version 2, a flags byte follows which
+// indicates optional fields.
 type CReq struct {
 	Header
-	Addr net.UDPAddr
+	Addr           net.UDPAddr
+	Timestamp      uint64 // version 2 only: echoed from SReqV2, omitted if zero
+	BigEndianPorts bool   // version 2 only: see addrFamily
+	Nonce          uint64 // version 2 only: the receiver's nonce from AssID, omitted if zero
 }
 
+const (
+	creqFlagTimestamp = 0x01
+	creqFlagNonce     = 0x02
+)
+
 func (*CReq) Type() byte { return PID_Puncher_CReq }
 
+// UDPAddr returns a copy of Addr for use with net.DialUDP and similar.
+func (p *CReq) UDPAddr() *net.UDPAddr {
+	addr := p.Addr
+	return &addr
+}
+
 // Fails if Addr is not set
 func (p CReq) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p.Header)
-	binary.Write(&b, binary.LittleEndian, uint16(p.Addr.Port))
-	v6 := p.Addr.IP.To16()
-	if v6 == nil {
-		return nil, errors.New("cannot marshal CReq: Addr.IP nil")
+	family := familyOf(p.Header.Version, p.BigEndianPorts, p.Addr.IP)
+	writeHeader(&b, p.Header, family)
+	if err := writeTCPAddr(&b, net.TCPAddr(p.Addr), family); err != nil {
+		return nil, err
+	}
+	if p.Header.Version >= 2 {
+		var flags byte
+		if p.Timestamp != 0 {
+			flags |= creqFlagTimestamp
+		}
+		if p.Nonce != 0 {
+			flags |= creqFlagNonce
+		}
+		b.WriteByte(flags)
+		if p.Timestamp != 0 {
+			binary.Write(&b, binary.LittleEndian, p.Timestamp)
+		}
+		if p.Nonce != 0 {
+			binary.Write(&b, binary.LittleEndian, p.Nonce)
+		}
 	}
-	binary.Write(&b, binary.LittleEndian, v6)
 	return b.Bytes(), nil
 }
 
 func (p *CReq) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	if err := binary.Read(b, binary.LittleEndian, &p.Header); err != nil {
-		return ErrInvalidMessage(err.Error())
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
+	if err != nil {
+		return err
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	addr, err := readTCPAddr(b, family)
+	if err != nil {
+		return err
 	}
-	var port uint16
-	if err := binary.Read(b, binary.LittleEndian, &port); err != nil {
-		return ErrInvalidMessage(err.Error())
+	p.Addr = net.UDPAddr(addr)
+	p.Timestamp = 0
+	p.Nonce = 0
+	if p.Header.Version >= 2 {
+		var flags byte
+		if err := binary.Read(b, binary.LittleEndian, &flags); err != nil {
+			return b.invalid(err)
+		}
+		if flags&creqFlagTimestamp != 0 {
+			if err := binary.Read(b, binary.LittleEndian, &p.Timestamp); err != nil {
+				return b.invalid(err)
+			}
+		}
+		if flags&creqFlagNonce != 0 {
+			if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+				return b.invalid(err)
+			}
+		}
 	}
-	var ip [16]byte
-	if err := binary.Read(b, binary.LittleEndian, &ip); err != nil {
-		return ErrInvalidMessage(err.Error())
+	return nil
+}
+
+// VerifyCReqPair checks that the two CReq messages sent for a punch request
+// point the host towards the client and the client towards the host.
+func VerifyCReqPair(toHost, toClient CReq, hostAddr, clientAddr net.UDPAddr) error {
+	hostOk := udpAddrEqual(toHost.Addr, clientAddr)
+	clientOk := udpAddrEqual(toClient.Addr, hostAddr)
+	switch {
+	case hostOk && clientOk:
+		return nil
+	case udpAddrEqual(toHost.Addr, hostAddr) && udpAddrEqual(toClient.Addr, clientAddr):
+		return errors.New("netpuncher: CReq pair is swapped")
+	case !hostOk:
+		return fmt.Errorf("netpuncher: CReq to host points to %v instead of client %v", &toHost.Addr, &clientAddr)
+	default:
+		return fmt.Errorf("netpuncher: CReq to client points to %v instead of host %v", &toClient.Addr, &hostAddr)
+	}
+}
+
+func udpAddrEqual(a, b net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// Validate checks that Addr can be punched towards. Decoding doesn't check
+// this, so that invalid messages can still be inspected.
+func (p *CReq) Validate() error {
+	return validatePunchAddr(p.Addr.IP, p.Addr.Port)
+}
+
+// validatePunchAddr checks that an address is a usable punch target.
+func validatePunchAddr(ip net.IP, port int) error {
+	switch {
+	case port == 0:
+		return fmt.Errorf("netpuncher: zero port in address %v", ip)
+	case port < 0 || port > 0xffff:
+		return fmt.Errorf("netpuncher: port %d out of range", port)
+	case ip.To16() == nil:
+		return fmt.Errorf("netpuncher: invalid IP address %v", ip)
+	case ip.IsUnspecified():
+		return fmt.Errorf("netpuncher: unspecified IP address %v", ip)
 	}
-	p.Addr = net.UDPAddr{Port: int(port), IP: ip[:]}
 	return nil
 }
 
@@ -285,91 +1241,925 @@ type SReqTCP struct {
 
 func (*SReqTCP) Type() byte { return PID_Puncher_SReqTCP }
 
+// Validate checks that CID is set.
+func (p *SReqTCP) Validate() error {
+	if p.CID == 0 {
+		return errZeroCID
+	}
+	return nil
+}
+
+// NewSReqTCP returns an SReqTCP for cid using the newest protocol version.
+func NewSReqTCP(cid uint32) *SReqTCP {
+	return &SReqTCP{Header{PID_Puncher_SReqTCP, NewestProtocolVersion}, cid}
+}
+
 // error is always nil
 func (p SReqTCP) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p)
+	writeHeader(&b, p.Header, familyIPv6)
+	writeCID(&b, p.Header.Version, p.CID)
 	return b.Bytes(), nil
 }
 
 func (p *SReqTCP) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	err := binary.Read(b, binary.LittleEndian, p)
-	if err != nil {
-		return ErrInvalidMessage(err.Error())
-	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	b := newMsgReader(buf)
+	if _, err := readHeader(b, &p.Header); err != nil {
+		return err
 	}
-	return nil
+	return readCID(b, p.Header.Version, &p.CID)
 }
 
-// Addr is encoded as 16 bit TCP port (little endian) and 16 byte IPv6 address.
+// Addr is encoded as 16 bit TCP port (little endian unless BigEndianPorts) and
+// IP address, see addrFamily. Since version 2, a flags byte follows which
+// indicates optional fields.
 type CReqTCP struct {
 	Header
-	SourceAddr net.TCPAddr
-	DestAddr   net.TCPAddr
+	SourceAddr     net.TCPAddr
+	DestAddr       net.TCPAddr
+	Retry          *RetryHint // version 2 only: omitted if nil
+	BigEndianPorts bool       // version 2 only: see addrFamily
+	Nonce          uint64     // version 2 only: the receiver's nonce from AssID, omitted if zero
 }
 
+// RetryHint tunes the simultaneous open loop of a peer receiving CReqTCP, as
+// different NATs need different numbers of connection attempts. Encoded as
+// count byte followed by the interval in milliseconds (16 bit, little endian).
+type RetryHint struct {
+	Count    uint8 // number of connection attempts after the first one
+	Interval time.Duration
+}
+
+const (
+	creqtcpFlagRetry = 0x01
+	creqtcpFlagNonce = 0x02
+)
+
 func (*CReqTCP) Type() byte { return PID_Puncher_CReqTCP }
 
-func writeTCPAddr(w io.Writer, addr net.TCPAddr) error {
-	err := binary.Write(w, binary.LittleEndian, uint16(addr.Port))
+// LocalListenAddr returns the address the receiving peer binds for the
+// simultaneous open, i.e. the source of its outgoing connection attempt.
+func (p *CReqTCP) LocalListenAddr() net.TCPAddr {
+	return p.SourceAddr
+}
+
+// SourceTCPAddr returns a copy of SourceAddr for use with net.DialTCP and
+// similar.
+func (p *CReqTCP) SourceTCPAddr() *net.TCPAddr {
+	addr := p.SourceAddr
+	return &addr
+}
+
+// DestTCPAddr returns a copy of DestAddr for use with net.DialTCP and similar.
+func (p *CReqTCP) DestTCPAddr() *net.TCPAddr {
+	addr := p.DestAddr
+	return &addr
+}
+
+// RetryParams returns the retry count and interval from the server's hint,
+// or the given defaults if there is none.
+func (p *CReqTCP) RetryParams(count int, interval time.Duration) (int, time.Duration) {
+	if p.Retry == nil {
+		return count, interval
+	}
+	return int(p.Retry.Count), p.Retry.Interval
+}
+
+// checkIP tells apart the ways ip can be unusable for encoding, as they point
+// to different mistakes by the caller.
+func checkIP(ip net.IP) error {
+	switch {
+	case ip == nil:
+		return errors.New("cannot marshal address: IP nil")
+	case len(ip) == 0:
+		return errors.New("cannot marshal address: IP empty")
+	case len(ip) != net.IPv4len && len(ip) != net.IPv6len:
+		return fmt.Errorf("cannot marshal address: invalid IP length %d", len(ip))
+	}
+	return nil
+}
+
+// writeTCPAddr writes addr, also used for UDP addresses.
+func writeTCPAddr(w io.Writer, addr net.TCPAddr, family addrFamily) error {
+	if err := checkIP(addr.IP); err != nil {
+		return err
+	}
+	err := binary.Write(w, family.portOrder(), uint16(addr.Port))
 	if err != nil {
 		return err
 	}
-	v6 := addr.IP.To16()
-	if v6 == nil {
-		return errors.New("cannot marshal TCPAddr: IP nil")
+	// To16 maps 4 byte IPv4 addresses, so both forms give the same bytes.
+	ip := addr.IP.To16()
+	if family.isIPv4() {
+		ip = addr.IP.To4()
 	}
-	return binary.Write(w, binary.LittleEndian, v6)
+	return binary.Write(w, binary.LittleEndian, []byte(ip))
 }
 
-func readTCPAddr(r io.Reader) (net.TCPAddr, error) {
+func readTCPAddr(r *msgReader, family addrFamily) (net.TCPAddr, error) {
 	var port uint16
-	if err := binary.Read(r, binary.LittleEndian, &port); err != nil {
-		return net.TCPAddr{}, ErrInvalidMessage(err.Error())
+	if err := binary.Read(r, family.portOrder(), &port); err != nil {
+		return net.TCPAddr{}, r.invalid(err)
+	}
+	ip := make(net.IP, family.addrLen()-2)
+	if err := binary.Read(r, binary.LittleEndian, []byte(ip)); err != nil {
+		return net.TCPAddr{}, r.invalid(err)
 	}
-	var ip [16]byte
-	if err := binary.Read(r, binary.LittleEndian, &ip); err != nil {
-		return net.TCPAddr{}, ErrInvalidMessage(err.Error())
+	return net.TCPAddr{Port: int(port), IP: ip}, nil
+}
+
+// Validate checks that SourceAddr and DestAddr are usable for punching.
+// Decoding doesn't check this, so that invalid messages can still be
+// inspected.
+func (p *CReqTCP) Validate() error {
+	if err := validatePunchAddr(p.SourceAddr.IP, p.SourceAddr.Port); err != nil {
+		return err
 	}
-	return net.TCPAddr{Port: int(port), IP: ip[:]}, nil
+	return validatePunchAddr(p.DestAddr.IP, p.DestAddr.Port)
 }
 
 // Fails if SourceAddr or DestAddr is not set
 func (p CReqTCP) MarshalBinary() ([]byte, error) {
 	var b bytes.Buffer
 	p.Header.Type = p.Type()
-	binary.Write(&b, binary.LittleEndian, p.Header)
-	err := writeTCPAddr(&b, p.SourceAddr)
+	family := familyOf(p.Header.Version, p.BigEndianPorts, p.SourceAddr.IP, p.DestAddr.IP)
+	writeHeader(&b, p.Header, family)
+	err := writeTCPAddr(&b, p.SourceAddr, family)
 	if err != nil {
 		return nil, err
 	}
-	err = writeTCPAddr(&b, p.DestAddr)
+	err = writeTCPAddr(&b, p.DestAddr, family)
 	if err != nil {
 		return nil, err
 	}
+	if p.Header.Version >= 2 {
+		var flags byte
+		if p.Retry != nil {
+			flags |= creqtcpFlagRetry
+		}
+		if p.Nonce != 0 {
+			flags |= creqtcpFlagNonce
+		}
+		b.WriteByte(flags)
+		if p.Retry != nil {
+			ms := p.Retry.Interval / time.Millisecond
+			if ms < 0 || ms > math.MaxUint16 {
+				return nil, fmt.Errorf("retry interval %v out of range", p.Retry.Interval)
+			}
+			b.WriteByte(p.Retry.Count)
+			binary.Write(&b, binary.LittleEndian, uint16(ms))
+		}
+		if p.Nonce != 0 {
+			binary.Write(&b, binary.LittleEndian, p.Nonce)
+		}
+	}
 	return b.Bytes(), nil
 }
 
 func (p *CReqTCP) UnmarshalBinary(buf []byte) error {
-	b := bytes.NewReader(buf)
-	if err := binary.Read(b, binary.LittleEndian, &p.Header); err != nil {
-		return ErrInvalidMessage(err.Error())
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
+	if err != nil {
+		return err
+	}
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	p.SourceAddr, err = readTCPAddr(b, family)
+	if err != nil {
+		return err
+	}
+	p.DestAddr, err = readTCPAddr(b, family)
+	if err != nil {
+		return err
+	}
+	p.Retry = nil
+	p.Nonce = 0
+	if p.Header.Version >= 2 {
+		var flags byte
+		if err := binary.Read(b, binary.LittleEndian, &flags); err != nil {
+			return b.invalid(err)
+		}
+		if flags&creqtcpFlagRetry != 0 {
+			var hint struct {
+				Count    uint8
+				Interval uint16
+			}
+			if err := binary.Read(b, binary.LittleEndian, &hint); err != nil {
+				return b.invalid(err)
+			}
+			p.Retry = &RetryHint{hint.Count, time.Duration(hint.Interval) * time.Millisecond}
+		}
+		if flags&creqtcpFlagNonce != 0 {
+			if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+				return b.invalid(err)
+			}
+		}
+	}
+	return nil
+}
+
+// unmarshalSourceOnly decodes a CReqTCP consisting of exactly the header and
+// SourceAddr, see UnmarshalLenient.
+func (p *CReqTCP) unmarshalSourceOnly(buf []byte) error {
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
+	if err != nil {
+		return err
+	}
+	if b.Len() != family.addrLen() {
+		return ErrNotReadEnough(len(buf))
+	}
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	if p.SourceAddr, err = readTCPAddr(b, family); err != nil {
+		return err
 	}
-	if !p.Header.Version.Supported() {
-		return ErrUnsupportedVersion(p.Header.Version)
+	p.DestAddr = net.TCPAddr{}
+	p.Retry = nil
+	return nil
+}
+
+// MaxTCPPairs is the maximum number of address pairs in CReqTCPMulti.
+const MaxTCPPairs = 4
+
+// TCPPair is a candidate for simultaneous open, see CReqTCP.
+type TCPPair struct {
+	SourceAddr net.TCPAddr
+	DestAddr   net.TCPAddr
+}
+
+// CReqTCPMulti is like CReqTCP, but offers several candidate address pairs,
+// e.g. in case a port is in use. Peers try them in order. Encoded as count
+// byte followed by the pairs, see CReqTCP.
+type CReqTCPMulti struct {
+	Header
+	Pairs          []TCPPair
+	BigEndianPorts bool // see addrFamily
+}
+
+func (*CReqTCPMulti) Type() byte { return PID_Puncher_CReqTCPMulti }
+
+// Validate checks that there are between one and MaxTCPPairs pairs which can
+// be punched towards, see CReqTCP.Validate.
+func (p *CReqTCPMulti) Validate() error {
+	if len(p.Pairs) == 0 || len(p.Pairs) > MaxTCPPairs {
+		return fmt.Errorf("netpuncher: %d address pairs, expected 1 to %d", len(p.Pairs), MaxTCPPairs)
+	}
+	for _, pair := range p.Pairs {
+		req := CReqTCP{SourceAddr: pair.SourceAddr, DestAddr: pair.DestAddr}
+		if err := req.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func errTCPPairCount(n int) error {
+	return InvalidMessageError{Err: fmt.Errorf("%d address pairs, at most %d allowed", n, MaxTCPPairs)}
+}
+
+// CReqTCPs returns a CReqTCP for each pair in order, e.g. to call Dial on.
+func (p *CReqTCPMulti) CReqTCPs() []CReqTCP {
+	reqs := make([]CReqTCP, len(p.Pairs))
+	for i, pair := range p.Pairs {
+		reqs[i] = CReqTCP{Header: Header{PID_Puncher_CReqTCP, p.Header.Version}, SourceAddr: pair.SourceAddr, DestAddr: pair.DestAddr, BigEndianPorts: p.BigEndianPorts}
+	}
+	return reqs
+}
+
+// Fails if there are too many pairs or an address is not set
+func (p CReqTCPMulti) MarshalBinary() ([]byte, error) {
+	if len(p.Pairs) > MaxTCPPairs {
+		return nil, errTCPPairCount(len(p.Pairs))
+	}
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	ips := make([]net.IP, 0, 2*len(p.Pairs))
+	for _, pair := range p.Pairs {
+		ips = append(ips, pair.SourceAddr.IP, pair.DestAddr.IP)
+	}
+	family := familyOf(p.Header.Version, p.BigEndianPorts, ips...)
+	writeHeader(&b, p.Header, family)
+	b.WriteByte(byte(len(p.Pairs)))
+	for _, pair := range p.Pairs {
+		if err := writeTCPAddr(&b, pair.SourceAddr, family); err != nil {
+			return nil, err
+		}
+		if err := writeTCPAddr(&b, pair.DestAddr, family); err != nil {
+			return nil, err
+		}
 	}
-	var err error
-	p.SourceAddr, err = readTCPAddr(b)
+	return b.Bytes(), nil
+}
+
+func (p *CReqTCPMulti) UnmarshalBinary(buf []byte) error {
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
 	if err != nil {
 		return err
 	}
-	p.DestAddr, err = readTCPAddr(b)
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	count, err := b.ReadByte()
+	if err != nil {
+		return b.invalid(err)
+	}
+	if count > MaxTCPPairs {
+		return b.locate(errTCPPairCount(int(count)))
+	}
+	// Check the length up front instead of decoding a partial list.
+	if b.Len() < int(count)*2*family.addrLen() {
+		return ErrNotReadEnough(len(buf))
+	}
+	p.Pairs = make([]TCPPair, count)
+	for i := range p.Pairs {
+		if p.Pairs[i].SourceAddr, err = readTCPAddr(b, family); err != nil {
+			return err
+		}
+		if p.Pairs[i].DestAddr, err = readTCPAddr(b, family); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CReqRelay is like CReq, but may offer a relay in addition to or instead of
+// the direct address. Peers punch towards Direct first and fall back to the
+// relay if that times out. They connect to the relay via C4NetIOUDP and
+// identify themselves by sending Token as 8 byte little endian in the first
+// message, after which the relay forwards between the two. Encoded as
+// flags byte followed by the addresses present and the token following the
+// relay address.
+type CReqRelay struct {
+	Header
+	Direct         *net.UDPAddr // omitted if nil
+	Relay          *net.UDPAddr // omitted if nil, together with Token
+	Token          uint64       // session token for the relay
+	BigEndianPorts bool         // see addrFamily
+}
+
+const (
+	creqrelayFlagDirect = 0x01
+	creqrelayFlagRelay  = 0x02
+)
+
+func (*CReqRelay) Type() byte { return PID_Puncher_CReqRelay }
+
+// Validate checks that at least one of Direct and Relay is set and that they
+// can be punched towards.
+func (p *CReqRelay) Validate() error {
+	if p.Direct == nil && p.Relay == nil {
+		return errors.New("netpuncher: neither direct address nor relay")
+	}
+	for _, addr := range []*net.UDPAddr{p.Direct, p.Relay} {
+		if addr == nil {
+			continue
+		}
+		if err := validatePunchAddr(addr.IP, addr.Port); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CReq returns a CReq for the direct address, or false if there is none.
+func (p *CReqRelay) CReq() (CReq, bool) {
+	if p.Direct == nil {
+		return CReq{}, false
+	}
+	return CReq{Header: Header{PID_Puncher_CReq, p.Header.Version}, Addr: *p.Direct, BigEndianPorts: p.BigEndianPorts}, true
+}
+
+// Fails if an address is set without IP
+func (p CReqRelay) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	var ips []net.IP
+	var flags byte
+	if p.Direct != nil {
+		ips = append(ips, p.Direct.IP)
+		flags |= creqrelayFlagDirect
+	}
+	if p.Relay != nil {
+		ips = append(ips, p.Relay.IP)
+		flags |= creqrelayFlagRelay
+	}
+	family := familyOf(p.Header.Version, p.BigEndianPorts, ips...)
+	writeHeader(&b, p.Header, family)
+	b.WriteByte(flags)
+	if p.Direct != nil {
+		if err := writeTCPAddr(&b, net.TCPAddr(*p.Direct), family); err != nil {
+			return nil, err
+		}
+	}
+	if p.Relay != nil {
+		if err := writeTCPAddr(&b, net.TCPAddr(*p.Relay), family); err != nil {
+			return nil, err
+		}
+		binary.Write(&b, binary.LittleEndian, p.Token)
+	}
+	return b.Bytes(), nil
+}
+
+func (p *CReqRelay) UnmarshalBinary(buf []byte) error {
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
 	if err != nil {
 		return err
 	}
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	p.Direct = nil
+	p.Relay = nil
+	p.Token = 0
+	flags, err := b.ReadByte()
+	if err != nil {
+		return b.invalid(err)
+	}
+	if flags&creqrelayFlagDirect != 0 {
+		addr, err := readTCPAddr(b, family)
+		if err != nil {
+			return err
+		}
+		direct := net.UDPAddr(addr)
+		p.Direct = &direct
+	}
+	if flags&creqrelayFlagRelay != 0 {
+		addr, err := readTCPAddr(b, family)
+		if err != nil {
+			return err
+		}
+		relay := net.UDPAddr(addr)
+		p.Relay = &relay
+		if err := binary.Read(b, binary.LittleEndian, &p.Token); err != nil {
+			return b.invalid(err)
+		}
+	}
+	return nil
+}
+
+// Transport selects the kind of punching requested with SReqV2.
+type Transport byte
+
+const (
+	TransportUDP Transport = 0 // answered with CReq
+	TransportTCP Transport = 1 // answered with CReqTCP
+)
+
+// Transports is a set of transports offered by a host.
+type Transports byte
+
+const (
+	TransportsUDP Transports = 1 << TransportUDP
+	TransportsTCP Transports = 1 << TransportTCP
+)
+
+// Supports returns whether t contains the transport. An empty set is treated
+// as containing all transports, as hosts before version 2 don't specify them.
+func (t Transports) Supports(transport Transport) bool {
+	return t == 0 || t&(1<<transport) != 0
+}
+
+// SReqV2 replaces SReq and SReqTCP in protocol version 2.
+// Encoded as CID (little endian) followed by a flags byte. The lowest bit of
+// the flags selects TCP punching, the others indicate optional fields.
+type SReqV2 struct {
+	Header
+	CID       uint32
+	Transport Transport
+	Timestamp uint64 // echoed by the server in CReq for RTT measurement, omitted if zero
+	// Address of the client to advertise to the host in addition to the
+	// observed address if both are behind the same NAT, omitted if nil. Only
+	// used for UDP punching.
+	PreferredAddr *net.UDPAddr
+	Padding       bool // request padded replies, see MarshalPadded
+	// Announces big-endian ports, see addrFamily. The server then uses them
+	// in all messages to the client.
+	BigEndianPorts bool
+	Nonce          uint64 // echoed from AssID, omitted if zero
+	// Request checksummed replies, see MarshalChecksummed. Can't be
+	// combined with Padding.
+	Checksum bool
+}
+
+const (
+	sreqFlagTCP           = 0x01
+	sreqFlagTimestamp     = 0x02
+	sreqFlagPreferredAddr = 0x04
+	sreqFlagPadding       = 0x08
+	sreqFlagNonce         = 0x10
+	sreqFlagChecksum      = 0x20
+)
+
+func (*SReqV2) Type() byte { return PID_Puncher_SReqV2 }
+
+// Validate checks that CID is set, Transport is known and Padding and
+// Checksum aren't both set. PreferredAddr isn't checked, as the server falls
+// back to the observed address.
+func (p *SReqV2) Validate() error {
+	if p.CID == 0 {
+		return errZeroCID
+	}
+	if p.Transport != TransportUDP && p.Transport != TransportTCP {
+		return fmt.Errorf("netpuncher: unknown transport %d", p.Transport)
+	}
+	if p.Padding && p.Checksum {
+		return errPaddingChecksum
+	}
+	return nil
+}
+
+// Fails if PreferredAddr is set without IP
+func (p SReqV2) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	var ips []net.IP
+	if p.PreferredAddr != nil {
+		ips = append(ips, p.PreferredAddr.IP)
+	}
+	family := familyOf(p.Header.Version, p.BigEndianPorts, ips...)
+	writeHeader(&b, p.Header, family)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	var flags byte
+	if p.Transport == TransportTCP {
+		flags |= sreqFlagTCP
+	}
+	if p.Timestamp != 0 {
+		flags |= sreqFlagTimestamp
+	}
+	if p.PreferredAddr != nil {
+		flags |= sreqFlagPreferredAddr
+	}
+	if p.Padding {
+		flags |= sreqFlagPadding
+	}
+	if p.Nonce != 0 {
+		flags |= sreqFlagNonce
+	}
+	if p.Checksum {
+		flags |= sreqFlagChecksum
+	}
+	b.WriteByte(flags)
+	if p.Timestamp != 0 {
+		binary.Write(&b, binary.LittleEndian, p.Timestamp)
+	}
+	if p.PreferredAddr != nil {
+		if err := writeTCPAddr(&b, net.TCPAddr(*p.PreferredAddr), family); err != nil {
+			return nil, err
+		}
+	}
+	if p.Nonce != 0 {
+		binary.Write(&b, binary.LittleEndian, p.Nonce)
+	}
+	return b.Bytes(), nil
+}
+
+func (p *SReqV2) UnmarshalBinary(buf []byte) error {
+	b := newMsgReader(buf)
+	family, err := readHeader(b, &p.Header)
+	if err != nil {
+		return err
+	}
+	p.BigEndianPorts = family&familyBigEndianPorts != 0
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
+		return b.invalid(err)
+	}
+	var flags byte
+	if err := binary.Read(b, binary.LittleEndian, &flags); err != nil {
+		return b.invalid(err)
+	}
+	p.Transport = TransportUDP
+	if flags&sreqFlagTCP != 0 {
+		p.Transport = TransportTCP
+	}
+	p.Padding = flags&sreqFlagPadding != 0
+	p.Checksum = flags&sreqFlagChecksum != 0
+	p.Timestamp = 0
+	if flags&sreqFlagTimestamp != 0 {
+		if err := binary.Read(b, binary.LittleEndian, &p.Timestamp); err != nil {
+			return b.invalid(err)
+		}
+	}
+	p.PreferredAddr = nil
+	if flags&sreqFlagPreferredAddr != 0 {
+		addr, err := readTCPAddr(b, family)
+		if err != nil {
+			return err
+		}
+		udpaddr := net.UDPAddr(addr)
+		p.PreferredAddr = &udpaddr
+	}
+	p.Nonce = 0
+	if flags&sreqFlagNonce != 0 {
+		if err := binary.Read(b, binary.LittleEndian, &p.Nonce); err != nil {
+			return b.invalid(err)
+		}
+	}
+	return nil
+}
+
+// UnifySReq converts any punch request (SReq, SReqTCP or SReqV2) to the
+// unified SReqV2 form, so that callers only need a single code path. The
+// header is kept as-is, so the result may carry version 1. Returns false if p
+// is not a punch request.
+func UnifySReq(p PuncherPacket) (SReqV2, bool) {
+	switch req := Unwrap(p).(type) {
+	case *SReq:
+		return SReqV2{Header: req.Header, CID: req.CID, Transport: TransportUDP}, true
+	case *SReqTCP:
+		return SReqV2{Header: req.Header, CID: req.CID, Transport: TransportTCP}, true
+	case *SReqV2:
+		return *req, true
+	}
+	return SReqV2{}, false
+}
+
+// PunchTransport returns the transport of a punch request or CReq message.
+// Returns false for messages that don't belong to a punch, e.g. IDReq.
+func PunchTransport(p PuncherPacket) (Transport, bool) {
+	switch Unwrap(p).(type) {
+	case *CReq, *CReqRelay:
+		return TransportUDP, true
+	case *CReqTCP, *CReqTCPMulti:
+		return TransportTCP, true
+	}
+	if req, ok := UnifySReq(p); ok {
+		return req.Transport, true
+	}
+	return 0, false
+}
+
+// IsTCP returns whether p belongs to a TCP punch, i.e. is SReqTCP, CReqTCP,
+// CReqTCPMulti or SReqV2 requesting TCP.
+func IsTCP(p PuncherPacket) bool {
+	t, ok := PunchTransport(p)
+	return ok && t == TransportTCP
+}
+
+// IsUDP returns whether p belongs to a UDP punch, i.e. is SReq, CReq or
+// SReqV2 requesting UDP.
+func IsUDP(p PuncherPacket) bool {
+	t, ok := PunchTransport(p)
+	return ok && t == TransportUDP
+}
+
+// ErrorCode describes why the puncher rejected a request.
+type ErrorCode byte
+
+const (
+	ErrorTransportUnsupported ErrorCode = 1  // the host doesn't offer the requested transport
+	ErrorAddressUnusable      ErrorCode = 2  // the host's or client's address can't be punched towards
+	ErrorVersionTooOld        ErrorCode = 3  // the puncher requires a newer protocol version
+	ErrorPeerUnreachable      ErrorCode = 4  // the puncher couldn't forward the punch request to the other party
+	ErrorUnknownHost          ErrorCode = 5  // no host is registered with the requested ID
+	ErrorDenied               ErrorCode = 6  // the puncher doesn't serve the sender's network
+	ErrorBadNonce             ErrorCode = 7  // the request didn't echo the nonce from AssID
+	ErrorAnnounceFailed       ErrorCode = 8  // the puncher couldn't announce the host, e.g. on a master server
+	ErrorUnexpectedMessage    ErrorCode = 9  // the message is only sent by the puncher or doesn't fit the sender's earlier requests
+	ErrorFamilyMismatch       ErrorCode = 10 // host and client use different IP versions, so punching can't work
+)
+
+var errorCodeNames = [...]string{
+	ErrorTransportUnsupported: "TransportUnsupported",
+	ErrorAddressUnusable:      "AddressUnusable",
+	ErrorVersionTooOld:        "VersionTooOld",
+	ErrorPeerUnreachable:      "PeerUnreachable",
+	ErrorUnknownHost:          "UnknownHost",
+	ErrorDenied:               "Denied",
+	ErrorBadNonce:             "BadNonce",
+	ErrorAnnounceFailed:       "AnnounceFailed",
+	ErrorUnexpectedMessage:    "UnexpectedMessage",
+	ErrorFamilyMismatch:       "FamilyMismatch",
+}
+
+var errorCodeMessages = [...]string{
+	ErrorTransportUnsupported: "the host doesn't offer the requested transport",
+	ErrorAddressUnusable:      "the host's or client's address can't be punched towards",
+	ErrorVersionTooOld:        "the puncher requires a newer protocol version",
+	ErrorPeerUnreachable:      "the other party of the punch is unreachable",
+	ErrorUnknownHost:          "no host is registered with the requested ID",
+	ErrorDenied:               "the puncher doesn't serve this network",
+	ErrorBadNonce:             "the request didn't echo the nonce",
+	ErrorAnnounceFailed:       "the puncher couldn't announce the host",
+	ErrorUnexpectedMessage:    "the puncher didn't expect this message",
+	ErrorFamilyMismatch:       "host and client use different IP versions",
+}
+
+// String returns the name of the code, e.g. "UnknownHost".
+func (c ErrorCode) String() string {
+	if int(c) < len(errorCodeNames) && errorCodeNames[c] != "" {
+		return errorCodeNames[c]
+	}
+	return fmt.Sprintf("ErrorCode(%d)", byte(c))
+}
+
+// Message returns a human-readable description of the code for displaying
+// to users, see also Error.Text.
+func (c ErrorCode) Message() string {
+	if int(c) < len(errorCodeMessages) && errorCodeMessages[c] != "" {
+		return errorCodeMessages[c]
+	}
+	return fmt.Sprintf("unknown error %d", byte(c))
+}
+
+// Error is sent by the puncher instead of the usual reply if it can't serve a
+// request. Only clients with version 2 receive this message. CID is the ID the
+// rejected request referred to.
+//
+// The optional Message is a human-readable explanation of at most
+// MaxErrorMessageSize byte. It is signalled by the high bit of the code byte
+// and follows the CID, prefixed with its length as a single byte.
+type Error struct {
+	Header
+	Code    ErrorCode
+	CID     uint32
+	Message string // omitted if empty
+}
+
+// errorFlagMessage is set in the code byte if Error.Message follows.
+const errorFlagMessage = 0x80
+
+func errErrorMessageSize(n int) error {
+	return InvalidMessageError{Err: fmt.Errorf("error message of %d byte exceeds %d byte", n, MaxErrorMessageSize)}
+}
+
+func (*Error) Type() byte { return PID_Puncher_Error }
+
+// NewError returns an Error with code and the optional msg using the newest
+// protocol version. CID has to be set if the rejected request referred to a
+// host.
+func NewError(code ErrorCode, msg string) *Error {
+	return &Error{Header: Header{PID_Puncher_Error, NewestProtocolVersion}, Code: code, Message: msg}
+}
+
+// Text returns Message, or the default message of Code if it's empty.
+func (p *Error) Text() string {
+	if p.Message != "" {
+		return p.Message
+	}
+	return p.Code.Message()
+}
+
+// Validate checks that Code is valid and Message isn't too long. Codes
+// unknown to this version are accepted, so that older peers still recognize
+// Errors of newer servers as such. CID may be zero if the rejected request
+// didn't refer to a host.
+func (p *Error) Validate() error {
+	if err := p.Code.validate(); err != nil {
+		return err
+	}
+	if len(p.Message) > MaxErrorMessageSize {
+		return errErrorMessageSize(len(p.Message))
+	}
+	return nil
+}
+
+// validate checks that the code is non-zero and fits beside errorFlagMessage.
+func (c ErrorCode) validate() error {
+	if c == 0 || c&errorFlagMessage != 0 {
+		return fmt.Errorf("netpuncher: invalid error code %d", c)
+	}
+	return nil
+}
+
+// Fails if Message is too long or Code has the high bit set
+func (p Error) MarshalBinary() ([]byte, error) {
+	if len(p.Message) > MaxErrorMessageSize {
+		return nil, errErrorMessageSize(len(p.Message))
+	}
+	if p.Code&errorFlagMessage != 0 {
+		return nil, p.Code.validate()
+	}
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	writeHeader(&b, p.Header, familyIPv6)
+	code := byte(p.Code)
+	if p.Message != "" {
+		code |= errorFlagMessage
+	}
+	b.WriteByte(code)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	if p.Message != "" {
+		b.WriteByte(byte(len(p.Message)))
+		b.WriteString(p.Message)
+	}
+	return b.Bytes(), nil
+}
+
+func (p *Error) UnmarshalBinary(buf []byte) error {
+	b := newMsgReader(buf)
+	if _, err := readHeader(b, &p.Header); err != nil {
+		return err
+	}
+	var code byte
+	if err := binary.Read(b, binary.LittleEndian, &code); err != nil {
+		return b.invalid(err)
+	}
+	p.Code = ErrorCode(code &^ errorFlagMessage)
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
+		return b.invalid(err)
+	}
+	p.Message = ""
+	if code&errorFlagMessage != 0 {
+		var l byte
+		if err := binary.Read(b, binary.LittleEndian, &l); err != nil {
+			return b.invalid(err)
+		}
+		if int(l) > MaxErrorMessageSize {
+			return b.locate(errErrorMessageSize(int(l)))
+		}
+		msg := make([]byte, l)
+		if err := binary.Read(b, binary.LittleEndian, msg); err != nil {
+			return b.invalid(err)
+		}
+		p.Message = string(msg)
+	}
+	return nil
+}
+
+// PunchResult is sent by a client after a punch attempt towards the host with
+// the given ID.
+type PunchResult struct {
+	Header
+	CID     uint32
+	Success bool
+}
+
+func (*PunchResult) Type() byte { return PID_Puncher_Result }
+
+// Validate checks that CID is set.
+func (p *PunchResult) Validate() error {
+	if p.CID == 0 {
+		return errZeroCID
+	}
+	return nil
+}
+
+// error is always nil
+func (p PunchResult) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	writeHeader(&b, p.Header, familyIPv6)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	binary.Write(&b, binary.LittleEndian, p.Success)
+	return b.Bytes(), nil
+}
+
+func (p *PunchResult) UnmarshalBinary(buf []byte) error {
+	b := newMsgReader(buf)
+	if _, err := readHeader(b, &p.Header); err != nil {
+		return err
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
+		return b.invalid(err)
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.Success); err != nil {
+		return b.invalid(err)
+	}
+	return nil
+}
+
+// Heartbeat is sent periodically by a registered host to keep its
+// registration fresh and to update its status, e.g. for a master server,
+// without registering again. The CID has to be the host's own.
+type Heartbeat struct {
+	Header
+	CID     uint32
+	Players uint16 // current number of players
+	Flags   byte   // application-defined, e.g. whether the game has started
+}
+
+func (*Heartbeat) Type() byte { return PID_Puncher_Heartbeat }
+
+// Validate checks that CID is set.
+func (p *Heartbeat) Validate() error {
+	if p.CID == 0 {
+		return errZeroCID
+	}
+	return nil
+}
+
+// error is always nil
+func (p Heartbeat) MarshalBinary() ([]byte, error) {
+	var b bytes.Buffer
+	p.Header.Type = p.Type()
+	writeHeader(&b, p.Header, familyIPv6)
+	binary.Write(&b, binary.LittleEndian, p.CID)
+	binary.Write(&b, binary.LittleEndian, p.Players)
+	b.WriteByte(p.Flags)
+	return b.Bytes(), nil
+}
+
+func (p *Heartbeat) UnmarshalBinary(buf []byte) error {
+	b := newMsgReader(buf)
+	if _, err := readHeader(b, &p.Header); err != nil {
+		return err
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.CID); err != nil {
+		return b.invalid(err)
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.Players); err != nil {
+		return b.invalid(err)
+	}
+	if err := binary.Read(b, binary.LittleEndian, &p.Flags); err != nil {
+		return b.invalid(err)
+	}
 	return nil
 }
@@ -2,20 +2,70 @@ package netpuncher
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 const version = 1
 
 var samplePackets = []PuncherPacket{
-	&IDReq{Header{PID_Puncher_IDReq, version}},
-	&AssID{Header{PID_Puncher_AssID, version}, 0xf0f0f0f0},
-	&SReq{Header{PID_Puncher_SReq, version}, 0xf0f0f0f0},
-	&CReq{Header{PID_Puncher_CReq, version}, net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
-	&SReqTCP{Header{PID_Puncher_SReqTCP, version}, 0xf1f1f1f1},
-	&CReqTCP{Header{PID_Puncher_CReqTCP, version}, net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+	&IDReq{Header: Header{PID_Puncher_IDReq, version}},
+	&AssID{Header: Header{PID_Puncher_AssID, version}, CID: 0xf0f0f0f0},
+	&SReq{Header: Header{PID_Puncher_SReq, version}, CID: 0xf0f0f0f0},
+	&CReq{Header: Header{PID_Puncher_CReq, version}, Addr: net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
+	&SReqTCP{Header: Header{PID_Puncher_SReqTCP, version}, CID: 0xf1f1f1f1},
+	&CReqTCP{Header: Header{PID_Puncher_CReqTCP, version}, SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf2f2f2f2, Transport: TransportUDP},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf2f2f2f2, Transport: TransportTCP, Timestamp: 0xf3f3f3f3f3f3f3f3},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf2f2f2f2, Transport: TransportUDP, PreferredAddr: &net.UDPAddr{Port: 0xff33, IP: net.IPv4(192, 168, 1, 2).To4()}},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf2f2f2f2, Transport: TransportUDP, Timestamp: 0xf3f3f3f3f3f3f3f3, PreferredAddr: &net.UDPAddr{Port: 0xff33, IP: net.ParseIP("2001:db8::1339")}},
+	&CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}},
+	&CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, Timestamp: 0xf4f4f4f4f4f4f4f4},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP | TransportsTCP},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP, PreferredAddr: &net.UDPAddr{Port: 0xff44, IP: net.IPv4(192, 168, 1, 3).To4()}},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Padding: true},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP, PreferredAddr: &net.UDPAddr{Port: 0xff44, IP: net.ParseIP("2001:db8::1340")}, Metadata: bytes.Repeat([]byte{0xf7}, MaxMetadataSize)},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP, Metadata: []byte("Clonk Rage 4 players")},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP, Metadata: []byte("Clonk Rage"), Identity: []byte("host secret")},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf2f2f2f2, Transport: TransportTCP, Padding: true},
+	&Error{Header: Header{PID_Puncher_Error, 2}, Code: ErrorTransportUnsupported, CID: 0xf5f5f5f5},
+	&PunchResult{Header: Header{PID_Puncher_Result, 2}, CID: 0xf6f6f6f6, Success: true},
+	&CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: net.UDPAddr{Port: 0xff11, IP: net.IPv4(192, 0, 2, 1).To4()}, Timestamp: 0xf4f4f4f4f4f4f4f4},
+	&CReqTCP{Header: Header{PID_Puncher_CReqTCP, 2}, SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.IPv4(192, 0, 2, 1).To4()}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.IPv4(192, 0, 2, 2).To4()}},
+	&CReqTCP{Header: Header{PID_Puncher_CReqTCP, 2}, SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.ParseIP("192.0.2.1")}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}},
+	&CReqTCP{Header: Header{PID_Puncher_CReqTCP, 2}, SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}, Retry: &RetryHint{Count: 5, Interval: 250 * time.Millisecond}},
+	&CReqTCPMulti{Header: Header{PID_Puncher_CReqTCPMulti, 2}, Pairs: []TCPPair{{SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.IPv4(192, 0, 2, 1).To4()}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.IPv4(192, 0, 2, 2).To4()}}}},
+	&CReqTCPMulti{Header: Header{PID_Puncher_CReqTCPMulti, 2}, Pairs: tcpPairs(MaxTCPPairs)},
+	&CReqRelay{Header: Header{PID_Puncher_CReqRelay, 2}, Direct: &net.UDPAddr{Port: 0xff11, IP: net.IPv4(192, 0, 2, 1).To4()}},
+	&CReqRelay{Header: Header{PID_Puncher_CReqRelay, 2}, Relay: &net.UDPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1337")}, Token: 0xf8f8f8f8f8f8f8f8},
+	&CReqRelay{Header: Header{PID_Puncher_CReqRelay, 2}, Direct: &net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1338")}, Relay: &net.UDPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1339")}, Token: 0xf8f8f8f8f8f8f8f8, BigEndianPorts: true},
+	&AssID{Header: Header{PID_Puncher_AssID, 2}, CID: 0xf1f1f1f1, Nonce: 0xf9f9f9f9f9f9f9f9},
+	&Heartbeat{Header: Header{PID_Puncher_Heartbeat, 2}, CID: 0xf1f1f1f1, Players: 0xf3f3, Flags: 0xf4},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf1f1f1f1, Transport: TransportUDP, Timestamp: 0xf2f2f2f2f2f2f2f2, PreferredAddr: &net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, Nonce: 0xf9f9f9f9f9f9f9f9},
+	&CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, Timestamp: 0xf4f4f4f4f4f4f4f4, Nonce: 0xf9f9f9f9f9f9f9f9},
+	&CReqTCP{Header: Header{PID_Puncher_CReqTCP, 2}, SourceAddr: net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, DestAddr: net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}, Retry: &RetryHint{Count: 5, Interval: 250 * time.Millisecond}, Nonce: 0xf9f9f9f9f9f9f9f9},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP, Checksum: true},
+	&IDReq{Header: Header{PID_Puncher_IDReq, 2}, Transports: TransportsUDP, Metadata: []byte("Clonk Rage"), Nonce: 0xf9f9f9f9f9f9f9f9},
+	&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 0xf2f2f2f2, Transport: TransportUDP, Checksum: true},
+	&Error{Header: Header{PID_Puncher_Error, 2}, Code: ErrorDenied, Message: "maintenance until 18:00 UTC"},
+}
+
+// tcpPairs returns n IPv6 address pairs with distinct ports.
+func tcpPairs(n int) []TCPPair {
+	pairs := make([]TCPPair, n)
+	for i := range pairs {
+		pairs[i] = TCPPair{SourceAddr: net.TCPAddr{Port: 0xff11 + i, IP: net.ParseIP("2001:db8::1337")}, DestAddr: net.TCPAddr{Port: 0xff22 + i, IP: net.ParseIP("2001:db8::1338")}}
+	}
+	return pairs
 }
 
 func TestMarshalRoundtrip(t *testing.T) {
@@ -47,6 +97,25 @@ func TestMarshalRoundtrip(t *testing.T) {
 }
 
 // Test unmarshalling fake packets with an unsupported version.
+func TestConstructors(t *testing.T) {
+	for _, pkt := range []PuncherPacket{NewIDReq(), NewSReq(1337), NewSReqTCP(1338), NewError(ErrorUnknownHost, "no such game")} {
+		if h := HeaderOf(pkt); h.Type != pkt.Type() || h.Version != NewestProtocolVersion {
+			t.Errorf("%T has header %+v", pkt, h)
+		}
+		buf, err := pkt.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T.MarshalBinary() failed: %v", pkt, err)
+		}
+		cpy, err := Unmarshal(buf)
+		if err != nil {
+			t.Fatalf("Unmarshal for %T failed: %v", pkt, err)
+		}
+		if !reflect.DeepEqual(pkt, cpy) {
+			t.Errorf("%T packets not equal: %+v != %+v", pkt, pkt, cpy)
+		}
+	}
+}
+
 func TestUnsupportedVersion(t *testing.T) {
 	buf := make([]byte, 100)
 	buf[1] = 0xff
@@ -55,8 +124,1117 @@ func TestUnsupportedVersion(t *testing.T) {
 		buf[0] = typ
 		r := bytes.NewReader(buf)
 		_, err := ReadFrom(r)
-		if _, ok := err.(ErrUnsupportedVersion); !ok {
+		if future, ok := err.(ErrFutureVersion); !ok || future.Type != typ || future.Version != 0xff {
 			t.Errorf("unexpected error: %v", err)
 		}
 	}
 }
+
+// All decode errors should wrap ErrProtocol.
+func TestErrorWrapping(t *testing.T) {
+	decode := func(buf []byte) error {
+		_, err := ReadFrom(bytes.NewReader(buf))
+		return err
+	}
+
+	err := decode([]byte{0xff, version})
+	var unknownType ErrUnknownType
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &unknownType) || unknownType != 0xff {
+		t.Errorf("unexpected error for unknown type: %v", err)
+	}
+
+	err = decode([]byte{PID_Puncher_IDReq, 0xff})
+	var unsupportedVersion ErrUnsupportedVersion
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &unsupportedVersion) || unsupportedVersion != 0xff {
+		t.Errorf("unexpected error for unsupported version: %v", err)
+	}
+
+	err = decode([]byte{PID_Puncher_IDReq})
+	var notReadEnough ErrNotReadEnough
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &notReadEnough) || notReadEnough != 1 {
+		t.Errorf("unexpected error for short message: %v", err)
+	}
+
+	err = (&CReq{}).UnmarshalBinary([]byte{PID_Puncher_CReq, version, 0x11})
+	var invalidMessage InvalidMessageError
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &invalidMessage) {
+		t.Errorf("unexpected error for truncated CReq: %v", err)
+	}
+	if !errors.Is(err, ErrInvalidMessage) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("InvalidMessageError doesn't wrap ErrInvalidMessage and the underlying error: %v", err)
+	}
+}
+
+func TestUnmarshalInto(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		p, _ := newPacket(pkt.Type())
+		// Decoding twice into the same packet gives the same result.
+		for i := 0; i < 2; i++ {
+			if err := UnmarshalInto(buf, p); err != nil {
+				t.Fatalf("UnmarshalInto for %T failed: %v", pkt, err)
+			}
+			if !reflect.DeepEqual(p, pkt) {
+				t.Errorf("packets not equal: %+v != %+v", p, pkt)
+			}
+		}
+	}
+
+	buf, _ := AssID{Header: Header{Version: 2}, CID: 1337}.MarshalBinary()
+	err := UnmarshalInto(buf, &SReq{})
+	var mismatch ErrTypeMismatch
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &mismatch) || mismatch != (ErrTypeMismatch{PID_Puncher_AssID, PID_Puncher_SReq}) {
+		t.Errorf("unexpected error for mismatched type: %v", err)
+	}
+}
+
+// SReqV2 requires protocol version 2.
+func TestSReqV2Version(t *testing.T) {
+	buf := []byte{PID_Puncher_SReqV2, 1, 0, 0, 0, 0, 0}
+	var p SReqV2
+	if err := p.UnmarshalBinary(buf); err != ErrUnsupportedVersion(1) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestUnifySReq(t *testing.T) {
+	tests := []struct {
+		in  PuncherPacket
+		out SReqV2
+	}{
+		{&SReq{Header: Header{PID_Puncher_SReq, 1}, CID: 1337}, SReqV2{Header: Header{PID_Puncher_SReq, 1}, CID: 1337, Transport: TransportUDP}},
+		{&SReqTCP{Header: Header{PID_Puncher_SReqTCP, 1}, CID: 1337}, SReqV2{Header: Header{PID_Puncher_SReqTCP, 1}, CID: 1337, Transport: TransportTCP}},
+		{&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 1337, Transport: TransportUDP}, SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 1337, Transport: TransportUDP}},
+		{&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 1337, Transport: TransportTCP, Timestamp: 1}, SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, CID: 1337, Transport: TransportTCP, Timestamp: 1}},
+	}
+	for _, test := range tests {
+		out, ok := UnifySReq(test.in)
+		if !ok || out != test.out {
+			t.Errorf("UnifySReq(%+v) = %+v, %v", test.in, out, ok)
+		}
+	}
+	if _, ok := UnifySReq(&IDReq{}); ok {
+		t.Error("UnifySReq accepted an IDReq")
+	}
+}
+
+func TestPunchTransport(t *testing.T) {
+	tests := []struct {
+		pkt      PuncherPacket
+		tcp, udp bool
+	}{
+		{&IDReq{}, false, false},
+		{&AssID{}, false, false},
+		{&SReq{}, false, true},
+		{&CReq{}, false, true},
+		{&SReqTCP{}, true, false},
+		{&CReqTCP{}, true, false},
+		{&CReqTCPMulti{}, true, false},
+		{&SReqV2{Transport: TransportUDP}, false, true},
+		{&SReqV2{Transport: TransportTCP}, true, false},
+		{&Error{}, false, false},
+		{&PunchResult{}, false, false},
+	}
+	for _, test := range tests {
+		if tcp, udp := IsTCP(test.pkt), IsUDP(test.pkt); tcp != test.tcp || udp != test.udp {
+			t.Errorf("%+v: IsTCP = %v, IsUDP = %v, expected %v, %v", test.pkt, tcp, udp, test.tcp, test.udp)
+		}
+	}
+}
+
+func TestMessageLen(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		n, err := MessageLen(buf)
+		if err != nil {
+			t.Errorf("MessageLen for %T failed: %v", pkt, err)
+			continue
+		}
+		if n != len(buf) {
+			t.Errorf("MessageLen for %T = %d, marshaled %d byte", pkt, n, len(buf))
+		}
+	}
+}
+
+func TestPeekMessageLen(t *testing.T) {
+	game := []byte{0x04, 0x01, 0x00, 0x00, 0x00, 0x42}
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		n := len(buf)
+		buf = append(buf, game...)
+		pid, l, ok := PeekMessageLen(buf)
+		if !ok || pid != buf[0] || l != n {
+			t.Errorf("PeekMessageLen for %T = %#x, %d, %v, expected %#x, %d, true", pkt, pid, l, ok, buf[0], n)
+		}
+		if _, _, ok := PeekMessageLen(buf[:n-1]); ok {
+			t.Errorf("PeekMessageLen for truncated %T reported a message", pkt)
+		}
+	}
+
+	// C4NetIOUDP packets start with a status byte in the low range.
+	for _, b := range [][]byte{nil, game, {0x00}, {0x02, 0x00, 0x00}, {0x84, 0x01}, {PID_Puncher_AssID, 9, 0, 0, 0, 0}} {
+		if pid, l, ok := PeekMessageLen(b); ok {
+			t.Errorf("PeekMessageLen(%x) = %#x, %d, true, expected no message", b, pid, l)
+		}
+	}
+}
+
+func TestIsPuncherMessage(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		if !IsPuncherMessage(buf) {
+			t.Errorf("%T not recognized", pkt)
+		}
+		padded, _ := MarshalPadded(pkt)
+		if !IsPuncherMessage(padded) {
+			t.Errorf("padded %T not recognized", pkt)
+		}
+
+		// Near misses
+		if IsPuncherMessage(buf[:len(buf)-1]) {
+			t.Errorf("truncated %T recognized", pkt)
+		}
+		if IsPuncherMessage(append(buf[:len(buf):len(buf)], 0)) {
+			t.Errorf("%T with trailing byte recognized", pkt)
+		}
+		bad := append([]byte(nil), buf...)
+		bad[1] = 7
+		if IsPuncherMessage(bad) {
+			t.Errorf("%T with unsupported version recognized", pkt)
+		}
+		padded[len(buf)] = 1
+		if IsPuncherMessage(padded) {
+			t.Errorf("%T with non-zero padding recognized", pkt)
+		}
+
+		if HeaderOf(pkt).Version < 2 {
+			continue
+		}
+		checksummed, err := MarshalChecksummed(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsPuncherMessage(checksummed) {
+			t.Errorf("checksummed %T not recognized", pkt)
+		}
+		checksummed[len(checksummed)-1] ^= 1
+		if IsPuncherMessage(checksummed) {
+			t.Errorf("%T with wrong checksum recognized", pkt)
+		}
+	}
+	for _, b := range [][]byte{nil, {PID_Puncher_AssID}, {0x42, 1, 0, 0, 0, 0}, {PID_Puncher_CReq, 2, 0x42}} {
+		if IsPuncherMessage(b) {
+			t.Errorf("IsPuncherMessage(%x) = true", b)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		b := make([]byte, 1+rng.Intn(PaddedSize))
+		rng.Read(b)
+		if IsPuncherMessage(b) {
+			t.Errorf("random bytes %x recognized", b)
+		}
+	}
+}
+
+func TestHeaderSize(t *testing.T) {
+	if n := binary.Size(Header{}); n != HeaderSize {
+		t.Errorf("binary.Size(Header{}) = %d, HeaderSize = %d", n, HeaderSize)
+	}
+	buf, _ := IDReq{Header: Header{Version: 1}}.MarshalBinary()
+	if len(buf) != HeaderSize {
+		t.Errorf("marshaled v1 IDReq (header only) has %d byte, HeaderSize = %d", len(buf), HeaderSize)
+	}
+}
+
+func TestAddrFamily(t *testing.T) {
+	v4 := net.TCPAddr{Port: 0xff11, IP: net.ParseIP("192.0.2.1")}
+	v6 := net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}
+	tests := []struct {
+		pkt    CReqTCP
+		family addrFamily
+	}{
+		{CReqTCP{Header{PID_Puncher_CReqTCP, 1}, v4, v4, nil, false, 0}, familyIPv6}, // implicit in v1
+		{CReqTCP{Header{PID_Puncher_CReqTCP, 2}, v4, v4, nil, false, 0}, familyIPv4},
+		{CReqTCP{Header{PID_Puncher_CReqTCP, 2}, v6, v6, nil, false, 0}, familyIPv6},
+		{CReqTCP{Header{PID_Puncher_CReqTCP, 2}, v4, v6, nil, false, 0}, familyIPv6},
+	}
+	for _, test := range tests {
+		buf, err := test.pkt.MarshalBinary()
+		if err != nil {
+			t.Errorf("%+v: MarshalBinary failed: %v", test.pkt, err)
+			continue
+		}
+		hs := HeaderSize
+		if test.pkt.Header.Version >= 2 {
+			hs += 2 // family and flags
+			if family := addrFamily(buf[HeaderSize]); family != test.family {
+				t.Errorf("%+v: encoded with family %d, expected %d", test.pkt, family, test.family)
+			}
+		}
+		if expected := hs + 2*test.family.addrLen(); len(buf) != expected {
+			t.Errorf("%+v: marshaled %d byte, expected %d", test.pkt, len(buf), expected)
+		}
+	}
+
+	ips := []struct {
+		name   string
+		ip     net.IP
+		family addrFamily
+		len    int
+	}{
+		{"native IPv4", net.IPv4(192, 0, 2, 1).To4(), familyIPv4, net.IPv4len},
+		{"IPv4-mapped IPv6", net.ParseIP("::ffff:192.0.2.1"), familyIPv4, net.IPv4len},
+		{"native IPv6", net.ParseIP("2001:db8::1"), familyIPv6, net.IPv6len},
+	}
+	for _, test := range ips {
+		buf, err := CReq{Header: Header{Version: 2}, Addr: net.UDPAddr{IP: test.ip, Port: 11113}}.MarshalBinary()
+		if err != nil {
+			t.Errorf("%s: MarshalBinary failed: %v", test.name, err)
+			continue
+		}
+		if family := addrFamily(buf[HeaderSize]); family != test.family {
+			t.Errorf("%s: encoded with family %d, expected %d", test.name, family, test.family)
+		}
+		var creq CReq
+		if err := creq.UnmarshalBinary(buf); err != nil {
+			t.Errorf("%s: UnmarshalBinary failed: %v", test.name, err)
+			continue
+		}
+		if !creq.Addr.IP.Equal(test.ip) || len(creq.Addr.IP) != test.len {
+			t.Errorf("%s: decoded IP %#v, expected %v with %d byte", test.name, creq.Addr.IP, test.ip, test.len)
+		}
+	}
+
+	buf, _ := CReq{Header: Header{Version: 2}, Addr: net.UDPAddr(v6)}.MarshalBinary()
+	buf[HeaderSize] = 0x42
+	if _, err := Unmarshal(buf); !errors.Is(err, ErrProtocol) {
+		t.Errorf("unknown address family: expected protocol error, got %v", err)
+	}
+}
+
+func TestMarshalMalformedIP(t *testing.T) {
+	tests := []struct {
+		ip   net.IP
+		want string
+	}{
+		{nil, "IP nil"},
+		{net.IP{}, "IP empty"},
+		{net.IP{192, 0, 2}, "invalid IP length 3"},
+		{make(net.IP, 17), "invalid IP length 17"},
+	}
+	valid := net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	for _, test := range tests {
+		for _, v := range []ProtocolVersion{1, 2} {
+			udp := net.UDPAddr{IP: test.ip, Port: 11113}
+			tcp := net.TCPAddr(udp)
+			packets := []PuncherPacket{
+				&CReq{Header: Header{Version: v}, Addr: udp},
+				&CReqTCP{Header: Header{Version: v}, SourceAddr: tcp, DestAddr: valid},
+				&CReqTCP{Header: Header{Version: v}, SourceAddr: valid, DestAddr: tcp},
+			}
+			for _, p := range packets {
+				_, err := p.MarshalBinary()
+				if err == nil || !strings.Contains(err.Error(), test.want) {
+					t.Errorf("version %d: %T with IP %#v: got error %v, expected %q", v, p, test.ip, err, test.want)
+				}
+			}
+		}
+	}
+}
+
+func TestCanonicalIPv4(t *testing.T) {
+	short := net.IPv4(192, 0, 2, 1).To4()
+	mapped := net.ParseIP("::ffff:192.0.2.1")
+	if len(short) != 4 || len(mapped) != 16 {
+		t.Fatal("test addresses not in the expected form")
+	}
+	for _, v := range []ProtocolVersion{1, 2} {
+		a, _ := CReq{Header: Header{Version: v}, Addr: net.UDPAddr{IP: short, Port: 11113}}.MarshalBinary()
+		b, _ := CReq{Header: Header{Version: v}, Addr: net.UDPAddr{IP: mapped, Port: 11113}}.MarshalBinary()
+		if !bytes.Equal(a, b) {
+			t.Errorf("version %d: 4 byte address encoded as %x, mapped address as %x", v, a, b)
+		}
+	}
+}
+
+func TestUnmarshalLenient(t *testing.T) {
+	src := net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	dest := net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 11114}
+	for _, v := range []ProtocolVersion{1, 2} {
+		full, _ := CReqTCP{Header: Header{Version: v}, SourceAddr: src, DestAddr: dest}.MarshalBinary()
+		// Header, address family in version 2 and the source address only.
+		n := HeaderSize + 18
+		if v >= 2 {
+			n++
+		}
+		single := full[:n]
+		if _, err := Unmarshal(single); err != ErrNotReadEnough(n) {
+			t.Errorf("version %d: strict: unexpected error %v", v, err)
+		}
+		p, err := UnmarshalLenient(single)
+		if err != nil {
+			t.Fatalf("version %d: lenient: %v", v, err)
+		}
+		expected := &CReqTCP{Header: Header{PID_Puncher_CReqTCP, v}, SourceAddr: src}
+		if !reflect.DeepEqual(p, expected) {
+			t.Errorf("version %d: lenient: got %+v, expected %+v", v, p, expected)
+		}
+
+		// Complete messages are decoded as usual.
+		if p, err := UnmarshalLenient(full); err != nil || p.(*CReqTCP).DestAddr.Port != dest.Port {
+			t.Errorf("version %d: lenient: full message decoded as %+v, %v", v, p, err)
+		}
+		// A partial address isn't recoverable.
+		if _, err := UnmarshalLenient(full[:n-1]); err != ErrNotReadEnough(n-1) {
+			t.Errorf("version %d: lenient: partial address: unexpected error %v", v, err)
+		}
+	}
+}
+
+func TestBigEndianPorts(t *testing.T) {
+	addr := net.UDPAddr{IP: net.ParseIP("2001:db8::1337"), Port: 0x1234}
+	tcpaddr := net.TCPAddr(addr)
+	var encoded [2][]byte
+	for i, be := range []bool{false, true} {
+		packets := []PuncherPacket{
+			&CReq{Header: Header{PID_Puncher_CReq, 2}, Addr: addr, BigEndianPorts: be},
+			&CReqTCP{Header: Header{PID_Puncher_CReqTCP, 2}, SourceAddr: tcpaddr, DestAddr: tcpaddr, BigEndianPorts: be},
+			&CReqTCPMulti{Header: Header{PID_Puncher_CReqTCPMulti, 2}, Pairs: []TCPPair{{tcpaddr, tcpaddr}}, BigEndianPorts: be},
+			&IDReq{Header: Header{PID_Puncher_IDReq, 2}, PreferredAddr: &addr, BigEndianPorts: be},
+			&SReqV2{Header: Header{PID_Puncher_SReqV2, 2}, PreferredAddr: &addr, BigEndianPorts: be},
+		}
+		for _, pkt := range packets {
+			buf, err := pkt.MarshalBinary()
+			if err != nil {
+				t.Fatalf("%T: %v", pkt, err)
+			}
+			p, err := Unmarshal(buf)
+			if err != nil {
+				t.Fatalf("%T: %v", pkt, err)
+			}
+			if !reflect.DeepEqual(p, pkt) {
+				t.Errorf("big endian %v: packets not equal: %+v != %+v", be, p, pkt)
+			}
+		}
+		encoded[i], _ = packets[0].MarshalBinary()
+	}
+	// Only the family byte and the port differ.
+	port := HeaderSize + 1
+	if le, be := encoded[0][port:port+2], encoded[1][port:port+2]; !bytes.Equal(le, []byte{0x34, 0x12}) || !bytes.Equal(be, []byte{0x12, 0x34}) {
+		t.Errorf("unexpected port encoding %x (little endian), %x (big endian)", le, be)
+	}
+	if !bytes.Equal(encoded[0][port+2:], encoded[1][port+2:]) {
+		t.Errorf("encodings differ after the port: %x, %x", encoded[0], encoded[1])
+	}
+
+	// Version 1 always uses little endian.
+	buf, _ := CReq{Header: Header{PID_Puncher_CReq, 1}, Addr: addr, BigEndianPorts: true}.MarshalBinary()
+	if !bytes.Equal(buf[HeaderSize:HeaderSize+2], []byte{0x34, 0x12}) {
+		t.Errorf("version 1: unexpected port encoding %x", buf[HeaderSize:HeaderSize+2])
+	}
+}
+
+func TestCReqTCPMultiBounds(t *testing.T) {
+	p := CReqTCPMulti{Header: Header{Version: 2}, Pairs: tcpPairs(MaxTCPPairs + 1)}
+	if _, err := p.MarshalBinary(); err == nil {
+		t.Error("expected error for too many pairs")
+	}
+
+	// Count of 3, but only 2 pairs present.
+	p.Pairs = tcpPairs(2)
+	buf, _ := p.MarshalBinary()
+	buf[HeaderSize+1] = 3
+	if err := (&CReqTCPMulti{}).UnmarshalBinary(buf); err != ErrNotReadEnough(len(buf)) {
+		t.Errorf("inflated count: unexpected error %v", err)
+	}
+	if _, err := Unmarshal(buf); err != ErrNotReadEnough(len(buf)) {
+		t.Errorf("inflated count: unexpected error from Unmarshal %v", err)
+	}
+
+	// Count above MaxTCPPairs is rejected without reading further.
+	buf[HeaderSize+1] = MaxTCPPairs + 1
+	if err := (&CReqTCPMulti{}).UnmarshalBinary(buf); !errors.Is(err, ErrProtocol) {
+		t.Errorf("count above maximum: unexpected error %v", err)
+	}
+	if _, err := MessageLen(buf); !errors.Is(err, ErrProtocol) {
+		t.Errorf("count above maximum: unexpected error from MessageLen %v", err)
+	}
+}
+
+func TestCReqTCPMultiCReqTCPs(t *testing.T) {
+	p := CReqTCPMulti{Header: Header{Version: 2}, Pairs: tcpPairs(2)}
+	reqs := p.CReqTCPs()
+	if len(reqs) != 2 {
+		t.Fatalf("got %d CReqTCP, expected 2", len(reqs))
+	}
+	for i, req := range reqs {
+		if req.Header.Version != 2 || req.SourceAddr.String() != p.Pairs[i].SourceAddr.String() || req.DestAddr.String() != p.Pairs[i].DestAddr.String() {
+			t.Errorf("CReqTCP %d = %+v, expected pair %+v", i, req, p.Pairs[i])
+		}
+	}
+}
+
+// largestPacket returns the largest message of the given type, with all
+// optional fields set and variable-length fields at their limit.
+func largestPacket(typ byte) PuncherPacket {
+	v2 := Header{Version: 2}
+	addr := net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}
+	tcpAddr := net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}
+	switch typ {
+	case PID_Puncher_AssID:
+		return &AssID{Header: v2, CID: 1, Nonce: 1}
+	case PID_Puncher_SReq:
+		return &SReq{Header: v2, CID: 1}
+	case PID_Puncher_CReq:
+		return &CReq{Header: v2, Addr: addr, Timestamp: 1, Nonce: 1}
+	case PID_Puncher_IDReq:
+		return &IDReq{Header: v2, Transports: TransportsUDP, PreferredAddr: &addr, Padding: true, Metadata: make([]byte, MaxMetadataSize), Identity: make([]byte, MaxIdentitySize)}
+	case PID_Puncher_SReqTCP:
+		return &SReqTCP{Header: v2, CID: 1}
+	case PID_Puncher_CReqTCP:
+		return &CReqTCP{Header: v2, SourceAddr: tcpAddr, DestAddr: tcpAddr, Retry: &RetryHint{Count: 1, Interval: time.Second}, Nonce: 1}
+	case PID_Puncher_SReqV2:
+		return &SReqV2{Header: v2, CID: 1, Transport: TransportUDP, Timestamp: 1, PreferredAddr: &addr, Padding: true, Nonce: 1}
+	case PID_Puncher_Error:
+		return &Error{Header: v2, Code: ErrorBadNonce, CID: 1, Message: strings.Repeat("x", MaxErrorMessageSize)}
+	case PID_Puncher_Result:
+		return &PunchResult{Header: v2, CID: 1, Success: true}
+	case PID_Puncher_CReqTCPMulti:
+		return &CReqTCPMulti{Header: v2, Pairs: tcpPairs(MaxTCPPairs)}
+	case PID_Puncher_CReqRelay:
+		return &CReqRelay{Header: v2, Direct: &addr, Relay: &addr, Token: 1}
+	case PID_Puncher_Heartbeat:
+		return &Heartbeat{Header: v2, CID: 1, Players: 1, Flags: 1}
+	}
+	return nil
+}
+
+// MaxPacketSize is maintained by hand, so check that it's exactly the size of
+// the largest message.
+func TestMaxPacketSize(t *testing.T) {
+	max := 0
+	for typ := 0; typ <= 0xff; typ++ {
+		if _, err := newPacket(byte(typ)); err != nil {
+			continue
+		}
+		p := largestPacket(byte(typ))
+		if p == nil {
+			t.Errorf("no largest message for type 0x%x", typ)
+			continue
+		}
+		buf, err := p.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%T.MarshalBinary() failed: %v", p, err)
+		}
+		if len(buf) > max {
+			max = len(buf)
+		}
+	}
+	if max != MaxPacketSize {
+		t.Errorf("largest message has %d byte, but MaxPacketSize is %d", max, MaxPacketSize)
+	}
+}
+
+func TestIDReqMetadataSize(t *testing.T) {
+	p := IDReq{Header: Header{Version: 2}, Metadata: make([]byte, MaxMetadataSize+1)}
+	if _, err := p.MarshalBinary(); err == nil {
+		t.Error("oversized metadata: MarshalBinary succeeded")
+	}
+	if _, err := (IDReq{Header: Header{Version: 2}, Identity: make([]byte, MaxIdentitySize+1)}).MarshalBinary(); err == nil {
+		t.Error("oversized identity: MarshalBinary succeeded")
+	}
+	p.Metadata = p.Metadata[:MaxMetadataSize]
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim one more byte than the limit.
+	buf[len(buf)-MaxMetadataSize-1] = MaxMetadataSize + 1
+	buf = append(buf, 0)
+	if _, err := MessageLen(buf); !errors.Is(err, ErrProtocol) {
+		t.Errorf("MessageLen: expected protocol error, got %v", err)
+	}
+	if err := (&IDReq{}).UnmarshalBinary(buf); !errors.Is(err, ErrProtocol) {
+		t.Errorf("UnmarshalBinary: expected protocol error, got %v", err)
+	}
+}
+
+// Decoding errors tell which message and field failed.
+func TestErrorLocation(t *testing.T) {
+	addr := net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	creq, _ := CReq{Header: Header{Version: 1}, Addr: net.UDPAddr(addr)}.MarshalBinary()
+	creqtcp, _ := CReqTCP{Header: Header{Version: 1}, SourceAddr: addr, DestAddr: addr}.MarshalBinary()
+	badFamily, _ := CReq{Header: Header{Version: 2}, Addr: net.UDPAddr(addr)}.MarshalBinary()
+	badFamily[HeaderSize] = 0x42
+	tests := []struct {
+		name   string
+		p      PuncherPacket
+		buf    []byte
+		pid    byte
+		offset int
+	}{
+		{"CReq truncated in IP", &CReq{}, creq[:10], PID_Puncher_CReq, HeaderSize + 2},
+		{"CReq truncated in port", &CReq{}, creq[:3], PID_Puncher_CReq, HeaderSize},
+		{"CReqTCP without DestAddr IP", &CReqTCP{}, creqtcp[:30], PID_Puncher_CReqTCP, HeaderSize + 18 + 2},
+		{"CReqTCP truncated header", &CReqTCP{}, creqtcp[:1], PID_Puncher_CReqTCP, 0},
+		{"CReq unknown address family", &CReq{}, badFamily, PID_Puncher_CReq, HeaderSize},
+	}
+	for _, test := range tests {
+		err := test.p.UnmarshalBinary(test.buf)
+		var e InvalidMessageError
+		if !errors.As(err, &e) {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if e.PID != test.pid || e.Offset != test.offset {
+			t.Errorf("%s: got PID 0x%x at offset %d, expected 0x%x at %d", test.name, e.PID, e.Offset, test.pid, test.offset)
+		}
+		if !errors.Is(err, ErrProtocol) {
+			t.Errorf("%s: error %v doesn't wrap ErrProtocol", test.name, err)
+		}
+	}
+}
+
+// Truncated messages are rejected before decoding.
+func TestReadFromShort(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		if len(buf) <= HeaderSize {
+			continue
+		}
+		short := buf[:len(buf)-1]
+		_, err := ReadFrom(bytes.NewReader(short))
+		if err != (ErrPartialDatagram{pkt.Type(), len(short), len(buf)}) {
+			t.Errorf("unexpected error for short %T: %v", pkt, err)
+		}
+	}
+}
+
+func TestCReqTCPLocalListenAddr(t *testing.T) {
+	pkt := CReqTCP{Header{PID_Puncher_CReqTCP, version}, net.TCPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}, net.TCPAddr{Port: 0xff22, IP: net.ParseIP("2001:db8::1338")}, nil, false, 0}
+	buf, _ := pkt.MarshalBinary()
+	var cpy CReqTCP
+	if err := cpy.UnmarshalBinary(buf); err != nil {
+		t.Fatal(err)
+	}
+	laddr := cpy.LocalListenAddr()
+	if laddr.String() != pkt.SourceAddr.String() {
+		t.Errorf("LocalListenAddr() = %v, expected %v", &laddr, &pkt.SourceAddr)
+	}
+}
+
+func TestAddrAccessors(t *testing.T) {
+	creq, _ := samplePackets[3].MarshalBinary()
+	var p CReq
+	if err := p.UnmarshalBinary(creq); err != nil {
+		t.Fatal(err)
+	}
+	if addr := p.UDPAddr(); addr.String() != "[2001:db8::1337]:65297" {
+		t.Errorf("UDPAddr() = %v", addr)
+	}
+
+	creqtcp, _ := samplePackets[5].MarshalBinary()
+	var ptcp CReqTCP
+	if err := ptcp.UnmarshalBinary(creqtcp); err != nil {
+		t.Fatal(err)
+	}
+	if addr := ptcp.SourceTCPAddr(); addr.String() != "[2001:db8::1337]:65297" {
+		t.Errorf("SourceTCPAddr() = %v", addr)
+	}
+	if addr := ptcp.DestTCPAddr(); addr.String() != "[2001:db8::1338]:65314" {
+		t.Errorf("DestTCPAddr() = %v", addr)
+	}
+}
+
+func TestCReqTCPRetryParams(t *testing.T) {
+	var p CReqTCP
+	if n, d := p.RetryParams(3, time.Second); n != 3 || d != time.Second {
+		t.Errorf("without hint: got %d, %v, expected defaults", n, d)
+	}
+	p.Retry = &RetryHint{10, 100 * time.Millisecond}
+	if n, d := p.RetryParams(3, time.Second); n != 10 || d != 100*time.Millisecond {
+		t.Errorf("with hint: got %d, %v, expected 10, 100ms", n, d)
+	}
+
+	p.Header.Version = 2
+	p.Retry.Interval = time.Minute + 6*time.Second
+	if _, err := p.MarshalBinary(); err == nil {
+		t.Error("expected error for interval out of range")
+	}
+}
+
+func TestVerifyCReqPair(t *testing.T) {
+	hostAddr := net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::2")}
+	clientAddr := net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}
+	otherAddr := net.UDPAddr{Port: 11114, IP: net.ParseIP("2001:db8::1")}
+	toHost := CReq{Header: Header{PID_Puncher_CReq, version}, Addr: clientAddr}
+	toClient := CReq{Header: Header{PID_Puncher_CReq, version}, Addr: hostAddr}
+
+	if err := VerifyCReqPair(toHost, toClient, hostAddr, clientAddr); err != nil {
+		t.Errorf("correct pair rejected: %v", err)
+	}
+	// IPv4 addresses in 4 and 16 byte form are equal.
+	v4 := net.UDPAddr{Port: 11113, IP: net.IPv4(192, 0, 2, 1).To4()}
+	if err := VerifyCReqPair(CReq{Addr: net.UDPAddr{Port: 11113, IP: net.IPv4(192, 0, 2, 1)}}, toClient, hostAddr, v4); err != nil {
+		t.Errorf("correct IPv4 pair rejected: %v", err)
+	}
+	if err := VerifyCReqPair(toClient, toHost, hostAddr, clientAddr); err == nil {
+		t.Error("swapped pair accepted")
+	}
+	if err := VerifyCReqPair(CReq{Addr: otherAddr}, toClient, hostAddr, clientAddr); err == nil {
+		t.Error("wrong host-directed CReq accepted")
+	}
+	if err := VerifyCReqPair(toHost, CReq{Addr: otherAddr}, hostAddr, clientAddr); err == nil {
+		t.Error("wrong client-directed CReq accepted")
+	}
+}
+
+// The timestamp is only encoded in version 2.
+func TestCReqTimestampV1(t *testing.T) {
+	p := CReq{Header: Header{Version: 1}, Addr: net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}, Timestamp: 1234}
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 2+18 {
+		t.Errorf("v1 CReq with timestamp has %d byte", len(buf))
+	}
+}
+
+func BenchmarkReadFrom(b *testing.B) {
+	buf, _ := samplePackets[3].MarshalBinary()
+	r := bytes.NewReader(buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(buf)
+		if _, err := ReadFrom(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	buf, _ := samplePackets[3].MarshalBinary()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Unmarshal(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMarshalAssID(t *testing.T) {
+	for _, v := range []ProtocolVersion{1, 2} {
+		for _, cid := range []uint32{0, 1337, 0xdeadbeef} {
+			expected, _ := AssID{Header: Header{Version: v}, CID: cid}.MarshalBinary()
+			if buf := MarshalAssID(v, cid); !bytes.Equal(buf, expected) {
+				t.Errorf("version %d, CID %d: got %x, expected %x", v, cid, buf, expected)
+			}
+		}
+	}
+}
+
+var assidSink []byte // keeps the compiler from optimizing away MarshalAssID
+
+func BenchmarkMarshalAssID(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		assidSink = MarshalAssID(2, uint32(i))
+	}
+}
+
+func BenchmarkAssIDMarshalBinary(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := (AssID{Header: Header{Version: 2}, CID: uint32(i)}).MarshalBinary(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestVarintCID(t *testing.T) {
+	tests := []struct {
+		cid uint32
+		len int
+	}{
+		{1, 1},
+		{0x7f, 1},
+		{0x80, 2},
+		{0x3fff, 2},
+		{0x4000, 3},
+		{1 << 21, 4},
+		{1 << 28, 5},
+		{math.MaxUint32, 5},
+	}
+	v1, v2 := Header{Version: 1}, Header{Version: 2}
+	var stream []byte
+	var expected []PuncherPacket
+	for _, test := range tests {
+		for _, pkt := range []PuncherPacket{
+			&AssID{Header: v1, CID: test.cid},
+			&SReq{Header: v1, CID: test.cid},
+			&SReqTCP{Header: v1, CID: test.cid},
+			&AssID{Header: v2, CID: test.cid},
+			&AssID{Header: v2, CID: test.cid, Nonce: 42},
+			&SReq{Header: v2, CID: test.cid},
+			&SReqTCP{Header: v2, CID: test.cid},
+		} {
+			buf, _ := pkt.MarshalBinary()
+			cidLen := len(buf) - HeaderSize
+			if h := HeaderOf(pkt); h.Version >= 2 {
+				cidLen-- // address family
+				if a, ok := pkt.(*AssID); ok {
+					cidLen-- // flags
+					if a.Nonce != 0 {
+						cidLen -= 8
+					}
+				}
+			}
+			expectedLen := test.len
+			if HeaderOf(pkt).Version < 2 {
+				expectedLen = 4
+			}
+			if cidLen != expectedLen {
+				t.Errorf("%T %+v: CID encoded in %d byte, expected %d", pkt, pkt, cidLen, expectedLen)
+			}
+			if n, err := MessageLen(buf); err != nil || n != len(buf) {
+				t.Errorf("%T %+v: MessageLen = %d, %v, expected %d", pkt, pkt, n, err, len(buf))
+			}
+			// Framing needs more data for any prefix.
+			for i := HeaderSize; i < len(buf); i++ {
+				if n, err := MessageLen(buf[:i]); err != nil || n <= i {
+					t.Errorf("%T %+v: MessageLen of %d byte = %d, %v", pkt, pkt, i, n, err)
+				}
+			}
+			p, err := Unmarshal(buf)
+			pkt.(headerPacket).header().Type = pkt.Type()
+			if err != nil || !reflect.DeepEqual(p, pkt) {
+				t.Errorf("got %+v, %v, expected %+v", p, err, pkt)
+			}
+			stream = append(stream, buf...)
+			expected = append(expected, pkt)
+		}
+	}
+
+	d := NewDecoder(bytes.NewReader(stream))
+	for i, pkt := range expected {
+		p, err := d.Decode()
+		if err != nil || !reflect.DeepEqual(p, pkt) {
+			t.Fatalf("message %d: got %+v, %v, expected %+v", i, p, err, pkt)
+		}
+	}
+
+	overflow := []byte{PID_Puncher_SReq, 2, byte(familyIPv6), 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}
+	if _, err := MessageLen(overflow); !errors.Is(err, ErrProtocol) {
+		t.Errorf("MessageLen of overflowing CID: got %v, expected protocol error", err)
+	}
+	if _, err := Unmarshal(overflow); !errors.Is(err, ErrProtocol) {
+		t.Errorf("Unmarshal of overflowing CID: got %v, expected protocol error", err)
+	}
+}
+
+func TestTransportsSupports(t *testing.T) {
+	tests := []struct {
+		t        Transports
+		udp, tcp bool
+	}{
+		{0, true, true},
+		{TransportsUDP, true, false},
+		{TransportsTCP, false, true},
+		{TransportsUDP | TransportsTCP, true, true},
+	}
+	for _, test := range tests {
+		if test.t.Supports(TransportUDP) != test.udp || test.t.Supports(TransportTCP) != test.tcp {
+			t.Errorf("unexpected result for Transports(%d)", test.t)
+		}
+	}
+}
+
+func TestErrorCodeString(t *testing.T) {
+	tests := []struct {
+		code    ErrorCode
+		name    string
+		message string
+	}{
+		{ErrorTransportUnsupported, "TransportUnsupported", "the host doesn't offer the requested transport"},
+		{ErrorUnknownHost, "UnknownHost", "no host is registered with the requested ID"},
+		{ErrorFamilyMismatch, "FamilyMismatch", "host and client use different IP versions"},
+		{0, "ErrorCode(0)", "unknown error 0"},
+		{ErrorFamilyMismatch + 1, fmt.Sprintf("ErrorCode(%d)", ErrorFamilyMismatch+1), fmt.Sprintf("unknown error %d", ErrorFamilyMismatch+1)},
+	}
+	for _, test := range tests {
+		if s := test.code.String(); s != test.name {
+			t.Errorf("ErrorCode(%d).String() = %q, expected %q", byte(test.code), s, test.name)
+		}
+		if s := test.code.Message(); s != test.message {
+			t.Errorf("ErrorCode(%d).Message() = %q, expected %q", byte(test.code), s, test.message)
+		}
+	}
+	// All named codes are valid. Unknown codes are valid as well, so that
+	// Errors from newer servers are recognized.
+	for code := ErrorCode(0); code < 0xff; code++ {
+		err := (&Error{Code: code}).Validate()
+		named := !strings.HasPrefix(code.String(), "ErrorCode(") && !strings.HasPrefix(code.Message(), "unknown error")
+		if named && err != nil {
+			t.Errorf("ErrorCode(%d): named, but invalid: %v", byte(code), err)
+		}
+		if valid := code != 0 && code < 0x80; valid != (err == nil) {
+			t.Errorf("ErrorCode(%d): Validate() = %v", byte(code), err)
+		}
+	}
+	if _, err := (Error{Header: Header{Version: 2}, Code: 0x85}).MarshalBinary(); err == nil {
+		t.Error("MarshalBinary succeeded for code with high bit")
+	}
+}
+
+func TestErrorText(t *testing.T) {
+	if s := NewError(ErrorDenied, "").Text(); s != ErrorDenied.Message() {
+		t.Errorf("Text() without message = %q, expected %q", s, ErrorDenied.Message())
+	}
+	p := NewError(ErrorDenied, "maintenance until 18:00 UTC")
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[HeaderSize+1]&errorFlagMessage == 0 {
+		t.Errorf("message flag not set in code byte %#x", buf[HeaderSize+1])
+	}
+	cpy, err := Unmarshal(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cpy.(*Error).Text(); s != p.Message {
+		t.Errorf("Text() = %q, expected %q", s, p.Message)
+	}
+	if cpy.(*Error).Code != ErrorDenied {
+		t.Errorf("Code = %v, expected %v", cpy.(*Error).Code, ErrorDenied)
+	}
+}
+
+func TestProtocolVersionString(t *testing.T) {
+	tests := []struct {
+		v        ProtocolVersion
+		expected string
+	}{
+		{1, "v1"},
+		{2, "v2"},
+		{0, "v?(0)"},
+		{7, "v?(7)"},
+		{NewestProtocolVersion + 1, fmt.Sprintf("v?(%d)", NewestProtocolVersion+1)},
+	}
+	for _, test := range tests {
+		if s := test.v.String(); s != test.expected {
+			t.Errorf("ProtocolVersion(%d).String() = %q, expected %q", byte(test.v), s, test.expected)
+		}
+	}
+	if s := ErrUnsupportedVersion(7).Error(); s != "netpuncher: unsupported protocol version v?(7)" {
+		t.Errorf("unexpected error message %q", s)
+	}
+}
+
+func TestFutureVersion(t *testing.T) {
+	buf, _ := CReq{Header: Header{Version: 2}, Addr: net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}}.MarshalBinary()
+	buf[1] = byte(NewestProtocolVersion + 1)
+	_, err := Unmarshal(buf)
+	var future ErrFutureVersion
+	if !errors.As(err, &future) || future.Type != PID_Puncher_CReq || future.Version != NewestProtocolVersion+1 {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var unsupported ErrUnsupportedVersion
+	if !errors.Is(err, ErrProtocol) || !errors.As(err, &unsupported) || unsupported != ErrUnsupportedVersion(NewestProtocolVersion+1) {
+		t.Errorf("%v doesn't wrap ErrUnsupportedVersion", err)
+	}
+	if s := err.Error(); s != "netpuncher: unsupported protocol version v?(3) of message type 0x53" {
+		t.Errorf("unexpected error message %q", s)
+	}
+	if _, err := NewDecoder(bytes.NewReader(buf)).Decode(); !errors.As(err, &future) || future.Type != PID_Puncher_CReq {
+		t.Errorf("Decoder: unexpected error %v", err)
+	}
+
+	// The type has to be known.
+	buf[0] = 0x42
+	if _, err := Unmarshal(buf); err != ErrUnknownType(0x42) {
+		t.Errorf("unknown type: unexpected error %v", err)
+	}
+}
+
+func TestHeaderValidate(t *testing.T) {
+	tests := []struct {
+		h   Header
+		err error
+	}{
+		{Header{PID_Puncher_IDReq, 1}, nil},
+		{Header{PID_Puncher_CReqTCP, 2}, nil},
+		{Header{PID_Puncher_SReqV2, 2}, nil},
+		{Header{PID_Puncher_IDReq, 0}, ErrUnsupportedVersion(0)},
+		{Header{PID_Puncher_IDReq, NewestProtocolVersion + 1}, ErrFutureVersion{PID_Puncher_IDReq, NewestProtocolVersion + 1}},
+		{Header{PID_Puncher_SReqV2, 0xff}, ErrFutureVersion{PID_Puncher_SReqV2, 0xff}},
+		{Header{PID_Puncher_SReqV2, 1}, ErrUnsupportedVersion(1)},
+		{Header{PID_Puncher_Error, 1}, ErrUnsupportedVersion(1)},
+		{Header{PID_Puncher_Result, 1}, ErrUnsupportedVersion(1)},
+		{Header{0x00, 1}, ErrUnknownType(0x00)},
+		{Header{0xff, 0xff}, ErrUnknownType(0xff)},
+	}
+	for _, test := range tests {
+		if err := test.h.Validate(); err != test.err {
+			t.Errorf("%+v.Validate() = %v, expected %v", test.h, err, test.err)
+		}
+	}
+}
+
+func TestCReqValidate(t *testing.T) {
+	ip := net.ParseIP("2001:db8::1")
+	valid := []net.UDPAddr{
+		{IP: ip, Port: 11113},
+		{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 1},
+	}
+	for _, addr := range valid {
+		p := CReq{Addr: addr}
+		if err := p.Validate(); err != nil {
+			t.Errorf("CReq to %v: unexpected error %v", &addr, err)
+		}
+	}
+	invalid := []net.UDPAddr{
+		{IP: ip, Port: 0},
+		{IP: ip, Port: 0x10000},
+		{IP: nil, Port: 11113},
+		{IP: net.IPv6unspecified, Port: 11113},
+	}
+	for _, addr := range invalid {
+		p := CReq{Header: Header{Version: version}, Addr: addr}
+		if err := p.Validate(); err == nil {
+			t.Errorf("CReq to %v: expected error", &addr)
+		}
+		// Decoding stays permissive.
+		if addr.IP != nil && addr.Port <= 0xffff {
+			buf, _ := p.MarshalBinary()
+			if err := (&CReq{}).UnmarshalBinary(buf); err != nil {
+				t.Errorf("CReq to %v: decoding failed: %v", &addr, err)
+			}
+		}
+	}
+
+	tcp := CReqTCP{SourceAddr: net.TCPAddr{IP: ip, Port: 60001}, DestAddr: net.TCPAddr{IP: ip, Port: 60002}}
+	if err := tcp.Validate(); err != nil {
+		t.Errorf("valid CReqTCP: unexpected error %v", err)
+	}
+	tcp.DestAddr.Port = 0
+	if err := tcp.Validate(); err == nil {
+		t.Error("CReqTCP with zero port: expected error")
+	}
+}
+
+func TestCReqRelay(t *testing.T) {
+	direct := net.UDPAddr{Port: 0xff11, IP: net.IPv4(192, 0, 2, 1).To4()}
+	relay := net.UDPAddr{Port: 0xff22, IP: net.IPv4(192, 0, 2, 2).To4()}
+	tests := []struct {
+		p   CReqRelay
+		len int
+	}{
+		{CReqRelay{Header: Header{Version: 2}, Direct: &direct}, HeaderSize + 1 + 1 + 6},
+		{CReqRelay{Header: Header{Version: 2}, Relay: &relay, Token: 42}, HeaderSize + 1 + 1 + 6 + 8},
+		{CReqRelay{Header: Header{Version: 2}, Direct: &direct, Relay: &relay, Token: 42}, HeaderSize + 1 + 1 + 2*6 + 8},
+	}
+	for _, test := range tests {
+		buf, err := test.p.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf) != test.len {
+			t.Errorf("%+v: got %d byte, expected %d", test.p, len(buf), test.len)
+		}
+		p, err := Unmarshal(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.p.Header.Type = PID_Puncher_CReqRelay
+		if !reflect.DeepEqual(p, &test.p) {
+			t.Errorf("got %+v, expected %+v", p, &test.p)
+		}
+		creq, ok := p.(*CReqRelay).CReq()
+		if ok != (test.p.Direct != nil) || ok && creq.Addr.String() != direct.String() {
+			t.Errorf("%+v: CReq() = %+v, %v", test.p, creq, ok)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	v2 := Header{Version: 2}
+	addr := net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}
+	tcpAddr := net.TCPAddr(addr)
+	zeroPort := net.UDPAddr{IP: addr.IP}
+	unspecified := net.UDPAddr{Port: 11113, IP: net.IPv4zero}
+	valid := []PuncherPacket{
+		&IDReq{Header: v2, PreferredAddr: &unspecified, Metadata: []byte("x"), Identity: []byte("x")},
+		&AssID{Header: v2, CID: 1},
+		&SReq{Header: v2, CID: 1},
+		&SReqTCP{Header: v2, CID: 1},
+		&SReqV2{Header: v2, CID: 1, Transport: TransportTCP, PreferredAddr: &unspecified},
+		&CReq{Header: v2, Addr: addr},
+		&CReqTCP{Header: v2, SourceAddr: tcpAddr, DestAddr: tcpAddr},
+		&CReqTCPMulti{Header: v2, Pairs: tcpPairs(MaxTCPPairs)},
+		&CReqRelay{Header: v2, Relay: &addr},
+		&Error{Header: v2, Code: ErrorUnknownHost},
+		&PunchResult{Header: v2, CID: 1},
+		&Heartbeat{Header: v2, CID: 1},
+	}
+	for _, p := range valid {
+		if err := p.Validate(); err != nil {
+			t.Errorf("%T %+v: unexpected error %v", p, p, err)
+		}
+	}
+	invalid := []PuncherPacket{
+		&IDReq{Header: v2, Metadata: make([]byte, MaxMetadataSize+1)},
+		&IDReq{Header: v2, Identity: make([]byte, MaxIdentitySize+1)},
+		&IDReq{Header: v2, Padding: true, Checksum: true},
+		&AssID{Header: v2},
+		&SReq{Header: v2},
+		&SReqTCP{Header: v2},
+		&SReqV2{Header: v2, Transport: TransportUDP},
+		&SReqV2{Header: v2, CID: 1, Transport: 7},
+		&SReqV2{Header: v2, CID: 1, Transport: TransportUDP, Padding: true, Checksum: true},
+		&CReq{Header: v2, Addr: zeroPort},
+		&CReq{Header: v2, Addr: unspecified},
+		&CReqTCP{Header: v2, SourceAddr: tcpAddr, DestAddr: net.TCPAddr(zeroPort)},
+		&CReqTCPMulti{Header: v2},
+		&CReqTCPMulti{Header: v2, Pairs: tcpPairs(MaxTCPPairs + 1)},
+		&CReqTCPMulti{Header: v2, Pairs: []TCPPair{{tcpAddr, net.TCPAddr(unspecified)}}},
+		&CReqRelay{Header: v2},
+		&CReqRelay{Header: v2, Direct: &addr, Relay: &zeroPort},
+		&Error{Header: v2},
+		&Error{Header: v2, Code: 0x80},
+		&Error{Header: v2, Code: ErrorDenied, Message: strings.Repeat("x", MaxErrorMessageSize+1)},
+		&PunchResult{Header: v2, Success: true},
+		&Heartbeat{Header: v2, Players: 4},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%T %+v: expected error", p, p)
+		}
+	}
+}
+
+// The type byte always selects the matching packet, so that a message can't
+// be decoded as a different type.
+func TestDecodedType(t *testing.T) {
+	for typ := 0; typ <= 0xff; typ++ {
+		if p, err := newPacket(byte(typ)); err == nil && p.Type() != byte(typ) {
+			t.Errorf("newPacket(0x%x) returned %T", typ, p)
+		}
+	}
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		for typ := 0; typ <= 0xff; typ++ {
+			buf[0] = byte(typ)
+			p, err := Unmarshal(buf)
+			if err != nil {
+				continue
+			}
+			if p.Type() != byte(typ) || HeaderOf(p).Type != byte(typ) {
+				t.Errorf("%T with type 0x%x decoded as %T with header %+v", pkt, typ, p, HeaderOf(p))
+			}
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package netpuncher
+
+import "net"
+
+// NATType is the behavior of a NAT as classified by NATClassifier.
+type NATType int
+
+const (
+	NATUnknown        NATType = iota // not enough observations
+	NATFullCone                      // any remote host can reach the mapping
+	NATRestricted                    // only IPs the client sent to can reach the mapping
+	NATPortRestricted                // only addresses the client sent to can reach the mapping
+	NATSymmetric                     // each destination gets a different mapping, punching rarely works
+)
+
+func (t NATType) String() string {
+	switch t {
+	case NATFullCone:
+		return "full-cone"
+	case NATRestricted:
+		return "restricted"
+	case NATPortRestricted:
+		return "port-restricted"
+	case NATSymmetric:
+		return "symmetric"
+	}
+	return "unknown"
+}
+
+// NATObservation is a reply to a request from the client's socket which
+// reports the client's reflexive address.
+type NATObservation struct {
+	Sent   net.UDPAddr // server endpoint the request was sent to
+	Server net.UDPAddr // server endpoint the reply came from
+	Mapped net.UDPAddr // the client's address as seen by Sent
+}
+
+// NATClassifier infers the NAT type from reflexive addresses observed by
+// different server endpoints, similar to classic STUN (RFC 3489). Each
+// endpoint should be asked once to reply from its own address and once each
+// from another IP and another port. Replies which don't arrive are simply
+// not added.
+type NATClassifier struct {
+	observations []NATObservation
+}
+
+// Add adds an observation.
+func (c *NATClassifier) Add(o NATObservation) {
+	c.observations = append(c.observations, o)
+}
+
+// Classify returns the NAT type. The mapping is compared across server IPs,
+// so at least two of them need to be observed, otherwise the type is
+// unknown. Differing mappings indicate a symmetric NAT. Otherwise, the
+// filtering is derived from the replies which came from another endpoint than
+// the request went to.
+func (c *NATClassifier) Classify() NATType {
+	ips := make(map[string]bool)
+	for _, o := range c.observations {
+		ips[o.Sent.IP.String()] = true
+	}
+	if len(ips) < 2 {
+		return NATUnknown
+	}
+	mapped := c.observations[0].Mapped
+	for _, o := range c.observations[1:] {
+		if o.Mapped.Port != mapped.Port || !o.Mapped.IP.Equal(mapped.IP) {
+			return NATSymmetric
+		}
+	}
+	typ := NATPortRestricted
+	for _, o := range c.observations {
+		if !o.Server.IP.Equal(o.Sent.IP) {
+			return NATFullCone
+		}
+		if o.Server.Port != o.Sent.Port {
+			typ = NATRestricted
+		}
+	}
+	return typ
+}
@@ -0,0 +1,36 @@
+package netpuncher
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNATClassifier(t *testing.T) {
+	a := net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 11115}
+	aPort := net.UDPAddr{IP: a.IP, Port: 11116}
+	b := net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 11115}
+	mapped := net.UDPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	mapped2 := net.UDPAddr{IP: mapped.IP, Port: 40001}
+
+	tests := []struct {
+		name         string
+		observations []NATObservation
+		expected     NATType
+	}{
+		{"none", nil, NATUnknown},
+		{"single server", []NATObservation{{a, a, mapped}, {a, aPort, mapped}}, NATUnknown},
+		{"symmetric", []NATObservation{{a, a, mapped}, {b, b, mapped2}}, NATSymmetric},
+		{"full cone", []NATObservation{{a, a, mapped}, {a, b, mapped}, {a, aPort, mapped}, {b, b, mapped}}, NATFullCone},
+		{"restricted", []NATObservation{{a, a, mapped}, {a, aPort, mapped}, {b, b, mapped}}, NATRestricted},
+		{"port-restricted", []NATObservation{{a, a, mapped}, {b, b, mapped}}, NATPortRestricted},
+	}
+	for _, test := range tests {
+		var c NATClassifier
+		for _, o := range test.observations {
+			c.Add(o)
+		}
+		if typ := c.Classify(); typ != test.expected {
+			t.Errorf("%s: got %v, expected %v", test.name, typ, test.expected)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Package nptest provides helpers for testing code using netpuncher messages.
+package nptest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// AssertWireEqual marshals a and b and reports an error to t if the encoded
+// bytes differ. Unlike comparing the structs, this ignores differences which
+// don't affect the encoding, e.g. the Type field of the header, and catches
+// ones which only show on the wire.
+func AssertWireEqual(t testing.TB, a, b netpuncher.PuncherPacket) {
+	t.Helper()
+	abuf, err := a.MarshalBinary()
+	if err != nil {
+		t.Errorf("%T.MarshalBinary(): %v", a, err)
+		return
+	}
+	bbuf, err := b.MarshalBinary()
+	if err != nil {
+		t.Errorf("%T.MarshalBinary(): %v", b, err)
+		return
+	}
+	if bytes.Equal(abuf, bbuf) {
+		return
+	}
+	t.Errorf("%T and %T differ on the wire at offset %d:\n%s\n%s",
+		a, b, firstDiff(abuf, bbuf), hex.Dump(abuf), hex.Dump(bbuf))
+}
+
+// firstDiff returns the offset of the first byte that differs.
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	return len(a)
+}
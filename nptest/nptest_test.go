@@ -0,0 +1,57 @@
+package nptest
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// recordTB records errors instead of failing the test.
+type recordTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordTB) Helper() {}
+
+func (r *recordTB) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, format)
+}
+
+func TestAssertWireEqual(t *testing.T) {
+	addr := net.UDPAddr{Port: 11113, IP: net.ParseIP("2001:db8::1")}
+	a := &netpuncher.CReq{Header: netpuncher.Header{Version: 2}, Addr: addr}
+	// The type in the header is set on marshaling.
+	b := &netpuncher.CReq{Header: netpuncher.Header{Type: netpuncher.PID_Puncher_CReq, Version: 2}, Addr: addr}
+
+	var r recordTB
+	AssertWireEqual(&r, a, b)
+	if len(r.errors) != 0 {
+		t.Errorf("equal packets reported as different: %v", r.errors)
+	}
+
+	b.Timestamp = 1
+	AssertWireEqual(&r, a, b)
+	if len(r.errors) != 1 || !strings.Contains(r.errors[0], "differ on the wire") {
+		t.Errorf("different packets: got errors %v", r.errors)
+	}
+}
+
+func TestFirstDiff(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"abc", "abd", 2},
+		{"abc", "ab", 2},
+		{"ab", "abc", 2},
+		{"xbc", "abc", 0},
+	}
+	for _, test := range tests {
+		if i := firstDiff([]byte(test.a), []byte(test.b)); i != test.expected {
+			t.Errorf("firstDiff(%q, %q) = %d, expected %d", test.a, test.b, i, test.expected)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package netpuncher
+
+import "fmt"
+
+// PaddedSize is the size of all messages marshaled with MarshalPadded, so that
+// observers can't tell message types apart by their length.
+const PaddedSize = MaxPacketSize + 1
+
+// MarshalPadded marshals p padded with zeros to PaddedSize. The last byte
+// holds the length of the message. As the padding follows the message,
+// Unmarshal also accepts padded messages, but only UnmarshalPadded checks the
+// length. Peers request padding with the Padding field of IDReq or SReqV2.
+func MarshalPadded(p PuncherPacket) ([]byte, error) {
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxPacketSize {
+		return nil, fmt.Errorf("netpuncher: message of %d byte too large to pad", len(b))
+	}
+	buf := make([]byte, PaddedSize)
+	copy(buf, b)
+	buf[PaddedSize-1] = byte(len(b))
+	return buf, nil
+}
+
+// UnmarshalPadded decodes a message marshaled with MarshalPadded.
+func UnmarshalPadded(b []byte) (PuncherPacket, error) {
+	if len(b) != PaddedSize {
+		return nil, InvalidMessageError{Err: fmt.Errorf("padded message has %d byte instead of %d", len(b), PaddedSize)}
+	}
+	l := int(b[PaddedSize-1])
+	if l > MaxPacketSize {
+		return nil, InvalidMessageError{Err: fmt.Errorf("padding length %d too large", l)}
+	}
+	n, err := MessageLen(b[:l])
+	if err != nil {
+		return nil, err
+	}
+	if n != l {
+		return nil, InvalidMessageError{Err: fmt.Errorf("padding length %d doesn't match message length %d", l, n)}
+	}
+	return unmarshal(b[:l])
+}
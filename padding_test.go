@@ -0,0 +1,95 @@
+package netpuncher
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalPadded(t *testing.T) {
+	var stream bytes.Buffer
+	for _, pkt := range samplePackets {
+		buf, err := MarshalPadded(pkt)
+		if err != nil {
+			t.Errorf("MarshalPadded(%T) failed: %v", pkt, err)
+			continue
+		}
+		if len(buf) != PaddedSize {
+			t.Errorf("padded %T has %d byte, expected %d", pkt, len(buf), PaddedSize)
+		}
+		stream.Write(buf)
+		for _, unmarshal := range []func([]byte) (PuncherPacket, error){UnmarshalPadded, Unmarshal} {
+			cpy, err := unmarshal(buf)
+			if err != nil {
+				t.Errorf("decoding padded %T failed: %v", pkt, err)
+				continue
+			}
+			if !reflect.DeepEqual(pkt, cpy) {
+				t.Errorf("packets not equal: %+v != %+v", pkt, cpy)
+			}
+		}
+	}
+
+	d := NewDecoder(&stream, ExpectPadding())
+	for _, expected := range samplePackets {
+		pkt, err := d.Decode()
+		if err != nil {
+			t.Fatalf("Decode failed: %v", err)
+		}
+		if !reflect.DeepEqual(pkt, expected) {
+			t.Errorf("packets not equal: %+v != %+v", pkt, expected)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestUnmarshalPaddedInvalid(t *testing.T) {
+	buf, _ := MarshalPadded(samplePackets[0])
+	bad := append([]byte(nil), buf...)
+	bad[PaddedSize-1]++
+	if _, err := UnmarshalPadded(bad); !errors.Is(err, ErrProtocol) {
+		t.Errorf("wrong length: expected protocol error, got %v", err)
+	}
+	bad[PaddedSize-1] = 0xff
+	if _, err := UnmarshalPadded(bad); !errors.Is(err, ErrProtocol) {
+		t.Errorf("length out of range: expected protocol error, got %v", err)
+	}
+	if _, err := UnmarshalPadded(buf[:PaddedSize-1]); !errors.Is(err, ErrProtocol) {
+		t.Errorf("short buffer: expected protocol error, got %v", err)
+	}
+}
+
+// datagramReader returns a datagram per Read like c4netioudp.Conn, which
+// returns the datagram's length even if it's truncated.
+type datagramReader [][]byte
+
+func (r *datagramReader) Read(b []byte) (int, error) {
+	if len(*r) == 0 {
+		return 0, io.EOF
+	}
+	data := (*r)[0]
+	*r = (*r)[1:]
+	copy(b, data)
+	return len(data), nil
+}
+
+func TestReadFromPadded(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := MarshalPadded(pkt)
+		r := datagramReader{buf}
+		cpy, err := ReadFrom(&r)
+		if err != nil {
+			t.Errorf("ReadFrom(padded %T) failed: %v", pkt, err)
+		} else if !reflect.DeepEqual(pkt, cpy) {
+			t.Errorf("packets not equal: %+v != %+v", pkt, cpy)
+		}
+	}
+	r := datagramReader{make([]byte, MaxDatagramSize+1)}
+	if _, err := ReadFrom(&r); !errors.Is(err, ErrProtocol) {
+		t.Errorf("oversized datagram: expected protocol error, got %v", err)
+	}
+}
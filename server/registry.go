@@ -0,0 +1,375 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+)
+
+// Registry holds information about registered hosts which is safe to access
+// outside of the server loop, e.g. for a directory service.
+type Registry struct {
+	mu    sync.Mutex
+	hosts map[uint32]registration
+	keys  map[string]uint32 // RegistrationKey of the host's address to CID
+	now   func() time.Time  // for tests, time.Now if nil
+
+	expiring bool // whether there may be imported registrations, see Import
+}
+
+type registration struct {
+	key       string
+	addr      net.UDPAddr
+	tcp       net.TCPAddr
+	created   time.Time
+	refreshed time.Time
+	metadata  []byte
+	players   uint16
+	flags     byte
+	expires   time.Time // for imported hosts until they reconnect, zero otherwise
+	hidden    bool      // left out of Snapshot and Export, see Server.SelfTest
+}
+
+func (r *Registry) time() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+	return time.Now()
+}
+
+// live returns whether reg hasn't expired at now.
+func (reg *registration) live(now time.Time) bool {
+	return reg.expires.IsZero() || now.Before(reg.expires)
+}
+
+// expire removes expired registrations. Called with r.mu held.
+func (r *Registry) expire() {
+	if !r.expiring {
+		return
+	}
+	now := r.time()
+	r.expiring = false
+	for cid, reg := range r.hosts {
+		if reg.live(now) {
+			r.expiring = r.expiring || !reg.expires.IsZero()
+			continue
+		}
+		r.removeKey(reg.key, cid)
+		delete(r.hosts, cid)
+	}
+}
+
+// RegistrationInfo describes a registered host at the time of a Snapshot.
+type RegistrationInfo struct {
+	CID       uint32
+	Addr      net.UDPAddr
+	Created   time.Time
+	Refreshed time.Time // of the last IDReq or Heartbeat
+	Players   uint16    // from the last Heartbeat
+	Flags     byte      // from the last Heartbeat
+	Expires   time.Time // for imported hosts until they reconnect, zero otherwise
+}
+
+// register adds the host with the given ID. target is the address to punch
+// towards, see Server.RewriteTargetAddr. Hidden hosts can be punched, but
+// aren't listed.
+func (r *Registry) register(cid uint32, addr, target *net.UDPAddr, created time.Time, metadata []byte, hidden bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[uint32]registration)
+		r.keys = make(map[string]uint32)
+	}
+	r.expire()
+	if reg, ok := r.hosts[cid]; ok {
+		r.removeKey(reg.key, cid)
+	}
+	key := netpuncher.RegistrationKey(addr)
+	r.keys[key] = cid
+	r.hosts[cid] = registration{
+		key:       key,
+		addr:      copyUDPAddr(addr),
+		tcp:       net.TCPAddr{IP: append(net.IP(nil), target.IP...), Zone: target.Zone},
+		created:   created,
+		refreshed: created,
+		metadata:  append([]byte(nil), metadata...),
+		hidden:    hidden,
+	}
+}
+
+// refresh updates the host with the given ID from a Heartbeat. Returns false
+// if there is no such host. Registrations of connected hosts have no TTL, they
+// last until the connection closes, which C4NetIOUDP detects by itself. As a
+// heartbeat shows that the host is connected, it clears the expiry of an
+// imported registration.
+func (r *Registry) refresh(cid uint32, now time.Time, players uint16, flags byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.hosts[cid]
+	if !ok || !reg.live(r.time()) {
+		return false
+	}
+	reg.refreshed, reg.players, reg.flags = now, players, flags
+	reg.expires = time.Time{}
+	r.hosts[cid] = reg
+	return true
+}
+
+func (r *Registry) unregister(cid uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reg, ok := r.hosts[cid]; ok {
+		r.removeKey(reg.key, cid)
+		delete(r.hosts, cid)
+	}
+}
+
+// removeKey removes key unless a newer registration took it over.
+func (r *Registry) removeKey(key string, cid uint32) {
+	if r.keys[key] == cid {
+		delete(r.keys, key)
+	}
+}
+
+// Lookup returns the CID of the host registered from addr, see
+// netpuncher.RegistrationKey. Returns false if there is no such host.
+func (r *Registry) Lookup(addr net.Addr) (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cid, ok := r.keys[netpuncher.RegistrationKey(addr)]
+	if reg := r.hosts[cid]; ok && !reg.live(r.time()) {
+		return 0, false
+	}
+	return cid, ok
+}
+
+// registered returns whether a host is registered with the given ID.
+func (r *Registry) registered(cid uint32) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.hosts[cid]
+	return ok && reg.live(r.time())
+}
+
+// LookupTCP returns the TCP endpoint of the host with the given ID. As the
+// ports of a TCP punch are generated for each one, the port is zero. Returns
+// false if there is no such host.
+func (r *Registry) LookupTCP(cid uint32) (net.TCPAddr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.hosts[cid]
+	if !ok || !reg.live(r.time()) {
+		return net.TCPAddr{}, false
+	}
+	return net.TCPAddr{IP: append(net.IP(nil), reg.tcp.IP...), Zone: reg.tcp.Zone}, true
+}
+
+// Metadata returns a copy of the metadata the host with the given ID sent in
+// its IDReq. Returns false if there is no such host.
+func (r *Registry) Metadata(cid uint32) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reg, ok := r.hosts[cid]
+	if !ok || !reg.live(r.time()) {
+		return nil, false
+	}
+	return append([]byte(nil), reg.metadata...), true
+}
+
+// Snapshot returns a copy of all current registrations, ordered by CID.
+func (r *Registry) Snapshot() []RegistrationInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	infos := make([]RegistrationInfo, 0, len(r.hosts))
+	for cid, reg := range r.hosts {
+		if reg.hidden {
+			continue
+		}
+		infos = append(infos, RegistrationInfo{cid, copyUDPAddr(&reg.addr), reg.created, reg.refreshed, reg.players, reg.flags, reg.expires})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CID < infos[j].CID })
+	return infos
+}
+
+// registryFormat is the version of the encoding used by Export.
+const registryFormat = 1
+
+// registrationSize is the size of an exported registration without its
+// metadata and addresses.
+const registrationSize = 4 + 3*8 + 2 + 1 + 2
+
+// ExportTTL is how long hosts which are connected at the time of Export stay
+// registered after Import for them to reconnect.
+const ExportTTL = 5 * time.Minute
+
+// Export encodes all registrations for Import, e.g. by a new server process
+// taking over after a restart. Connected hosts expire ExportTTL from now,
+// imported ones which didn't reconnect yet keep their expiry.
+func (r *Registry) Export() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.expire()
+	now := r.time()
+	b := []byte{registryFormat}
+	for cid, reg := range r.hosts {
+		if reg.hidden {
+			continue
+		}
+		expires := reg.expires
+		if expires.IsZero() {
+			expires = now.Add(ExportTTL)
+		}
+		var fixed [registrationSize]byte
+		binary.LittleEndian.PutUint32(fixed[0:], cid)
+		for i, t := range []time.Time{reg.created, reg.refreshed, expires} {
+			binary.LittleEndian.PutUint64(fixed[4+8*i:], uint64(unixNano(t)))
+		}
+		binary.LittleEndian.PutUint16(fixed[28:], reg.players)
+		fixed[30] = reg.flags
+		binary.LittleEndian.PutUint16(fixed[31:], uint16(len(reg.metadata)))
+		b = append(b, fixed[:]...)
+		b = append(b, reg.metadata...)
+		b = appendAddr(b, reg.addr.IP, reg.addr.Port, reg.addr.Zone)
+		b = appendAddr(b, reg.tcp.IP, 0, reg.tcp.Zone)
+	}
+	return b
+}
+
+// Import adds the registrations encoded by Export which haven't expired yet.
+// As their hosts aren't connected, each one is removed at its exported expiry
+// unless the host reconnects from the same address and registers again, which
+// gives it its previous CID, see Server.reconnectID. Hosts which are already
+// registered take precedence. The registry is unchanged if b is invalid.
+func (r *Registry) Import(b []byte) error {
+	if len(b) < 1 || b[0] != registryFormat {
+		return fmt.Errorf("registry: unsupported format")
+	}
+	now := r.time()
+	var imported []registration
+	var cids []uint32
+	for d := (registryDecoder{b: b[1:]}); len(d.b) > 0; {
+		fixed := d.next(registrationSize)
+		if fixed == nil {
+			return fmt.Errorf("registry: truncated data")
+		}
+		var times [3]time.Time
+		for i := range times {
+			times[i] = fromUnixNano(int64(binary.LittleEndian.Uint64(fixed[4+8*i:])))
+		}
+		reg := registration{
+			created:   times[0],
+			refreshed: times[1],
+			expires:   times[2],
+			players:   binary.LittleEndian.Uint16(fixed[28:]),
+			flags:     fixed[30],
+			metadata:  append([]byte(nil), d.next(int(binary.LittleEndian.Uint16(fixed[31:])))...),
+		}
+		if reg.expires.IsZero() {
+			return fmt.Errorf("registry: missing expiry")
+		}
+		ip, port, zone := d.addr()
+		reg.addr = net.UDPAddr{IP: ip, Port: port, Zone: zone}
+		ip, _, zone = d.addr()
+		reg.tcp = net.TCPAddr{IP: ip, Zone: zone}
+		if d.err {
+			return fmt.Errorf("registry: truncated data")
+		}
+		reg.key = netpuncher.RegistrationKey(&reg.addr)
+		if reg.live(now) {
+			imported = append(imported, reg)
+			cids = append(cids, binary.LittleEndian.Uint32(fixed))
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hosts == nil {
+		r.hosts = make(map[uint32]registration)
+		r.keys = make(map[string]uint32)
+	}
+	for i, reg := range imported {
+		if _, ok := r.hosts[cids[i]]; ok {
+			continue
+		}
+		if _, ok := r.keys[reg.key]; ok {
+			continue
+		}
+		r.hosts[cids[i]] = reg
+		r.keys[reg.key] = cids[i]
+		r.expiring = true
+	}
+	return nil
+}
+
+// appendAddr encodes an address for Export as IP length, IP, port, zone
+// length and zone.
+func appendAddr(b []byte, ip net.IP, port int, zone string) []byte {
+	b = append(b, byte(len(ip)))
+	b = append(b, ip...)
+	var p [2]byte
+	binary.LittleEndian.PutUint16(p[:], uint16(port))
+	b = append(b, p[:]...)
+	b = append(b, byte(len(zone)))
+	return append(b, zone...)
+}
+
+// registryDecoder reads the data written by Export. err is set once the data
+// ends prematurely or contains an invalid address.
+type registryDecoder struct {
+	b   []byte
+	err bool
+}
+
+func (d *registryDecoder) next(n int) []byte {
+	if d.err || len(d.b) < n {
+		d.err = true
+		return nil
+	}
+	v := d.b[:n:n]
+	d.b = d.b[n:]
+	return v
+}
+
+// addr reads an address written by appendAddr.
+func (d *registryDecoder) addr() (ip net.IP, port int, zone string) {
+	if n := d.next(1); n != nil {
+		ip = append(net.IP(nil), d.next(int(n[0]))...)
+	}
+	if p := d.next(2); p != nil {
+		port = int(binary.LittleEndian.Uint16(p))
+	}
+	if n := d.next(1); n != nil {
+		zone = string(d.next(int(n[0])))
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		d.err = true
+	}
+	return ip, port, zone
+}
+
+// unixNano is t.UnixNano, but zero for the zero time.
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func copyUDPAddr(addr *net.UDPAddr) net.UDPAddr {
+	cpy := *addr
+	cpy.IP = append(net.IP(nil), addr.IP...)
+	return cpy
+}
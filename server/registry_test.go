@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+)
+
+func TestRegistryMetadata(t *testing.T) {
+	s, host, client := handleServer()
+	metadata := []byte("Clonk Rage 4 players")
+	idreq := netpuncher.IDReq{Header: netpuncher.Header{Version: 2}, Metadata: metadata}
+	if _, err := s.Handle(&idreq, host.addr); err != nil {
+		t.Fatal(err)
+	}
+	metadata[0] = 'X' // the registry keeps its own copy
+	if m, ok := s.Registry().Metadata(host.ID); !ok || !bytes.Equal(m, []byte("Clonk Rage 4 players")) {
+		t.Errorf("Metadata(host) = %q, %v", m, ok)
+	}
+	if _, ok := s.Registry().Metadata(client.ID); ok {
+		t.Error("client without IDReq is registered")
+	}
+
+	s.removeConn(host.ID)
+	if _, ok := s.Registry().Metadata(host.ID); ok {
+		t.Error("host still registered after closing")
+	}
+}
+
+func TestRegistrySnapshot(t *testing.T) {
+	s, host, client := handleServer()
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	idreq := netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}
+	for _, c := range []*Conn{host, client} {
+		if _, err := s.Handle(&idreq, c.addr); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Second)
+	}
+	s.removeConn(host.ID)
+
+	snapshot := s.Registry().Snapshot()
+	expected := []RegistrationInfo{{CID: client.ID, Addr: *client.addr, Created: time.Unix(1001, 0), Refreshed: time.Unix(1001, 0)}}
+	if !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("got snapshot %+v, expected %+v", snapshot, expected)
+	}
+	// The snapshot doesn't share memory with the registry.
+	snapshot[0].Addr.IP[0] = 0
+	if s.Registry().Snapshot()[0].Addr.IP[0] == 0 {
+		t.Error("snapshot shares IP with registry")
+	}
+}
+
+func TestRegistryReconnect(t *testing.T) {
+	s, _, _ := handleServer()
+	header := netpuncher.Header{Version: 2}
+	host := &Conn{ID: 1339, addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 11113}, s: s}
+	s.addConn(host)
+	if _, err := s.Handle(&netpuncher.IDReq{Header: header}, host.addr); err != nil {
+		t.Fatal(err)
+	}
+	// Same endpoint, but as IPv4-mapped address from a dual-stack socket.
+	mapped := &net.UDPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 11113}
+	if cid, ok := s.Registry().Lookup(mapped); !ok || cid != host.ID {
+		t.Errorf("Lookup(%v) = %d, %v", mapped, cid, ok)
+	}
+	assID := func(c *Conn) uint32 {
+		out, err := s.Handle(&netpuncher.IDReq{Header: header}, c.addr)
+		if err != nil || len(out) != 1 {
+			t.Fatalf("IDReq: got %+v, %v", out, err)
+		}
+		return out[0].Packet.(*netpuncher.AssID).CID
+	}
+
+	// The previous connection is still there, so its ID isn't taken over.
+	reconnected := &Conn{ID: 1340, addr: mapped, s: s}
+	s.addConn(reconnected)
+	if id := assID(reconnected); id != reconnected.ID {
+		t.Errorf("host got ID %d while the previous connection is open, expected %d", id, reconnected.ID)
+	}
+	s.removeConn(reconnected.ID)
+	s.removeConn(host.ID)
+	if _, ok := s.Registry().Lookup(mapped); ok {
+		t.Error("Lookup succeeds after closing")
+	}
+
+	// An imported registration is reused by a host registering from the
+	// same endpoint, but not by a client.
+	s.registry.register(host.ID, host.addr, host.addr, s.time(), nil, false)
+	client := &Conn{ID: 1341, addr: mapped, s: s}
+	s.addConn(client)
+	if _, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID}, client.addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.conns[client.ID]; !ok || client.ID == host.ID {
+		t.Errorf("client took over ID %d", host.ID)
+	}
+	s.removeConn(client.ID)
+	reconnected = &Conn{ID: 1342, addr: mapped, s: s}
+	s.addConn(reconnected)
+	if id := assID(reconnected); id != host.ID {
+		t.Errorf("reconnecting host got ID %d, expected %d", id, host.ID)
+	}
+	if s.conns[host.ID] != reconnected {
+		t.Error("reconnected host not found by its previous ID")
+	}
+}
+
+// Random IDs skip the ones in use and imported registrations.
+func TestConnIDCollision(t *testing.T) {
+	s, host, _ := handleServer()
+	rng := rand.New(rand.NewSource(2))
+	s.rng = rand.New(rand.NewSource(2))
+	registered, connected, free := rng.Uint32(), rng.Uint32(), rng.Uint32()
+	addr := &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 11113}
+	s.registry.register(registered, addr, addr, time.Unix(1000, 0), nil, false)
+	s.changeID(host, connected)
+	if id := s.connID(); id != free {
+		t.Errorf("got ID %d, expected %d after skipping %d and %d", id, free, registered, connected)
+	}
+}
+
+func TestRegistryLookupTCP(t *testing.T) {
+	s, host, client := handleServer()
+	header := netpuncher.Header{Version: 2}
+	if _, err := s.Handle(&netpuncher.IDReq{Header: header, Transports: netpuncher.TransportsUDP | netpuncher.TransportsTCP}, host.addr); err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := s.Registry().LookupTCP(host.ID)
+	if expected := (net.TCPAddr{IP: host.addr.IP}); !ok || !reflect.DeepEqual(addr, expected) {
+		t.Errorf("LookupTCP(host) = %v, %v, expected %v", &addr, ok, &expected)
+	}
+
+	toHost, toClient, _, err := s.creqTCPs(host, client, addr, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !toHost.SourceAddr.IP.Equal(host.addr.IP) || !toHost.DestAddr.IP.Equal(client.addr.IP) {
+		t.Errorf("CReqTCP to host has wrong orientation: %+v", toHost)
+	}
+	if !reflect.DeepEqual(toClient.SourceAddr, toHost.DestAddr) || !reflect.DeepEqual(toClient.DestAddr, toHost.SourceAddr) {
+		t.Errorf("CReqTCP messages don't match: %+v, %+v", toHost, toClient)
+	}
+
+	// Missing CID
+	if _, ok := s.Registry().LookupTCP(client.ID); ok {
+		t.Error("LookupTCP found client without IDReq")
+	}
+	s, host, client = handleServer()
+	host.transports = netpuncher.TransportsTCP
+	out, _ := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, Transport: netpuncher.TransportTCP}, client.addr)
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorUnknownHost, CID: host.ID}, client.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	s, host, client := handleServer()
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	header := netpuncher.Header{Version: 2}
+	if _, err := s.Handle(&netpuncher.IDReq{Header: header}, host.addr); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(time.Minute)
+	out, err := s.Handle(&netpuncher.Heartbeat{Header: header, CID: host.ID, Players: 3, Flags: 1}, host.addr)
+	if err != nil || len(out) != 0 {
+		t.Errorf("Heartbeat: got %+v, %v", out, err)
+	}
+	expected := []RegistrationInfo{{host.ID, *host.addr, time.Unix(1000, 0), time.Unix(1060, 0), 3, 1, time.Time{}}}
+	if snapshot := s.Registry().Snapshot(); !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("got snapshot %+v, expected %+v", snapshot, expected)
+	}
+
+	// Hosts can't refresh other CIDs, clients none at all.
+	out, _ = s.Handle(&netpuncher.Heartbeat{Header: header, CID: 42}, host.addr)
+	if e, ok := out[0].Packet.(*netpuncher.Error); len(out) != 1 || !ok || e.Code != netpuncher.ErrorUnknownHost {
+		t.Errorf("Heartbeat for other CID: got %+v", out)
+	}
+	out, _ = s.Handle(&netpuncher.Heartbeat{Header: header, CID: host.ID}, client.addr)
+	if e, ok := out[0].Packet.(*netpuncher.Error); len(out) != 1 || !ok || e.Code != netpuncher.ErrorUnexpectedMessage {
+		t.Errorf("Heartbeat from client: got %+v", out)
+	}
+	if snapshot := s.Registry().Snapshot(); !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("registration changed by rejected heartbeats: %+v", snapshot)
+	}
+}
+
+func TestRegistryExport(t *testing.T) {
+	now := time.Unix(2000, 0)
+	old := Registry{now: func() time.Time { return now }}
+	host1 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113, Zone: "eth0"}
+	host2 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1).To4(), Port: 11114}
+	old.register(1337, host1, host1, time.Unix(1000, 0), []byte("Clonk Rage"), false)
+	old.register(1339, host2, &net.UDPAddr{IP: net.ParseIP("198.51.100.1")}, time.Unix(1001, 0), nil, false)
+	old.refresh(1339, time.Unix(1060, 0), 3, 1)
+
+	restored := Registry{now: old.now}
+	if err := restored.Import(old.Export()); err != nil {
+		t.Fatal(err)
+	}
+	// Imported registrations expire unless their hosts reconnect.
+	expected := old.Snapshot()
+	for i := range expected {
+		expected[i].Expires = now.Add(ExportTTL)
+	}
+	if snapshot := restored.Snapshot(); !reflect.DeepEqual(snapshot, expected) {
+		t.Errorf("got snapshot %+v, expected %+v", snapshot, expected)
+	}
+	if cid, ok := restored.Lookup(host2); !ok || cid != 1339 {
+		t.Errorf("Lookup(%v) = %d, %v", host2, cid, ok)
+	}
+	if addr, ok := restored.LookupTCP(1339); !ok || !addr.IP.Equal(net.ParseIP("198.51.100.1")) {
+		t.Errorf("LookupTCP(1339) = %v, %v", &addr, ok)
+	}
+	if m, ok := restored.Metadata(1337); !ok || string(m) != "Clonk Rage" {
+		t.Errorf("Metadata(1337) = %q, %v", m, ok)
+	}
+
+	// Exporting again keeps the remaining TTL.
+	now = now.Add(ExportTTL - time.Minute)
+	again := Registry{now: old.now}
+	if err := again.Import(restored.Export()); err != nil {
+		t.Fatal(err)
+	}
+	// A reconnecting host keeps its registration.
+	again.register(1337, host1, host1, now, nil, false)
+	now = now.Add(time.Minute - time.Second)
+	if _, ok := again.Lookup(host2); !ok {
+		t.Error("Lookup fails before TTL")
+	}
+	now = now.Add(time.Second)
+	for _, r := range []*Registry{&restored, &again} {
+		if _, ok := r.Lookup(host2); ok {
+			t.Error("Lookup succeeds after TTL")
+		}
+	}
+	if snapshot := again.Snapshot(); len(snapshot) != 1 || snapshot[0].CID != 1337 {
+		t.Errorf("got snapshot %+v, expected only reconnected host", snapshot)
+	}
+}
+
+// A heartbeat shows that the host of an imported registration is connected.
+func TestRegistryRefreshImported(t *testing.T) {
+	now := time.Unix(2000, 0)
+	old := Registry{now: func() time.Time { return now }}
+	host := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	old.register(1337, host, host, time.Unix(1000, 0), nil, false)
+	restored := Registry{now: old.now}
+	if err := restored.Import(old.Export()); err != nil {
+		t.Fatal(err)
+	}
+	if !restored.refresh(1337, now, 2, 0) {
+		t.Fatal("refresh failed")
+	}
+	if snapshot := restored.Snapshot(); len(snapshot) != 1 || !snapshot[0].Expires.IsZero() {
+		t.Errorf("got snapshot %+v, expected no expiry", snapshot)
+	}
+	now = now.Add(ExportTTL)
+	if _, ok := restored.Lookup(host); !ok {
+		t.Error("refreshed registration expired")
+	}
+}
+
+func TestRegistryImportInvalid(t *testing.T) {
+	var old Registry
+	host := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	old.register(1337, host, host, time.Unix(1000, 0), []byte("Clonk Rage"), false)
+	b := old.Export()
+	for _, invalid := range [][]byte{nil, {registryFormat + 1}, b[:len(b)-1], b[:len(b)-20]} {
+		var r Registry
+		if err := r.Import(invalid); err == nil {
+			t.Errorf("Import(%x) succeeded", invalid)
+		}
+		if len(r.Snapshot()) != 0 {
+			t.Errorf("Import(%x) changed the registry", invalid)
+		}
+	}
+	// Hosts which are already registered take precedence.
+	var r Registry
+	r.register(1337, &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 11113}, host, time.Unix(2000, 0), nil, false)
+	if err := r.Import(b); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := r.Metadata(1337); m != nil {
+		t.Errorf("imported registration replaced existing one: %q", m)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+const (
+	selfTestPunchTimeout  = 5 * time.Second // if ctx has no deadline
+	selfTestPunchInterval = 50 * time.Millisecond
+)
+
+// SelfTest checks that the listening server works by connecting a host and a
+// client via loopback, running the UDP punch handshake through the server
+// loop and punching between them. The returned error names the stage which
+// failed. The self-test peers don't trigger AcceptConn, OnAnnounce,
+// RegisterHost, CReq and CloseConn, and their registration is left out of
+// Registry.Snapshot and Registry.Export, so that health checks don't show up
+// as hosts. The waits are bounded by ctx only, so it should have a deadline.
+// With multiple sockets, the first one is tested.
+func (s *Server) SelfTest(ctx context.Context) error {
+	if len(s.listeners) == 0 {
+		return fmt.Errorf("self-test: server isn't listening")
+	}
+	laddr, ok := s.Addr().(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("self-test: unsupported address %v", s.Addr())
+	}
+	saddr := *laddr
+	if saddr.IP.IsUnspecified() {
+		if saddr.IP.To4() != nil {
+			saddr.IP = net.IPv4(127, 0, 0, 1)
+		} else {
+			saddr.IP = net.IPv6loopback
+		}
+	}
+	header := netpuncher.Header{Version: 2}
+
+	host, hostConn, err := s.selfTestPeer(&saddr)
+	if err != nil {
+		return fmt.Errorf("self-test: connecting host: %v", err)
+	}
+	defer host.Close()
+	defer s.markSelfTestPeer(host.Addr(), false)
+	defer hostConn.Close()
+	client, clientConn, err := s.selfTestPeer(&saddr)
+	if err != nil {
+		return fmt.Errorf("self-test: connecting client: %v", err)
+	}
+	defer client.Close()
+	defer s.markSelfTestPeer(client.Addr(), false)
+	defer clientConn.Close()
+
+	if err := writeSelfTest(hostConn, &netpuncher.IDReq{Header: header, Transports: netpuncher.TransportsUDP}); err != nil {
+		return fmt.Errorf("self-test: sending IDReq: %v", err)
+	}
+	p, err := readSelfTest(ctx, hostConn)
+	if err != nil {
+		return fmt.Errorf("self-test: waiting for AssID: %v", err)
+	}
+	assid, ok := p.(*netpuncher.AssID)
+	if !ok {
+		return fmt.Errorf("self-test: got %T instead of AssID", p)
+	}
+
+	sreq := &netpuncher.SReqV2{Header: header, CID: assid.CID, Transport: netpuncher.TransportUDP}
+	if err := writeSelfTest(clientConn, sreq); err != nil {
+		return fmt.Errorf("self-test: sending SReqV2: %v", err)
+	}
+	p, err = readSelfTest(ctx, clientConn)
+	if challenge, ok := p.(*netpuncher.AssID); ok && err == nil {
+		// See RequireNonce.
+		sreq.Nonce = challenge.Nonce
+		if err := writeSelfTest(clientConn, sreq); err != nil {
+			return fmt.Errorf("self-test: sending SReqV2 with nonce: %v", err)
+		}
+		p, err = readSelfTest(ctx, clientConn)
+	}
+	if err != nil {
+		return fmt.Errorf("self-test: waiting for CReq to client: %v", err)
+	}
+	toClient, ok := p.(*netpuncher.CReq)
+	if !ok {
+		return fmt.Errorf("self-test: got %T instead of CReq to client", p)
+	}
+	p, err = readSelfTest(ctx, hostConn)
+	if err != nil {
+		return fmt.Errorf("self-test: waiting for CReq to host: %v", err)
+	}
+	toHost, ok := p.(*netpuncher.CReq)
+	if !ok {
+		return fmt.Errorf("self-test: got %T instead of CReq to host", p)
+	}
+
+	timeout := selfTestPunchTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- host.Punch(toHost.UDPAddr(), timeout, selfTestPunchInterval)
+	}()
+	if err := client.Punch(toClient.UDPAddr(), timeout, selfTestPunchInterval); err != nil {
+		return fmt.Errorf("self-test: punching from client: %v", err)
+	}
+	if err := <-errs; err != nil {
+		return fmt.Errorf("self-test: punching from host: %v", err)
+	}
+	return nil
+}
+
+// selfTestPeer listens on a random loopback port and connects to saddr. The
+// server treats the connection as self-test peer until it's unmarked, see
+// markSelfTestPeer.
+func (s *Server) selfTestPeer(saddr *net.UDPAddr) (*c4netioudp.Listener, *c4netioudp.Conn, error) {
+	listener, err := c4netioudp.Listen("udp", &net.UDPAddr{IP: saddr.IP})
+	if err != nil {
+		return nil, nil, err
+	}
+	s.markSelfTestPeer(listener.Addr(), true)
+	conn, err := listener.Dial(saddr)
+	if err != nil {
+		s.markSelfTestPeer(listener.Addr(), false)
+		listener.Close()
+		return nil, nil, err
+	}
+	return listener, conn, nil
+}
+
+// markSelfTestPeer sets whether connections from addr are self-test peers.
+func (s *Server) markSelfTestPeer(addr net.Addr, mark bool) {
+	s.selfTestMu.Lock()
+	defer s.selfTestMu.Unlock()
+	if s.selfTestPeers == nil {
+		s.selfTestPeers = make(map[string]bool)
+	}
+	if mark {
+		s.selfTestPeers[netpuncher.RegistrationKey(addr)] = true
+	} else {
+		delete(s.selfTestPeers, netpuncher.RegistrationKey(addr))
+	}
+}
+
+// isSelfTestPeer returns whether addr belongs to a peer of a running
+// SelfTest.
+func (s *Server) isSelfTestPeer(addr *net.UDPAddr) bool {
+	s.selfTestMu.Lock()
+	defer s.selfTestMu.Unlock()
+	return s.selfTestPeers[netpuncher.RegistrationKey(addr)]
+}
+
+func writeSelfTest(conn *c4netioudp.Conn, p netpuncher.PuncherPacket) error {
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf)
+	return err
+}
+
+// readSelfTest reads a message from conn until ctx is done. The reader
+// finishes once conn is closed.
+func readSelfTest(ctx context.Context, conn *c4netioudp.Conn) (netpuncher.PuncherPacket, error) {
+	type result struct {
+		p   netpuncher.PuncherPacket
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		p, err := netpuncher.ReadFrom(conn)
+		ch <- result{p, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.p, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
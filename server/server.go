@@ -1,9 +1,15 @@
 package server
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/openclonk/netpuncher"
@@ -11,19 +17,51 @@ import (
 )
 
 type Conn struct {
-	ID        uint32
-	NetIOConn *c4netioudp.Conn
-	version   netpuncher.ProtocolVersion
-	s         *Server
+	ID         uint32
+	NetIOConn  *c4netioudp.Conn
+	addr       *net.UDPAddr // remote address of NetIOConn
+	reader     netpuncher.MsgReader
+	writer     io.Writer
+	version    netpuncher.ProtocolVersion
+	transports netpuncher.Transports // offered by a host
+	preferred  *net.UDPAddr          // LAN address of a host, may be nil
+	padding    bool                  // whether messages to the peer are padded
+	checksum   bool                  // whether messages to the peer are checksummed
+	bigEndian  bool                  // whether the peer wants big-endian ports
+	nonce      uint64                // see RequireNonce, zero until assigned
+	identity   string                // keyed hash of a host's identity, see IdentityKey
+	role       role                  // set by the first IDReq or punch request
+	selfTest   bool                  // connected by SelfTest, hidden from callbacks
+	s          *Server
 }
 
+// role is what a peer uses the server for. A peer is either host or client.
+type role int
+
+const (
+	roleUnknown role = iota
+	roleHost         // sent IDReq
+	roleClient       // sent a punch request
+)
+
 func (c *Conn) npHeader() netpuncher.Header {
 	return netpuncher.Header{Version: c.version}
 }
 
-func (c *Conn) handlePackets(req chan<- punchReq, close chan<- uint32) {
+// netioReader reads messages from a C4NetIOUDP connection, which only
+// receives from its remote address.
+type netioReader struct {
+	conn *c4netioudp.Conn
+}
+
+func (r netioReader) ReadMsg() (netpuncher.PuncherPacket, net.Addr, error) {
+	p, err := netpuncher.ReadFrom(r.conn)
+	return p, r.conn.RemoteAddr(), err
+}
+
+func (c *Conn) handlePackets(recv chan<- received, close chan<- *Conn) {
 	for {
-		msg, err := netpuncher.ReadFrom(c.NetIOConn)
+		msg, src, err := c.reader.ReadMsg()
 		select {
 		case <-c.s.exitch:
 			return
@@ -31,15 +69,17 @@ func (c *Conn) handlePackets(req chan<- punchReq, close chan<- uint32) {
 		}
 		switch errt := err.(type) {
 		case c4netioudp.ErrConnectionClosed:
-			if c.s.CloseConn != nil {
+			if c.s.CloseConn != nil && !c.selfTest {
 				c.s.CloseConn(c, &errt)
 			}
 			c.NetIOConn.Close()
-			close <- c.ID
+			close <- c
 			return
-		case netpuncher.ErrUnsupportedVersion:
+		case netpuncher.ErrUnsupportedVersion, netpuncher.ErrFutureVersion:
 			if c.s.UnsupportedVersionErr != nil {
-				c.s.UnsupportedVersionErr(c, &errt)
+				var v netpuncher.ErrUnsupportedVersion
+				errors.As(errt, &v)
+				c.s.UnsupportedVersionErr(c, &v)
 			}
 			c.NetIOConn.Close()
 			continue
@@ -50,34 +90,61 @@ func (c *Conn) handlePackets(req chan<- punchReq, close chan<- uint32) {
 			}
 			continue
 		}
-		switch np := msg.(type) {
-		case *netpuncher.IDReq:
-			c.version = np.Header.Version
-			buf, err := netpuncher.AssID{Header: c.npHeader(), CID: c.ID}.MarshalBinary()
-			if err != nil {
-				if c.s.MarshalErr != nil {
-					c.s.MarshalErr(fmt.Errorf("AssID.MarshalBinary(): %v", err))
-				}
-				continue
-			}
-			c.NetIOConn.Write(buf)
-			if c.s.RegisterHost != nil {
-				c.s.RegisterHost(c)
+		if c.s.QueueSize <= 0 {
+			recv <- received{c, msg, src}
+			continue
+		}
+		select {
+		case recv <- received{c, msg, src}:
+		default:
+			if c.s.DropMessage != nil {
+				c.s.DropMessage(c, msg)
 			}
-		case *netpuncher.SReq:
-			c.version = np.Header.Version
-			req <- punchReq{np.CID, c, false}
-		case *netpuncher.SReqTCP:
-			c.version = np.Header.Version
-			req <- punchReq{np.CID, c, true}
 		}
 	}
 }
 
-type punchReq struct {
-	id   uint32
+// received is a message read by a connection's goroutine.
+type received struct {
 	conn *Conn
-	tcp  bool
+	p    netpuncher.PuncherPacket
+	src  net.Addr
+}
+
+// Outgoing is a message the server sends in response to a received one.
+type Outgoing struct {
+	Packet netpuncher.PuncherPacket
+	Dest   net.Addr
+	// Sent to Dest after Packet if another message of the same response
+	// couldn't be sent, may be nil. This keeps one party of a punch from
+	// waiting for the other one indefinitely.
+	Fallback netpuncher.PuncherPacket
+}
+
+// Handler processes a message received from src and returns the messages to
+// send in response, see Server.Handle.
+type Handler interface {
+	Handle(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error)
+}
+
+// HandlerFunc adapts a function to the Handler interface.
+type HandlerFunc func(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error)
+
+func (f HandlerFunc) Handle(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error) {
+	return f(p, src)
+}
+
+// Interceptor wraps the handling of incoming messages, e.g. for logging or
+// authentication. It may return without calling next to drop a message or
+// answer it by itself.
+type Interceptor func(next Handler) Handler
+
+type punchReq struct {
+	id        uint32
+	conn      *Conn
+	transport netpuncher.Transport
+	timestamp uint64       // echoed back to the client
+	preferred *net.UDPAddr // client-supplied address, may be nil
 }
 
 type Server struct {
@@ -87,10 +154,205 @@ type Server struct {
 	InvalidPacketErr      func(c *Conn, err error)                             // called when a client sends an invalid packet
 	RegisterHost          func(host *Conn)                                     // called when a host requests an ID
 	CReq                  func(host *Conn, client *Conn)                       // called when initiating punch between host and client
+	RejectPunch           func(host, client *Conn, code netpuncher.ErrorCode)  // called when a punch request can't be served
+	PunchResult           func(c *Conn, cid uint32, success bool)              // called when a client reports the result of a pending punch
 	CloseConn             func(c *Conn, err *c4netioudp.ErrConnectionClosed)   // called when closing a connection
+	DropCReq              func(dest net.Addr)                                  // called for each CReq dropped because of CReqLimit
+	SendErr               func(c *Conn, err error)                             // called when sending a message fails
+	DropMessage           func(c *Conn, p netpuncher.PuncherPacket)            // called when a message exceeds QueueSize
+	DenySource            func(src net.Addr)                                   // called when a message from a denied network is dropped
+	OnAnnounce            func(cid uint32, addr net.Addr) error                // called before sending AssID to a host, an error rolls back the registration
+	TCPPorts              func(host, client *Conn, hostPort, clientPort int)   // called when generating the ports for a TCP punch
+
+	// Maximum number of CReq and CReqTCP messages sent to a single IP address
+	// per CReqLimitWindow, unlimited if zero. This prevents abusing the server
+	// for amplification towards a victim. If either party of a punch is over
+	// the limit, neither receives its messages. The window defaults to a
+	// minute if zero.
+	CReqLimit       int
+	CReqLimitWindow time.Duration
+
+	// IDReq and punch requests with an older protocol version are answered
+	// with an Error and otherwise ignored, so such peers can neither
+	// register nor punch. Version 1 peers can't decode an Error, so their
+	// connection is closed instead. Zero accepts all supported versions.
+	MinClientVersion netpuncher.ProtocolVersion
+
+	// Networks allowed to use the server, all if empty. Deny takes
+	// precedence. Messages from other sources are dropped. If NotifyDenied
+	// is set, version 2 senders receive an Error.
+	Allow        []net.IPNet
+	Deny         []net.IPNet
+	NotifyDenied bool
+
+	// Number of received messages buffered for processing. If non-zero,
+	// further messages are dropped instead of blocking the connections'
+	// readers, so that a flood doesn't delay everyone else.
+	QueueSize int
 
-	listener *c4netioudp.Listener
-	exitch   chan struct{} // signals that the server should exit
+	// Generates the ports in CReqTCP messages, random dynamic ports if nil.
+	PortGenerator PortGenerator
+
+	// Rewrites the observed address of a peer before it's used as target in
+	// CReq and CReqTCP messages, e.g. if the server is behind a load
+	// balancer. The observed address is used if nil or if the result isn't a
+	// *net.UDPAddr.
+	RewriteTargetAddr func(observed net.Addr) net.Addr
+
+	// Addresses of the server itself. Punches which would send a CReq
+	// towards one of them, or a CReqTCP towards one of their IPs, are
+	// rejected with ErrorAddressUnusable, as the server would end up
+	// talking to itself. The TCP ports are generated independently of the
+	// server's UDP ports, so only the IP is compared. If DetectLocalAddrs is
+	// set, Listen adds the listening address, or the addresses of all
+	// interfaces if it listens on the unspecified address.
+	LocalAddrs       []net.UDPAddr
+	DetectLocalAddrs bool
+
+	// Version 2 peers receive a nonce in AssID which they have to echo in
+	// IDReq or SReqV2 and which the server includes in CReq and CReqTCP to
+	// them, so that injected messages can be told apart. The nonce is
+	// derived from the peer's address, so echoing it proves that the peer
+	// receives there. IDReq and SReqV2 without nonce are answered with an
+	// AssID carrying it, without registering the host, with a different one
+	// with ErrorBadNonce. Version 2 SReq and SReqTCP, which have no nonce
+	// field, are rejected with ErrorBadNonce as well. Version 1 peers are
+	// exempt.
+	RequireNonce bool
+
+	// Key for deriving the CID of hosts which send an identity in IDReq,
+	// as HMAC-SHA256 of the identity truncated to 32 bit. A host
+	// reconnecting with the same identity takes over its CID, while other
+	// collisions are resolved by trying the following CIDs. Identities are
+	// ignored if nil.
+	IdentityKey []byte
+
+	listeners []Listener
+	exitch    chan struct{}          // signals that the server should exit
+	rng       *rand.Rand             // used by the server loop only
+	conns     map[uint32]*Conn       // by ID, used by the server loop only
+	addrs     map[net.Addr]*Conn     // by the identity of Conn.addr, used by the server loop only
+	limiter   creqLimiter            // used by the server loop only
+	tcpPorts  map[punchKey]tcpPunch  // used by the server loop only
+	pending   map[punchKey]time.Time // punches awaiting a PunchResult, used by the server loop only
+	nonceKey  []byte                 // see nonceOf, used by the server loop only
+	registry  Registry
+	now       func() time.Time // for tests, time.Now if nil
+	detected  []net.UDPAddr    // local addresses found by Listen
+
+	interceptors []Interceptor
+	handler      Handler // interceptors around handle, built on demand
+
+	selfTestMu    sync.Mutex
+	selfTestPeers map[string]bool // by RegistrationKey, see SelfTest
+}
+
+// creqLimiter counts CReq messages per destination IP in fixed windows.
+type creqLimiter struct {
+	start  time.Time
+	counts map[string]int
+}
+
+// defaultCReqLimitWindow is used if CReqLimitWindow is zero.
+const defaultCReqLimitWindow = time.Minute
+
+// allow counts a message to each of ips and returns whether all of them are
+// within limit. Nothing is counted otherwise.
+func (l *creqLimiter) allow(ips []net.IP, now time.Time, limit int, window time.Duration) bool {
+	if l.counts == nil || now.Sub(l.start) >= window {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	need := make(map[string]int)
+	for _, ip := range ips {
+		need[ip.String()]++
+	}
+	for key, n := range need {
+		if l.counts[key]+n > limit {
+			return false
+		}
+	}
+	for key, n := range need {
+		l.counts[key] += n
+	}
+	return true
+}
+
+// tcpPunchWindow is how long the ports of a TCP punch are reused for
+// retransmitted requests.
+const tcpPunchWindow = 10 * time.Second
+
+// pendingPunchWindow is how long a client may report the result of a punch.
+const pendingPunchWindow = time.Minute
+
+// punchKey identifies a punch by the IDs of its parties.
+type punchKey struct {
+	host, client uint32
+}
+
+// tcpPunch holds the ports generated for a TCP punch, so that a retransmitted
+// request matches the listener the host has already bound.
+type tcpPunch struct {
+	hostPort, clientPort int
+	created              time.Time
+}
+
+func (s *Server) time() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// allowCReqs applies CReqLimit to the messages of a punch, one towards each
+// of dests. They are either all allowed or all dropped.
+func (s *Server) allowCReqs(dests []*net.UDPAddr) bool {
+	if s.CReqLimit <= 0 {
+		return true
+	}
+	window := s.CReqLimitWindow
+	if window <= 0 {
+		window = defaultCReqLimitWindow
+	}
+	ips := make([]net.IP, len(dests))
+	for i, dest := range dests {
+		ips[i] = dest.IP
+	}
+	if s.limiter.allow(ips, s.time(), s.CReqLimit, window) {
+		return true
+	}
+	if s.DropCReq != nil {
+		for _, dest := range dests {
+			s.DropCReq(dest)
+		}
+	}
+	return false
+}
+
+// PortGenerator produces the ports for TCP punching. The host listens on
+// hostPort and connects from there to the client's clientPort and vice versa.
+// Ports is only called by the server loop.
+type PortGenerator interface {
+	Ports() (hostPort, clientPort int)
+}
+
+// FixedPorts is a PortGenerator always returning the same ports, e.g. for
+// tests.
+type FixedPorts struct {
+	HostPort, ClientPort int
+}
+
+func (p FixedPorts) Ports() (hostPort, clientPort int) {
+	return p.HostPort, p.ClientPort
+}
+
+// randomPorts generates random dynamic ports.
+type randomPorts struct {
+	rng *rand.Rand
+}
+
+func (r randomPorts) Ports() (hostPort, clientPort int) {
+	return randomPort(r.rng), randomPort(r.rng)
 }
 
 // randomPort generates a random dynamic port.
@@ -100,112 +362,808 @@ func randomPort(rng *rand.Rand) int {
 	return min + rng.Intn(max-min)
 }
 
+// connID returns a random non-zero ID for a new connection which is neither in
+// use nor registered, e.g. by an imported registration. A host may get its
+// previous CID back once it registers, see reconnectID.
+func (s *Server) connID() uint32 {
+	for {
+		id := s.rng.Uint32()
+		if _, ok := s.conns[id]; id != 0 && !ok && !s.registry.registered(id) {
+			return id
+		}
+	}
+}
+
+// reconnectID returns the CID of the registration from the address and port
+// of host c, so that clients can still find a host which reconnected, e.g.
+// after a restart of the server. The CID is only reused if its previous
+// connection is gone.
+func (s *Server) reconnectID(c *Conn) (uint32, bool) {
+	cid, ok := s.registry.Lookup(c.addr)
+	if !ok || cid == c.ID {
+		return 0, false
+	}
+	if _, connected := s.conns[cid]; connected {
+		return 0, false
+	}
+	return cid, true
+}
+
+// addConn registers c for lookup by ID and remote address.
+func (s *Server) addConn(c *Conn) {
+	if s.conns == nil {
+		s.conns = make(map[uint32]*Conn)
+		s.addrs = make(map[net.Addr]*Conn)
+	}
+	s.conns[c.ID] = c
+	s.addrs[c.addr] = c
+}
+
+// identityID returns the CID for a host sending identity, see IdentityKey.
+func (s *Server) identityID(c *Conn, identity []byte) uint32 {
+	mac := hmac.New(sha256.New, s.IdentityKey)
+	mac.Write(identity)
+	c.identity = string(mac.Sum(nil))
+	cid := binary.LittleEndian.Uint32([]byte(c.identity))
+	for {
+		other, ok := s.conns[cid]
+		if cid != 0 && (!ok || other == c || other.identity == c.identity) {
+			return cid
+		}
+		cid++
+	}
+}
+
+// changeID moves c to a new ID, taking it over from any other connection.
+func (s *Server) changeID(c *Conn, id uint32) {
+	if id == c.ID {
+		return
+	}
+	if s.conns[c.ID] == c {
+		s.registry.unregister(c.ID)
+		delete(s.conns, c.ID)
+	}
+	c.ID = id
+	s.conns[id] = c
+}
+
+func (s *Server) removeConn(id uint32) {
+	s.registry.unregister(id)
+	if c, ok := s.conns[id]; ok {
+		delete(s.conns, id)
+		delete(s.addrs, c.addr)
+	}
+}
+
+// Use adds interceptors around the handling of incoming messages. The first
+// one is outermost and receives messages first. Use must not be called while
+// the server is listening.
+func (s *Server) Use(interceptors ...Interceptor) {
+	s.interceptors = append(s.interceptors, interceptors...)
+	s.handler = nil
+}
+
+// Handle processes the message p received from src and returns the messages
+// to send in response, passing it through the interceptors added with Use.
+// src has to be the remote address of the receiving connection as returned
+// by its reader. Connections are told apart by the identity of that address,
+// not its value, as a peer may connect to several sockets from the same
+// address.
+// Handle is not safe for concurrent use, so it must not be called while the
+// server is listening.
+func (s *Server) Handle(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error) {
+	if s.handler == nil {
+		var h Handler = HandlerFunc(s.handle)
+		for i := len(s.interceptors) - 1; i >= 0; i-- {
+			h = s.interceptors[i](h)
+		}
+		s.handler = h
+	}
+	return s.handler.Handle(p, src)
+}
+
+func (s *Server) handle(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error) {
+	if !s.allowSource(src) {
+		if s.DenySource != nil {
+			s.DenySource(src)
+		}
+		if h := netpuncher.HeaderOf(p); s.NotifyDenied && h.Version >= 2 {
+			return []Outgoing{{newError(netpuncher.Header{Version: h.Version}, netpuncher.ErrorDenied, 0), src, nil}}, nil
+		}
+		return nil, nil
+	}
+	c, ok := s.addrs[src]
+	if !ok {
+		return nil, fmt.Errorf("message from unknown address %v", src)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	if !c.fits(p) {
+		// E.g. a CReq reflected back to the server.
+		if v := netpuncher.HeaderOf(p).Version; v >= 2 {
+			var cid uint32
+			if sreq, ok := netpuncher.UnifySReq(p); ok {
+				cid = sreq.CID
+			}
+			return []Outgoing{{newError(netpuncher.Header{Version: v}, netpuncher.ErrorUnexpectedMessage, cid), src, nil}}, nil
+		}
+		return nil, fmt.Errorf("unexpected message %T from %v", p, src)
+	}
+	switch np := netpuncher.Unwrap(p).(type) {
+	case *netpuncher.IDReq:
+		if np.Header.Version < s.MinClientVersion {
+			return s.rejectVersion(c, np.Header.Version, 0), nil
+		}
+		c.role = roleHost
+		c.version = np.Header.Version
+		c.transports = np.Transports
+		c.preferred = np.PreferredAddr
+		c.padding = np.Padding
+		c.checksum = np.Checksum
+		c.bigEndian = np.BigEndianPorts
+		if nonce := s.nonceOf(c); np.Nonce != nonce {
+			if np.Nonce == 0 {
+				// The host is registered once it echoes the nonce.
+				return []Outgoing{{&netpuncher.AssID{Header: c.npHeader(), CID: c.ID, Nonce: nonce}, src, nil}}, nil
+			}
+			return []Outgoing{{newError(c.npHeader(), netpuncher.ErrorBadNonce, 0), src, nil}}, nil
+		}
+		if s.IdentityKey != nil && len(np.Identity) > 0 {
+			s.changeID(c, s.identityID(c, np.Identity))
+		} else if cid, ok := s.reconnectID(c); ok {
+			s.changeID(c, cid)
+		}
+		s.registry.register(c.ID, c.addr, s.targetAddr(c), s.time(), np.Metadata, c.selfTest)
+		if s.OnAnnounce != nil && !c.selfTest {
+			if err := s.OnAnnounce(c.ID, src); err != nil {
+				// Version 1 hosts can't receive an Error.
+				s.registry.unregister(c.ID)
+				if c.version < 2 {
+					return nil, nil
+				}
+				return []Outgoing{{newError(c.npHeader(), netpuncher.ErrorAnnounceFailed, c.ID), src, nil}}, nil
+			}
+		}
+		if s.RegisterHost != nil && !c.selfTest {
+			s.RegisterHost(c)
+		}
+		return []Outgoing{{&netpuncher.AssID{Header: c.npHeader(), CID: c.ID, Nonce: s.nonceOf(c)}, src, nil}}, nil
+	case *netpuncher.SReq, *netpuncher.SReqTCP, *netpuncher.SReqV2:
+		sreq, _ := netpuncher.UnifySReq(np)
+		if sreq.Header.Version < s.MinClientVersion {
+			return s.rejectVersion(c, sreq.Header.Version, sreq.CID), nil
+		}
+		c.role = roleClient
+		c.version = sreq.Header.Version
+		c.padding = sreq.Padding
+		c.checksum = sreq.Checksum
+		c.bigEndian = sreq.BigEndianPorts
+		if _, ok := np.(*netpuncher.SReqV2); !ok && s.nonceOf(c) != 0 {
+			// SReq and SReqTCP can't carry the nonce, so an AssID
+			// would only make the client retry forever.
+			return []Outgoing{{newError(c.npHeader(), netpuncher.ErrorBadNonce, sreq.CID), src, nil}}, nil
+		}
+		if nonce := s.nonceOf(c); sreq.Nonce != nonce {
+			if sreq.Nonce == 0 {
+				// Tell the client which nonce to echo.
+				return []Outgoing{{&netpuncher.AssID{Header: c.npHeader(), CID: c.ID, Nonce: nonce}, src, nil}}, nil
+			}
+			return []Outgoing{{newError(c.npHeader(), netpuncher.ErrorBadNonce, sreq.CID), src, nil}}, nil
+		}
+		return s.handlePunch(punchReq{sreq.CID, c, sreq.Transport, sreq.Timestamp, sreq.PreferredAddr}), nil
+	case *netpuncher.Heartbeat:
+		// Hosts can only refresh their own registration.
+		if np.CID != c.ID || !s.registry.refresh(c.ID, s.time(), np.Players, np.Flags) {
+			return []Outgoing{{newError(c.npHeader(), netpuncher.ErrorUnknownHost, np.CID), src, nil}}, nil
+		}
+		return nil, nil
+	case *netpuncher.PunchResult:
+		// Only the client of a punch may report its result, once.
+		key := punchKey{np.CID, c.ID}
+		if !s.takePendingPunch(key) {
+			return nil, fmt.Errorf("PunchResult from %v without pending punch towards %d", src, np.CID)
+		}
+		delete(s.tcpPorts, key)
+		if s.PunchResult != nil {
+			s.PunchResult(c, np.CID, np.Success)
+		}
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unexpected message %T", p)
+}
+
+// fits returns whether c may send p to the server. Hosts may not request
+// punching or report its result, clients may not request an ID, and only
+// hosts send heartbeats. Messages only sent by the server never fit.
+func (c *Conn) fits(p netpuncher.PuncherPacket) bool {
+	switch netpuncher.Unwrap(p).(type) {
+	case *netpuncher.IDReq:
+		return c.role != roleClient
+	case *netpuncher.Heartbeat:
+		return c.role == roleHost
+	case *netpuncher.SReq, *netpuncher.SReqTCP, *netpuncher.SReqV2, *netpuncher.PunchResult:
+		return c.role != roleHost
+	}
+	return false
+}
+
+// allowSource checks src against Allow and Deny.
+func (s *Server) allowSource(src net.Addr) bool {
+	if len(s.Allow) == 0 && len(s.Deny) == 0 {
+		return true
+	}
+	addr, ok := src.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range s.Deny {
+		if n.Contains(addr.IP) {
+			return false
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, n := range s.Allow {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlePunch handles the client (r.conn) requesting punching from the host
+// (r.id). Both parties receive CReq messages.
+func (s *Server) handlePunch(r punchReq) []Outgoing {
+	client := r.conn
+	host, ok := s.conns[r.id]
+	htcp, registered := s.registry.LookupTCP(r.id)
+	if !ok || !registered {
+		// Only registered hosts can be punched, so a failed announce
+		// rolls back the registration completely. Unlike
+		// ErrorTransportUnsupported, this tells the client that trying
+		// another transport won't help.
+		if client.version < 2 {
+			return nil
+		}
+		return []Outgoing{{newError(client.npHeader(), netpuncher.ErrorUnknownHost, r.id), client.addr, nil}}
+	}
+	if !host.transports.Supports(r.transport) {
+		return s.rejectPunch(host, client, netpuncher.ErrorTransportUnsupported)
+	}
+	haddr, caddr := s.targetAddr(host), s.targetAddr(client)
+	if (haddr.IP.To4() == nil) != (caddr.IP.To4() == nil) {
+		// E.g. the host registered via the IPv6 socket of a dual-stack
+		// server and the client via IPv4.
+		return s.rejectPunch(host, client, netpuncher.ErrorFamilyMismatch)
+	}
+	toHost, toClient, err := s.punchMessages(r, host, haddr, caddr, htcp)
+	if err != nil {
+		return s.rejectPunch(host, client, netpuncher.ErrorAddressUnusable)
+	}
+	// A TCP punch needs both parties to connect at the same time.
+	var hostFallback, clientFallback netpuncher.PuncherPacket
+	if r.transport == netpuncher.TransportTCP {
+		hostFallback = peerUnreachable(host, host.ID)
+		clientFallback = peerUnreachable(client, host.ID)
+	}
+	// Sending only one party its messages would leave it punching alone.
+	out := make([]Outgoing, 0, len(toHost)+len(toClient))
+	dests := make([]*net.UDPAddr, 0, len(toHost)+len(toClient))
+	for _, p := range toHost {
+		out = append(out, Outgoing{p, host.addr, hostFallback})
+		dests = append(dests, host.addr)
+	}
+	for _, p := range toClient {
+		out = append(out, Outgoing{p, client.addr, clientFallback})
+		dests = append(dests, client.addr)
+	}
+	if !s.allowCReqs(dests) {
+		return nil
+	}
+	s.addPendingPunch(punchKey{host.ID, client.ID})
+	if s.CReq != nil && !host.selfTest && !client.selfTest {
+		s.CReq(host, client)
+	}
+	return out
+}
+
+// nonceOf returns the nonce of c, or zero if it doesn't need one, see
+// RequireNonce. It is derived from c's address as HMAC-SHA256 with a random
+// key truncated to 64 bit.
+func (s *Server) nonceOf(c *Conn) uint64 {
+	if !s.RequireNonce || c.version < 2 {
+		return 0
+	}
+	if c.nonce == 0 {
+		if s.nonceKey == nil {
+			s.nonceKey = make([]byte, sha256.Size)
+			s.rng.Read(s.nonceKey)
+		}
+		mac := hmac.New(sha256.New, s.nonceKey)
+		mac.Write([]byte(netpuncher.RegistrationKey(c.addr)))
+		// Zero means no nonce.
+		c.nonce = binary.LittleEndian.Uint64(mac.Sum(nil)) | 1
+	}
+	return c.nonce
+}
+
+// rejectVersion answers an IDReq or punch request of c with version v below
+// MinClientVersion. cid is the requested host, if any.
+func (s *Server) rejectVersion(c *Conn, v netpuncher.ProtocolVersion, cid uint32) []Outgoing {
+	if s.UnsupportedVersionErr != nil {
+		err := netpuncher.ErrUnsupportedVersion(v)
+		s.UnsupportedVersionErr(c, &err)
+	}
+	if v < 2 {
+		// Error messages exist since version 2.
+		if c.NetIOConn != nil {
+			c.NetIOConn.Close()
+		}
+		return nil
+	}
+	return []Outgoing{{newError(netpuncher.Header{Version: v}, netpuncher.ErrorVersionTooOld, cid), c.addr, nil}}
+}
+
+// newError returns an Error with code for cid using the protocol version of
+// header h.
+func newError(h netpuncher.Header, code netpuncher.ErrorCode, cid uint32) *netpuncher.Error {
+	e := netpuncher.NewError(code, "")
+	e.Header = h
+	e.CID = cid
+	return e
+}
+
+// peerUnreachable returns the Error message telling c that the other party
+// of the punch for cid won't take part, or nil if c doesn't support it.
+func peerUnreachable(c *Conn, cid uint32) netpuncher.PuncherPacket {
+	if c.version < 2 {
+		return nil
+	}
+	return newError(c.npHeader(), netpuncher.ErrorPeerUnreachable, cid)
+}
+
+// rejectPunch notifies the client that its punch request can't be served if
+// it supports Error messages.
+func (s *Server) rejectPunch(host, client *Conn, code netpuncher.ErrorCode) []Outgoing {
+	if s.RejectPunch != nil {
+		s.RejectPunch(host, client, code)
+	}
+	if client.version < 2 {
+		return nil
+	}
+	return []Outgoing{{newError(client.npHeader(), code, host.ID), client.addr, nil}}
+}
+
+// punchMessages builds the CReq or CReqTCP messages to host and client for
+// the punch request r. Fails if one of the addresses can't be punched towards.
+// Each party always receives a CReq for the observed address of the other
+// one, see punchAddrs for additional candidates. TCP punches use the host's
+// endpoint htcp from the registry instead of haddr, see creqTCPs.
+func (s *Server) punchMessages(r punchReq, host *Conn, haddr, caddr *net.UDPAddr, htcp net.TCPAddr) (toHost, toClient []netpuncher.PuncherPacket, err error) {
+	client := r.conn
+	if r.transport == netpuncher.TransportTCP {
+		h, c, retransmit, err := s.creqTCPs(host, client, htcp, caddr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if retransmit {
+			// Only the client may have missed the previous CReqTCP. The
+			// host would rebind its listener on a new one.
+			return nil, []netpuncher.PuncherPacket{c}, nil
+		}
+		return []netpuncher.PuncherPacket{h}, []netpuncher.PuncherPacket{c}, nil
+	}
+	if err = (&netpuncher.CReq{Addr: *caddr}).Validate(); err != nil {
+		return nil, nil, err
+	}
+	if err = (&netpuncher.CReq{Addr: *haddr}).Validate(); err != nil {
+		return nil, nil, err
+	}
+	// Without hairpinning support in the NAT, punching via the public
+	// address fails if both parties are behind the same NAT. Preferred
+	// addresses are only useful to peers in the same LAN. Forwarding them
+	// to others would only reveal the LAN layout.
+	var hpreferred, cpreferred *net.UDPAddr
+	if isSameNAT(haddr, caddr) {
+		hpreferred, cpreferred = host.preferred, r.preferred
+	}
+	for _, addr := range punchAddrs(caddr, cpreferred) {
+		if s.isLocalAddr(addr) {
+			return nil, nil, errLocalAddr(addr)
+		}
+		toHost = append(toHost, &netpuncher.CReq{Header: host.npHeader(), Addr: addr, BigEndianPorts: host.bigEndian, Nonce: s.nonceOf(host)})
+	}
+	for _, addr := range punchAddrs(haddr, hpreferred) {
+		if s.isLocalAddr(addr) {
+			return nil, nil, errLocalAddr(addr)
+		}
+		toClient = append(toClient, &netpuncher.CReq{Header: client.npHeader(), Addr: addr, Timestamp: r.timestamp, BigEndianPorts: client.bigEndian, Nonce: s.nonceOf(client)})
+	}
+	return toHost, toClient, nil
+}
+
+// creqTCPs builds the mirrored CReqTCP messages for a TCP punch between host,
+// at its TCP endpoint haddrtcp from the registry, and client at caddr.
+// retransmit reports whether the ports were reused from an earlier request.
+func (s *Server) creqTCPs(host, client *Conn, haddrtcp net.TCPAddr, caddr *net.UDPAddr) (toHost, toClient *netpuncher.CReqTCP, retransmit bool, err error) {
+	ports, retransmit := s.tcpPunchPorts(punchKey{host.ID, client.ID})
+	caddrtcp := net.TCPAddr{IP: caddr.IP, Port: ports.clientPort}
+	haddrtcp.Port = ports.hostPort
+	toHost = &netpuncher.CReqTCP{Header: host.npHeader(), SourceAddr: haddrtcp, DestAddr: caddrtcp, BigEndianPorts: host.bigEndian, Nonce: s.nonceOf(host)}
+	toClient = &netpuncher.CReqTCP{Header: client.npHeader(), SourceAddr: caddrtcp, DestAddr: haddrtcp, BigEndianPorts: client.bigEndian, Nonce: s.nonceOf(client)}
+	if err = toHost.Validate(); err != nil {
+		return nil, nil, false, err
+	}
+	for _, addr := range []net.TCPAddr{caddrtcp, haddrtcp} {
+		if s.isLocalIP(addr.IP) {
+			return nil, nil, false, fmt.Errorf("CReqTCP address %v is the server's own", &addr)
+		}
+	}
+	if !retransmit && s.TCPPorts != nil {
+		s.TCPPorts(host, client, ports.hostPort, ports.clientPort)
+	}
+	return toHost, toClient, retransmit, nil
+}
+
+// targetAddr returns the address of c to punch towards, see
+// RewriteTargetAddr.
+func (s *Server) targetAddr(c *Conn) *net.UDPAddr {
+	if s.RewriteTargetAddr == nil {
+		return c.addr
+	}
+	observed := copyUDPAddr(c.addr)
+	if addr, ok := s.RewriteTargetAddr(&observed).(*net.UDPAddr); ok && addr != nil {
+		return addr
+	}
+	return c.addr
+}
+
+func errLocalAddr(addr net.UDPAddr) error {
+	return fmt.Errorf("CReq address %v is the server's own", &addr)
+}
+
+// isLocalAddr returns whether addr is one of the server's own addresses, see
+// LocalAddrs.
+func (s *Server) isLocalAddr(addr net.UDPAddr) bool {
+	for _, list := range [][]net.UDPAddr{s.LocalAddrs, s.detected} {
+		for _, local := range list {
+			if local.Port == addr.Port && local.IP.Equal(addr.IP) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isLocalIP returns whether ip belongs to one of the server's own addresses.
+func (s *Server) isLocalIP(ip net.IP) bool {
+	for _, list := range [][]net.UDPAddr{s.LocalAddrs, s.detected} {
+		for _, local := range list {
+			if local.IP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// detectLocalAddrs returns the addresses the server listening on laddr can be
+// reached at.
+func detectLocalAddrs(laddr *net.UDPAddr) ([]net.UDPAddr, error) {
+	if !laddr.IP.IsUnspecified() {
+		return []net.UDPAddr{*laddr}, nil
+	}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]net.UDPAddr, 0, len(ifaddrs))
+	for _, a := range ifaddrs {
+		if ipnet, ok := a.(*net.IPNet); ok {
+			addrs = append(addrs, net.UDPAddr{IP: ipnet.IP, Port: laddr.Port})
+		}
+	}
+	return addrs, nil
+}
+
+// tcpPunchPorts returns the ports for a TCP punch between the given parties.
+// Within tcpPunchWindow, a retransmitted request gets the same ports again.
+func (s *Server) tcpPunchPorts(key punchKey) (p tcpPunch, retransmit bool) {
+	now := s.time()
+	if p, ok := s.tcpPorts[key]; ok && now.Sub(p.created) < tcpPunchWindow {
+		return p, true
+	}
+	if s.tcpPorts == nil {
+		s.tcpPorts = make(map[punchKey]tcpPunch)
+	}
+	for k, p := range s.tcpPorts {
+		if now.Sub(p.created) >= tcpPunchWindow {
+			delete(s.tcpPorts, k)
+		}
+	}
+	gen := s.PortGenerator
+	if gen == nil {
+		gen = randomPorts{s.rng}
+	}
+	p.hostPort, p.clientPort = gen.Ports()
+	p.created = now
+	s.tcpPorts[key] = p
+	return p, false
+}
+
+// addPendingPunch records a punch for its result, see takePendingPunch.
+// Records older than pendingPunchWindow are dropped.
+func (s *Server) addPendingPunch(key punchKey) {
+	now := s.time()
+	if s.pending == nil {
+		s.pending = make(map[punchKey]time.Time)
+	}
+	for k, created := range s.pending {
+		if now.Sub(created) >= pendingPunchWindow {
+			delete(s.pending, k)
+		}
+	}
+	s.pending[key] = now
+}
+
+// takePendingPunch removes the record of a punch. Returns false if there was
+// none within pendingPunchWindow.
+func (s *Server) takePendingPunch(key punchKey) bool {
+	created, ok := s.pending[key]
+	delete(s.pending, key)
+	return ok && s.time().Sub(created) < pendingPunchWindow
+}
+
+// isSameNAT returns whether peers observed at haddr and caddr are behind the
+// same NAT.
+func isSameNAT(haddr, caddr *net.UDPAddr) bool {
+	return haddr.IP.Equal(caddr.IP)
+}
+
+// punchAddrs returns the addresses of a peer to send CReqs for. The observed
+// address is always included, so that a peer can't redirect punching to an
+// arbitrary target. A usable preferred address, which is only passed for
+// peers behind the same NAT, is tried first.
+func punchAddrs(observed, preferred *net.UDPAddr) []net.UDPAddr {
+	addrs := []net.UDPAddr{*observed}
+	if preferred == nil || preferred.Port == observed.Port && preferred.IP.Equal(observed.IP) {
+		return addrs
+	}
+	// An unusable preferred address doesn't prevent punching via the
+	// observed one.
+	if (&netpuncher.CReq{Addr: *preferred}).Validate() != nil {
+		return addrs
+	}
+	return append([]net.UDPAddr{*preferred}, addrs...)
+}
+
+// Listener accepts the connections of peers for the server. It is
+// implemented by *c4netioudp.Listener.
+type Listener interface {
+	AcceptConn() (*c4netioudp.Conn, error)
+	Addr() net.Addr
+	Close() error
+}
+
 // Listen starts the netpuncher server.
 func (s *Server) Listen(network string, listenaddr *net.UDPAddr) error {
-	listener, err := c4netioudp.Listen(network, listenaddr)
-	if err != nil {
-		return fmt.Errorf("couldn't ListenUDP: %v", err)
+	return s.ListenMulti(network, []*net.UDPAddr{listenaddr})
+}
+
+// ListenMulti starts the netpuncher server on several sockets, e.g. on
+// multiple ports or interfaces, see Start.
+func (s *Server) ListenMulti(network string, listenaddrs []*net.UDPAddr) error {
+	var listeners []Listener
+	for _, listenaddr := range listenaddrs {
+		listener, err := c4netioudp.Listen(network, listenaddr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("couldn't ListenUDP: %v", err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return s.Start(listeners)
+}
+
+// Start starts the netpuncher server on listeners, which it closes on Close
+// or if starting fails. They share the server loop and the registry, so a
+// client can punch a host which registered via another listener. Messages
+// to a peer are sent via the listener it connected to, and the peer's
+// address is the one observed there, even if it connects to several of the
+// listeners from the same address.
+func (s *Server) Start(listeners []Listener) error {
+	if len(listeners) == 0 {
+		return fmt.Errorf("no listen address")
+	}
+	s.listeners = listeners
+	s.detected = nil
+	if s.DetectLocalAddrs {
+		for _, listener := range listeners {
+			laddr, ok := listener.Addr().(*net.UDPAddr)
+			if !ok {
+				continue
+			}
+			detected, err := detectLocalAddrs(laddr)
+			if err != nil {
+				s.closeListeners()
+				return fmt.Errorf("couldn't detect local addresses: %v", err)
+			}
+			s.detected = append(s.detected, detected...)
+		}
 	}
-	s.listener = listener
 	s.exitch = make(chan struct{})
 
-	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
-
-	go func() {
-		connch := make(chan *c4netioudp.Conn)
-		conns := make(map[uint32]*Conn)
-		req := make(chan punchReq)
-		closech := make(chan uint32)
-		go func() {
-			for {
-				conn, err := listener.AcceptConn()
-				select {
-				case <-s.exitch:
-					return
-				default:
-				}
-				if err != nil {
-					if s.AcceptConn != nil {
-						s.AcceptConn(nil, err)
-					}
-					continue
-				}
-				connch <- conn
-			}
-		}()
-		for {
-			select {
-			case conn := <-connch:
-				id := rng.Uint32()
-				c := &Conn{ID: id, NetIOConn: conn, s: s}
-				conns[id] = c
-				go c.handlePackets(req, closech)
-				if s.AcceptConn != nil {
-					s.AcceptConn(c, nil)
-				}
-			case r := <-req:
-				// The client (r.conn) requests punching from the host (r.id). We will send a
-				// CReq message to both parties.
-				client := r.conn
-				if host, ok := conns[r.id]; ok {
-					caddr := client.NetIOConn.RemoteAddr().(*net.UDPAddr)
-					haddr := host.NetIOConn.RemoteAddr().(*net.UDPAddr)
-					var hbuf, cbuf []byte
-					var herr, cerr error
-					if r.tcp {
-						caddrtcp := net.TCPAddr{IP: caddr.IP, Port: randomPort(rng)}
-						haddrtcp := net.TCPAddr{IP: haddr.IP, Port: randomPort(rng)}
-						hbuf, herr = netpuncher.CReqTCP{
-							Header:     host.npHeader(),
-							SourceAddr: haddrtcp,
-							DestAddr:   caddrtcp}.MarshalBinary()
-						cbuf, cerr = netpuncher.CReqTCP{
-							Header:     client.npHeader(),
-							SourceAddr: caddrtcp,
-							DestAddr:   haddrtcp}.MarshalBinary()
-					} else {
-						hbuf, herr = netpuncher.CReq{Header: host.npHeader(), Addr: *caddr}.MarshalBinary()
-						cbuf, cerr = netpuncher.CReq{Header: client.npHeader(), Addr: *haddr}.MarshalBinary()
-					}
-					if herr != nil {
-						if s.MarshalErr != nil {
-							s.MarshalErr(fmt.Errorf("CReq.MarshalBinary() host: %v", herr))
-						}
-						continue
-					}
-					host.NetIOConn.Write(hbuf)
-					if cerr != nil {
-						if s.MarshalErr != nil {
-							s.MarshalErr(fmt.Errorf("CReq.MarshalBinary() client: %v", cerr))
-						}
-						continue
-					}
-					client.NetIOConn.Write(cbuf)
-					if s.CReq != nil {
-						s.CReq(host, client)
-					}
+	s.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	connch := make(chan *c4netioudp.Conn)
+	for _, listener := range s.listeners {
+		go s.accept(listener, connch)
+	}
+	go s.loop(connch)
+
+	return nil
+}
+
+// accept passes connections from listener to the server loop until the
+// server exits.
+func (s *Server) accept(listener Listener, connch chan<- *c4netioudp.Conn) {
+	for {
+		conn, err := listener.AcceptConn()
+		select {
+		case <-s.exitch:
+			return
+		default:
+		}
+		if err != nil {
+			if s.AcceptConn != nil {
+				s.AcceptConn(nil, err)
+			}
+			continue
+		}
+		select {
+		case connch <- conn:
+		case <-s.exitch:
+			return
+		}
+	}
+}
+
+// loop is the server loop which handles all connections and messages.
+func (s *Server) loop(connch <-chan *c4netioudp.Conn) {
+	recv := make(chan received, s.QueueSize)
+	closech := make(chan *Conn)
+	for {
+		select {
+		case conn := <-connch:
+			addr := conn.RemoteAddr().(*net.UDPAddr)
+			c := &Conn{ID: s.connID(), NetIOConn: conn, addr: addr, reader: netioReader{conn}, writer: conn, selfTest: s.isSelfTestPeer(addr), s: s}
+			s.addConn(c)
+			go c.handlePackets(recv, closech)
+			if s.AcceptConn != nil && !c.selfTest {
+				s.AcceptConn(c, nil)
+			}
+		case r := <-recv:
+			out, err := s.Handle(r.p, r.src)
+			if err != nil {
+				if s.InvalidPacketErr != nil {
+					s.InvalidPacketErr(r.conn, err)
 				}
-			case id := <-closech:
-				delete(conns, id)
-			case <-s.exitch:
-				return
+				continue
+			}
+			s.send(out)
+		case c := <-closech:
+			// A reconnect may have taken over the ID, see identityID.
+			if s.conns[c.ID] == c {
+				s.removeConn(c.ID)
 			}
+		case <-s.exitch:
+			return
 		}
-	}()
+	}
+}
 
-	return nil
+// send marshals and sends out. Nothing is sent if marshalling fails. If
+// sending one of the messages fails, the fallbacks of the others are sent.
+func (s *Server) send(out []Outgoing) {
+	conns := make([]*Conn, len(out))
+	bufs := make([][]byte, len(out))
+	for i, o := range out {
+		c, ok := s.addrs[o.Dest]
+		if !ok {
+			continue
+		}
+		conns[i] = c
+		var err error
+		if bufs[i], err = s.marshal(c, o.Packet); err != nil {
+			return
+		}
+	}
+	sent := make([]bool, len(out))
+	failed := false
+	for i, c := range conns {
+		if c == nil {
+			continue
+		}
+		if _, err := c.writer.Write(bufs[i]); err != nil {
+			failed = true
+			if s.SendErr != nil {
+				s.SendErr(c, err)
+			}
+			continue
+		}
+		sent[i] = true
+	}
+	if !failed {
+		return
+	}
+	for i, o := range out {
+		if !sent[i] || o.Fallback == nil {
+			continue
+		}
+		if buf, err := s.marshal(conns[i], o.Fallback); err == nil {
+			conns[i].writer.Write(buf)
+		}
+	}
+}
+
+// marshal encodes p for sending to c.
+func (s *Server) marshal(c *Conn, p netpuncher.PuncherPacket) (buf []byte, err error) {
+	if assid, ok := p.(*netpuncher.AssID); ok && assid.Nonce == 0 && !c.padding && !c.checksum {
+		return netpuncher.MarshalAssID(assid.Header.Version, assid.CID), nil
+	}
+	if c.padding {
+		buf, err = netpuncher.MarshalPadded(p)
+	} else if c.checksum {
+		buf, err = netpuncher.MarshalChecksummed(p)
+	} else {
+		buf, err = p.MarshalBinary()
+	}
+	if err != nil && s.MarshalErr != nil {
+		s.MarshalErr(fmt.Errorf("%T.MarshalBinary(): %v", p, err))
+	}
+	return
 }
 
-// Addr returns the netpuncher's local UDP address.
+// Registry returns information about the registered hosts.
+func (s *Server) Registry() *Registry {
+	return &s.registry
+}
+
+// Addr returns the netpuncher's local UDP address, the first one if it
+// listens on several sockets.
 func (s *Server) Addr() net.Addr {
-	if s.listener == nil {
+	if len(s.listeners) == 0 {
 		return nil
 	}
-	return s.listener.Addr()
+	return s.listeners[0].Addr()
+}
+
+// Addrs returns the local UDP addresses of all sockets, in the order passed
+// to ListenMulti or Start.
+func (s *Server) Addrs() []net.Addr {
+	addrs := make([]net.Addr, len(s.listeners))
+	for i, listener := range s.listeners {
+		addrs[i] = listener.Addr()
+	}
+	return addrs
 }
 
-// Close makes the netpuncher exit.
+// Close makes the netpuncher exit and closes all of its sockets.
 func (s *Server) Close() error {
 	close(s.exitch)
-	return nil
+	return s.closeListeners()
+}
+
+func (s *Server) closeListeners() error {
+	var err error
+	for _, listener := range s.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
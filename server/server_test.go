@@ -0,0 +1,1555 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/openclonk/netpuncher"
+	"github.com/openclonk/netpuncher/c4netioudp"
+)
+
+// readPacket reads a single netpuncher message from conn or fails the test
+// after a timeout.
+func readPacket(t *testing.T, conn *c4netioudp.Conn) netpuncher.PuncherPacket {
+	t.Helper()
+	p, err := netpuncher.Unmarshal(readDatagram(t, conn))
+	if err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	return p
+}
+
+// readDatagram reads a single datagram from conn or fails the test after a
+// timeout.
+func readDatagram(t *testing.T, conn *c4netioudp.Conn) []byte {
+	t.Helper()
+	type result struct {
+		b   []byte
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		buf := make([]byte, c4netioudp.MaxSize)
+		n, err := conn.Read(buf)
+		ch <- result{buf[:n], err}
+	}()
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("Read: %v", r.err)
+		}
+		return r.b
+	case <-time.After(time.Second):
+		t.Fatal("timeout while waiting for message")
+	}
+	return nil
+}
+
+func writePacket(t *testing.T, conn *c4netioudp.Conn, p netpuncher.PuncherPacket) {
+	t.Helper()
+	buf, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatalf("%T.MarshalBinary(): %v", p, err)
+	}
+	if _, err = conn.Write(buf); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// startServer starts a server on the loopback interface and connects a host
+// and a client. The host is registered with idreq and the returned CID.
+func startServer(t *testing.T, s *Server, idreq netpuncher.IDReq) (host, client *c4netioudp.Conn, cid uint32) {
+	t.Helper()
+	if err := s.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Fatal(err)
+	}
+	raddr := s.Addr().(*net.UDPAddr)
+	host, err := c4netioudp.Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err = c4netioudp.Dial("udp", nil, raddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePacket(t, host, &idreq)
+	assid, ok := readPacket(t, host).(*netpuncher.AssID)
+	if !ok {
+		t.Fatal("host didn't receive AssID")
+	}
+	return host, client, assid.CID
+}
+
+// A client can punch a host which registered via another socket. Each peer
+// gets its messages via the socket it connected to.
+func TestListenMulti(t *testing.T) {
+	var s Server
+	if err := s.ListenMulti("udp", []*net.UDPAddr{{IP: net.IPv6loopback}, {IP: net.IPv6loopback}}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	addrs := s.Addrs()
+	if len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("expected two distinct addresses, got %v", addrs)
+	}
+	host, err := c4netioudp.Dial("udp", nil, addrs[0].(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	client, err := c4netioudp.Dial("udp", nil, addrs[1].(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	header := netpuncher.Header{Version: 2}
+	writePacket(t, host, &netpuncher.IDReq{Header: header})
+	assid, ok := readPacket(t, host).(*netpuncher.AssID)
+	if !ok {
+		t.Fatal("host didn't receive AssID")
+	}
+	if _, ok := s.Registry().Metadata(assid.CID); !ok {
+		t.Fatal("host not in registry")
+	}
+	writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: assid.CID, Transport: netpuncher.TransportUDP})
+	toHost, ok := readPacket(t, host).(*netpuncher.CReq)
+	if !ok {
+		t.Fatal("expected CReq to host")
+	}
+	toClient, ok := readPacket(t, client).(*netpuncher.CReq)
+	if !ok {
+		t.Fatal("expected CReq to client")
+	}
+	hostAddr := host.LocalAddr().(*net.UDPAddr)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	if toHost.Addr.Port != clientAddr.Port || toClient.Addr.Port != hostAddr.Port {
+		t.Errorf("got CReq to host %v and to client %v, expected %v and %v", &toHost.Addr, &toClient.Addr, clientAddr, hostAddr)
+	}
+}
+
+// A peer connecting to both sockets from the same address is answered via
+// the socket its message arrived on.
+func TestListenMultiSameAddr(t *testing.T) {
+	var s Server
+	if err := s.ListenMulti("udp", []*net.UDPAddr{{IP: net.IPv6loopback}, {IP: net.IPv6loopback}}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	peer, err := c4netioudp.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	var conns []*c4netioudp.Conn
+	for _, addr := range s.Addrs() {
+		conn, err := peer.Dial(addr.(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+
+	header := netpuncher.Header{Version: 2}
+	for _, i := range []int{0, 1, 0} {
+		writePacket(t, conns[i], &netpuncher.IDReq{Header: header})
+		if _, ok := readPacket(t, conns[i]).(*netpuncher.AssID); !ok {
+			t.Fatalf("socket %d: expected AssID", i)
+		}
+	}
+}
+
+// closeCounter is a Listener which counts how often it is closed.
+type closeCounter struct {
+	*c4netioudp.Listener
+	closed int
+}
+
+func (l *closeCounter) Close() error {
+	l.closed++
+	return l.Listener.Close()
+}
+
+// Start serves on listeners created by the caller and closes them on Close.
+func TestStart(t *testing.T) {
+	inner, err := c4netioudp.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &closeCounter{Listener: inner}
+	var s Server
+	if err := s.Start([]Listener{listener}); err != nil {
+		t.Fatal(err)
+	}
+	host, err := c4netioudp.Dial("udp", nil, s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	writePacket(t, host, &netpuncher.IDReq{Header: netpuncher.Header{Version: 2}})
+	if _, ok := readPacket(t, host).(*netpuncher.AssID); !ok {
+		t.Fatal("host didn't receive AssID")
+	}
+	s.Close()
+	if listener.closed != 1 {
+		t.Errorf("listener closed %d times, want 1", listener.closed)
+	}
+}
+
+// The unified SReqV2 is answered with CReq or CReqTCP depending on its transport.
+func TestSReqV2Transport(t *testing.T) {
+	var s Server
+	host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: netpuncher.Header{Version: 2}})
+	defer s.Close()
+	defer host.Close()
+	defer client.Close()
+
+	header := netpuncher.Header{Version: 2}
+	writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: cid, Transport: netpuncher.TransportUDP})
+	toHost, ok := readPacket(t, host).(*netpuncher.CReq)
+	if !ok {
+		t.Fatal("expected CReq to host for UDP transport")
+	}
+	toClient, ok := readPacket(t, client).(*netpuncher.CReq)
+	if !ok {
+		t.Fatal("expected CReq to client for UDP transport")
+	}
+	hostAddr := host.LocalAddr().(*net.UDPAddr)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	if err := netpuncher.VerifyCReqPair(*toHost, *toClient, *hostAddr, *clientAddr); err != nil {
+		t.Error(err)
+	}
+
+	writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: cid, Transport: netpuncher.TransportTCP})
+	for _, conn := range []*c4netioudp.Conn{host, client} {
+		if p, ok := readPacket(t, conn).(*netpuncher.CReqTCP); !ok {
+			t.Errorf("expected CReqTCP for TCP transport, got %T", p)
+		}
+	}
+}
+
+// The client's timestamp is echoed back unchanged.
+func TestTimestampEcho(t *testing.T) {
+	var s Server
+	host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: netpuncher.Header{Version: 2}})
+	defer s.Close()
+	defer host.Close()
+	defer client.Close()
+
+	const timestamp = 0x0123456789abcdef
+	writePacket(t, client, &netpuncher.SReqV2{Header: netpuncher.Header{Version: 2}, CID: cid, Timestamp: timestamp})
+	if creq, ok := readPacket(t, host).(*netpuncher.CReq); !ok || creq.Timestamp != 0 {
+		t.Errorf("unexpected message to host: %+v", creq)
+	}
+	if creq, ok := readPacket(t, client).(*netpuncher.CReq); !ok || creq.Timestamp != timestamp {
+		t.Errorf("unexpected message to client: %+v", creq)
+	}
+}
+
+// Punch requests for a transport the host doesn't offer are rejected.
+func TestTransportUnsupported(t *testing.T) {
+	tests := []struct {
+		offered   netpuncher.Transports
+		requested netpuncher.Transport
+	}{
+		{netpuncher.TransportsTCP, netpuncher.TransportUDP},
+		{netpuncher.TransportsUDP, netpuncher.TransportTCP},
+	}
+	for _, test := range tests {
+		rejected := make(chan netpuncher.ErrorCode, 1)
+		s := Server{RejectPunch: func(host, client *Conn, code netpuncher.ErrorCode) { rejected <- code }}
+		header := netpuncher.Header{Version: 2}
+		host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: header, Transports: test.offered})
+
+		writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: cid, Transport: test.requested})
+		if p, ok := readPacket(t, client).(*netpuncher.Error); !ok || p.Code != netpuncher.ErrorTransportUnsupported || p.CID != cid {
+			t.Errorf("offered %d, requested %d: unexpected reply %+v", test.offered, test.requested, p)
+		}
+		if code := <-rejected; code != netpuncher.ErrorTransportUnsupported {
+			t.Errorf("RejectPunch called with code %d", code)
+		}
+
+		s.Close()
+		host.Close()
+		client.Close()
+	}
+}
+
+// Punch messages towards a zero port are rejected.
+func TestPunchMessagesZeroPort(t *testing.T) {
+	s := Server{rng: rand.New(rand.NewSource(1))}
+	good := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	host := &Conn{ID: 1337, version: 2, addr: good, s: &s}
+	client := &Conn{ID: 1338, version: 2, s: &s}
+	register(&s, host)
+	zero := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 0}
+
+	for _, transport := range []netpuncher.Transport{netpuncher.TransportUDP, netpuncher.TransportTCP} {
+		r := punchReq{id: host.ID, conn: client, transport: transport}
+		if _, _, err := s.punchMessages(r, host, good, good, net.TCPAddr{IP: good.IP}); err != nil {
+			t.Errorf("transport %d: valid addresses rejected: %v", transport, err)
+		}
+	}
+	r := punchReq{id: host.ID, conn: client, transport: netpuncher.TransportUDP}
+	if _, _, err := s.punchMessages(r, host, zero, good, net.TCPAddr{}); err == nil {
+		t.Error("zero host port accepted")
+	}
+	if _, _, err := s.punchMessages(r, host, good, zero, net.TCPAddr{}); err == nil {
+		t.Error("zero client port accepted")
+	}
+}
+
+func TestPunchMessagesPreferredAddr(t *testing.T) {
+	s := Server{rng: rand.New(rand.NewSource(1))}
+	host := &Conn{ID: 1337, version: 2, s: &s}
+	client := &Conn{ID: 1338, version: 2, s: &s}
+	haddr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}
+	caddr := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11114}
+	other := &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 11114}
+	preferred := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 11115}
+
+	tests := []struct {
+		name      string
+		caddr     *net.UDPAddr
+		preferred *net.UDPAddr
+		want      []*net.UDPAddr
+	}{
+		{"absent", caddr, nil, []*net.UDPAddr{caddr}},
+		{"present", caddr, preferred, []*net.UDPAddr{preferred, caddr}},
+		{"same as observed", caddr, caddr, []*net.UDPAddr{caddr}},
+		{"unusable", caddr, &net.UDPAddr{IP: net.IPv4zero, Port: 11115}, []*net.UDPAddr{caddr}},
+		{"different NAT", other, preferred, []*net.UDPAddr{other}},
+	}
+	for _, test := range tests {
+		r := punchReq{id: host.ID, conn: client, transport: netpuncher.TransportUDP, preferred: test.preferred}
+		toHost, _, err := s.punchMessages(r, host, haddr, test.caddr, net.TCPAddr{})
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if len(toHost) != len(test.want) {
+			t.Errorf("%s: got %d messages to host, expected %d", test.name, len(toHost), len(test.want))
+			continue
+		}
+		for i, p := range toHost {
+			creq, ok := p.(*netpuncher.CReq)
+			if !ok {
+				t.Errorf("%s: message %d is %T, expected *CReq", test.name, i, p)
+				continue
+			}
+			if !creq.Addr.IP.Equal(test.want[i].IP) || creq.Addr.Port != test.want[i].Port {
+				t.Errorf("%s: message %d has address %v, expected %v", test.name, i, &creq.Addr, test.want[i])
+			}
+		}
+	}
+}
+
+func TestPunchMessagesSameNAT(t *testing.T) {
+	s := Server{rng: rand.New(rand.NewSource(1))}
+	hlan := &net.UDPAddr{IP: net.ParseIP("192.168.1.2"), Port: 11113}
+	clan := &net.UDPAddr{IP: net.ParseIP("192.168.1.3"), Port: 11114}
+	host := &Conn{ID: 1337, version: 2, preferred: hlan, s: &s}
+	client := &Conn{ID: 1338, version: 2, s: &s}
+	haddr := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40001}
+	caddr := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 40002}
+
+	addrsOf := func(packets []netpuncher.PuncherPacket) []string {
+		var addrs []string
+		for _, p := range packets {
+			addrs = append(addrs, p.(*netpuncher.CReq).Addr.String())
+		}
+		return addrs
+	}
+	r := punchReq{id: host.ID, conn: client, transport: netpuncher.TransportUDP, preferred: clan}
+	toHost, toClient, err := s.punchMessages(r, host, haddr, caddr, net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addrsOf(toHost), []string{clan.String(), caddr.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("same NAT: host received %v, expected %v", got, want)
+	}
+	if got, want := addrsOf(toClient), []string{hlan.String(), haddr.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("same NAT: client received %v, expected %v", got, want)
+	}
+
+	// Different NATs: the LAN addresses are useless to the other party.
+	caddr = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 40002}
+	toHost, toClient, err = s.punchMessages(r, host, haddr, caddr, net.TCPAddr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := addrsOf(toHost), []string{caddr.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("different NATs: host received %v, expected %v", got, want)
+	}
+	if got, want := addrsOf(toClient), []string{haddr.String()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("different NATs: client received %v, expected %v", got, want)
+	}
+}
+
+// handleServer returns a Server with a host and a client registered, suitable
+// for calling Handle.
+func handleServer() (s *Server, host, client *Conn) {
+	s = &Server{rng: rand.New(rand.NewSource(1))}
+	host = &Conn{ID: 1337, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 11113}, s: s}
+	client = &Conn{ID: 1338, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 11114}, s: s}
+	s.addConn(host)
+	s.addConn(client)
+	return
+}
+
+// register registers host as if it had sent an IDReq, which TCP punching
+// requires.
+func register(s *Server, host *Conn) {
+	s.registry.register(host.ID, host.addr, s.targetAddr(host), s.time(), nil, false)
+}
+
+// Messages from a Decoder with PreserveWireForm or PreserveExtensions are
+// handled like the messages they wrap.
+func TestHandleWrapped(t *testing.T) {
+	s, host, client := handleServer()
+	header := netpuncher.Header{Version: 2}
+	idreq := &netpuncher.ExtendedPacket{PuncherPacket: &netpuncher.IDReq{Header: header, Transports: netpuncher.TransportsUDP}}
+	out, err := s.Handle(idreq, host.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || host.role != roleHost {
+		t.Fatalf("IDReq: got %+v, host %+v", out, host)
+	}
+	if _, ok := out[0].Packet.(*netpuncher.AssID); !ok {
+		t.Errorf("IDReq: got %T, expected AssID", out[0].Packet)
+	}
+	sreq := &netpuncher.SReqV2{Header: header, CID: host.ID, Transport: netpuncher.TransportUDP}
+	raw, _ := sreq.MarshalBinary()
+	out, err = s.Handle(&netpuncher.WirePacket{PuncherPacket: sreq, Raw: raw}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || client.role != roleClient {
+		t.Fatalf("SReqV2: got %+v, expected two CReqs", out)
+	}
+
+	// Also before the message type is known.
+	s.MinClientVersion = 2
+	old := &netpuncher.WirePacket{PuncherPacket: &netpuncher.IDReq{Header: netpuncher.Header{Version: 1}}}
+	if _, err := s.Handle(old, host.addr); err != nil {
+		t.Errorf("IDReq v1: %v", err)
+	}
+	s.Deny = []net.IPNet{{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(32, 128)}}
+	s.NotifyDenied = true
+	if out, _ := s.Handle(&netpuncher.WirePacket{PuncherPacket: sreq, Raw: raw}, client.addr); len(out) != 1 {
+		t.Errorf("denied SReqV2: got %+v, expected Error", out)
+	}
+}
+
+func TestHandleIDReq(t *testing.T) {
+	s, host, _ := handleServer()
+	out, err := s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 2}, Transports: netpuncher.TransportsUDP}, host.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Outgoing{{&netpuncher.AssID{Header: netpuncher.Header{Version: 2}, CID: host.ID}, host.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+	if host.version != 2 || host.transports != netpuncher.TransportsUDP {
+		t.Errorf("host not updated: %+v", host)
+	}
+}
+
+func TestHandleRole(t *testing.T) {
+	s, host, client := handleServer()
+	header := netpuncher.Header{Version: 2}
+	creq := &netpuncher.CReq{Header: header, Addr: *client.addr}
+	out, err := s.Handle(creq, host.addr)
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorUnexpectedMessage}, host.addr, nil}}
+	if err != nil || !reflect.DeepEqual(out, expected) {
+		t.Errorf("CReq: got %+v, %v, expected %+v", out, err, expected)
+	}
+	// Version 1 peers can't receive an Error.
+	out, err = s.Handle(&netpuncher.CReq{Header: netpuncher.Header{Version: 1}, Addr: *client.addr}, host.addr)
+	if err == nil || len(out) != 0 {
+		t.Errorf("CReq v1: got %+v, %v, expected error", out, err)
+	}
+
+	// Hosts can't request punching and clients can't request an ID.
+	if _, err := s.Handle(&netpuncher.IDReq{Header: header}, host.addr); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = s.Handle(&netpuncher.SReqV2{Header: header, CID: client.ID}, host.addr)
+	expected = []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorUnexpectedMessage, CID: client.ID}, host.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("SReqV2 from host: got %+v, expected %+v", out, expected)
+	}
+	if _, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID}, client.addr); err != nil {
+		t.Fatal(err)
+	}
+	out, _ = s.Handle(&netpuncher.IDReq{Header: header}, client.addr)
+	expected = []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorUnexpectedMessage}, client.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("IDReq from client: got %+v, expected %+v", out, expected)
+	}
+}
+
+func TestFamilyMismatch(t *testing.T) {
+	s, host, client := handleServer()
+	host.version = 2
+	register(s, host)
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 11114}
+	delete(s.addrs, client.addr)
+	client.addr = v4
+	s.addConn(client)
+	var rejected []netpuncher.ErrorCode
+	s.RejectPunch = func(h, c *Conn, code netpuncher.ErrorCode) { rejected = append(rejected, code) }
+	header := netpuncher.Header{Version: 2}
+	out, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID}, v4)
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorFamilyMismatch, CID: host.ID}, v4, nil}}
+	if err != nil || !reflect.DeepEqual(out, expected) {
+		t.Errorf("IPv6 host, IPv4 client: got %+v, %v, expected %+v", out, err, expected)
+	}
+	if !reflect.DeepEqual(rejected, []netpuncher.ErrorCode{netpuncher.ErrorFamilyMismatch}) {
+		t.Errorf("RejectPunch called with %v", rejected)
+	}
+
+	// An IPv4-mapped address counts as IPv4.
+	delete(s.addrs, host.addr)
+	host.addr = &net.UDPAddr{IP: net.ParseIP("::ffff:198.51.100.1"), Port: 11113}
+	s.addConn(host)
+	out, err = s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID}, v4)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("IPv4 host and client: got %+v, %v", out, err)
+	}
+	for _, o := range out {
+		if _, ok := o.Packet.(*netpuncher.CReq); !ok {
+			t.Errorf("IPv4 host and client: got %+v, expected CReq", o.Packet)
+		}
+	}
+}
+
+func TestHandleSReq(t *testing.T) {
+	s, host, client := handleServer()
+	host.version = 1
+	register(s, host)
+	out, err := s.Handle(&netpuncher.SReq{Header: netpuncher.Header{Version: 1}, CID: host.ID}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := netpuncher.Header{Version: 1}
+	expected := []Outgoing{
+		{&netpuncher.CReq{Header: header, Addr: *client.addr}, host.addr, nil},
+		{&netpuncher.CReq{Header: header, Addr: *host.addr}, client.addr, nil},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+
+	// Unknown host IDs are ignored.
+	out, err = s.Handle(&netpuncher.SReq{Header: header, CID: 42}, client.addr)
+	if err != nil || len(out) != 0 {
+		t.Errorf("unknown host: got %+v, %v", out, err)
+	}
+}
+
+func TestHandleSReqTCP(t *testing.T) {
+	s, host, client := handleServer()
+	register(s, host)
+	host.version = 1
+	out, err := s.Handle(&netpuncher.SReqTCP{Header: netpuncher.Header{Version: 1}, CID: host.ID}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 {
+		t.Fatalf("got %d messages, expected 2", len(out))
+	}
+	toHost, ok1 := out[0].Packet.(*netpuncher.CReqTCP)
+	toClient, ok2 := out[1].Packet.(*netpuncher.CReqTCP)
+	if !ok1 || !ok2 || out[0].Dest != host.addr || out[1].Dest != client.addr {
+		t.Fatalf("unexpected messages %+v", out)
+	}
+	if !toHost.SourceAddr.IP.Equal(host.addr.IP) || !toHost.DestAddr.IP.Equal(client.addr.IP) {
+		t.Errorf("CReqTCP to host has wrong orientation: %+v", toHost)
+	}
+	if toClient.SourceAddr.String() != toHost.DestAddr.String() || toClient.DestAddr.String() != toHost.SourceAddr.String() {
+		t.Errorf("CReqTCP messages don't match: %+v, %+v", toHost, toClient)
+	}
+}
+
+// seqPorts is a PortGenerator returning consecutive ports.
+type seqPorts int
+
+func (p *seqPorts) Ports() (hostPort, clientPort int) {
+	*p += 2
+	return int(*p) - 2, int(*p) - 1
+}
+
+func TestPortGenerator(t *testing.T) {
+	s, host, client := handleServer()
+	register(s, host)
+	host.version = 1
+	ports := seqPorts(50000)
+	s.PortGenerator = &ports
+	out, err := s.Handle(&netpuncher.SReqTCP{Header: netpuncher.Header{Version: 1}, CID: host.ID}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Outgoing{
+		{&netpuncher.CReqTCP{Header: netpuncher.Header{Version: 1}, SourceAddr: net.TCPAddr{IP: host.addr.IP, Port: 50000}, DestAddr: net.TCPAddr{IP: client.addr.IP, Port: 50001}}, host.addr, nil},
+		{&netpuncher.CReqTCP{Header: netpuncher.Header{Version: 1}, SourceAddr: net.TCPAddr{IP: client.addr.IP, Port: 50001}, DestAddr: net.TCPAddr{IP: host.addr.IP, Port: 50000}}, client.addr, nil},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+}
+
+func TestFixedPorts(t *testing.T) {
+	s, host, client := handleServer()
+	register(s, host)
+	s.PortGenerator = FixedPorts{HostPort: 50123, ClientPort: 50456}
+	var generated []int
+	s.TCPPorts = func(h, c *Conn, hostPort, clientPort int) {
+		if h != host || c != client {
+			t.Errorf("TCPPorts called for %v, %v", h, c)
+		}
+		generated = append(generated, hostPort, clientPort)
+	}
+	out, err := s.Handle(&netpuncher.SReqTCP{Header: netpuncher.Header{Version: 2}, CID: host.ID}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(generated, []int{50123, 50456}) {
+		t.Errorf("TCPPorts got %v, expected [50123 50456]", generated)
+	}
+	if len(out) != 2 {
+		t.Fatalf("got %d messages, expected 2", len(out))
+	}
+	toHost := out[0].Packet.(*netpuncher.CReqTCP)
+	toClient := out[1].Packet.(*netpuncher.CReqTCP)
+	if toHost.SourceAddr.Port != 50123 || toHost.DestAddr.Port != 50456 {
+		t.Errorf("CReqTCP to host has ports %d -> %d, expected 50123 -> 50456", toHost.SourceAddr.Port, toHost.DestAddr.Port)
+	}
+	if toClient.SourceAddr.Port != 50456 || toClient.DestAddr.Port != 50123 {
+		t.Errorf("CReqTCP to client has ports %d -> %d, expected 50456 -> 50123", toClient.SourceAddr.Port, toClient.DestAddr.Port)
+	}
+
+	// Retransmissions reuse the ports without generating new ones.
+	s.Handle(&netpuncher.SReqTCP{Header: netpuncher.Header{Version: 2}, CID: host.ID}, client.addr)
+	if len(generated) != 2 {
+		t.Errorf("TCPPorts called again on retransmit: %v", generated)
+	}
+}
+
+func TestSReqTCPRetransmit(t *testing.T) {
+	s, host, client := handleServer()
+	register(s, host)
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	sreq := &netpuncher.SReqTCP{Header: netpuncher.Header{Version: 1}, CID: host.ID}
+	var toHost []*netpuncher.CReqTCP
+	var toClient []*netpuncher.CReqTCP
+	for i := 0; i < 2; i++ {
+		out, err := s.Handle(sreq, client.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, o := range out {
+			if o.Dest == host.addr {
+				toHost = append(toHost, o.Packet.(*netpuncher.CReqTCP))
+			} else {
+				toClient = append(toClient, o.Packet.(*netpuncher.CReqTCP))
+			}
+		}
+	}
+	if len(toHost) != 1 || len(toClient) != 2 {
+		t.Fatalf("got %d CReqTCP to host and %d to client, expected 1 and 2", len(toHost), len(toClient))
+	}
+	if !reflect.DeepEqual(toClient[0], toClient[1]) {
+		t.Errorf("retransmit got different ports: %+v, %+v", toClient[0], toClient[1])
+	}
+	if toClient[1].DestAddr.Port != toHost[0].SourceAddr.Port {
+		t.Errorf("retransmit doesn't match host listener: %+v, %+v", toClient[1], toHost[0])
+	}
+
+	// After the window, the host is notified again.
+	now = now.Add(tcpPunchWindow)
+	out, _ := s.Handle(sreq, client.addr)
+	if len(out) != 2 {
+		t.Errorf("got %d messages after window, expected 2", len(out))
+	}
+}
+
+func TestHandleUnknownHost(t *testing.T) {
+	s, host, client := handleServer()
+	host.transports = netpuncher.TransportsUDP
+	register(s, host)
+	header := netpuncher.Header{Version: 2}
+	tests := []struct {
+		cid  uint32
+		code netpuncher.ErrorCode
+	}{
+		{42, netpuncher.ErrorUnknownHost},
+		{host.ID, netpuncher.ErrorTransportUnsupported},
+	}
+	for _, test := range tests {
+		out, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: test.cid, Transport: netpuncher.TransportTCP}, client.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []Outgoing{{&netpuncher.Error{Header: header, Code: test.code, CID: test.cid}, client.addr, nil}}
+		if !reflect.DeepEqual(out, expected) {
+			t.Errorf("CID %d: got %+v, expected %+v", test.cid, out, expected)
+		}
+	}
+}
+
+// Connections without registration can't be punched over any transport.
+func TestHandleUnregistered(t *testing.T) {
+	s, host, client := handleServer()
+	host.transports = netpuncher.TransportsUDP | netpuncher.TransportsTCP
+	header := netpuncher.Header{Version: 2}
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorUnknownHost, CID: host.ID}, client.addr, nil}}
+	for _, transport := range []netpuncher.Transport{netpuncher.TransportUDP, netpuncher.TransportTCP} {
+		out, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, Transport: transport}, client.addr)
+		if err != nil || !reflect.DeepEqual(out, expected) {
+			t.Errorf("transport %d: got %+v, %v, expected %+v", transport, out, err, expected)
+		}
+	}
+}
+
+// A client which sends SReq for a CID that was never allocated, e.g. because
+// it skipped waiting for the host's ID, gets an error right away instead of
+// waiting for a CReq that never comes.
+func TestSReqNeverAllocated(t *testing.T) {
+	var s Server
+	host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: netpuncher.Header{Version: 2}})
+	defer s.Close()
+	defer host.Close()
+	defer client.Close()
+
+	header := netpuncher.Header{Version: 2}
+	unknown := cid + 1000
+	writePacket(t, client, &netpuncher.SReq{Header: header, CID: unknown})
+	p := readPacket(t, client)
+	expected := &netpuncher.Error{Header: netpuncher.Header{Type: netpuncher.PID_Puncher_Error, Version: 2}, Code: netpuncher.ErrorUnknownHost, CID: unknown}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("got %+v, expected %+v", p, expected)
+	}
+}
+
+func TestHandleUnexpected(t *testing.T) {
+	s, host, _ := handleServer()
+	if _, err := s.Handle(&netpuncher.AssID{Header: netpuncher.Header{Version: 1}, CID: 1}, host.addr); err == nil {
+		t.Error("AssID from peer: expected error")
+	}
+	unknown := &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 11115}
+	if _, err := s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 1}}, unknown); err == nil {
+		t.Error("unknown source address: expected error")
+	}
+	if out, err := s.Handle(&netpuncher.SReqV2{Header: netpuncher.Header{Version: 2}}, host.addr); err == nil {
+		t.Errorf("SReqV2 without CID: got %+v, expected error", out)
+	}
+}
+
+func TestHandlePunchResult(t *testing.T) {
+	s, host, client := handleServer()
+	host.version = 2
+	host.transports = netpuncher.TransportsUDP | netpuncher.TransportsTCP
+	register(s, host)
+	type result struct {
+		c       *Conn
+		cid     uint32
+		success bool
+	}
+	var results []result
+	s.PunchResult = func(c *Conn, cid uint32, success bool) {
+		results = append(results, result{c, cid, success})
+	}
+	header := netpuncher.Header{Version: 2}
+	punchResult := func(success bool) error {
+		out, err := s.Handle(&netpuncher.PunchResult{Header: header, CID: host.ID, Success: success}, client.addr)
+		if len(out) != 0 {
+			t.Errorf("success = %v: got %+v", success, out)
+		}
+		return err
+	}
+	for _, transport := range []netpuncher.Transport{netpuncher.TransportUDP, netpuncher.TransportTCP} {
+		if _, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, Transport: transport}, client.addr); err != nil {
+			t.Fatal(err)
+		}
+		if err := punchResult(transport == netpuncher.TransportUDP); err != nil {
+			t.Errorf("%v: %v", transport, err)
+		}
+		// The result releases the punch.
+		if err := punchResult(true); err == nil {
+			t.Errorf("%v: second result accepted", transport)
+		}
+	}
+	expected := []result{{client, host.ID, true}, {client, host.ID, false}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("got results %+v, expected %+v", results, expected)
+	}
+	if len(s.pending) != 0 || len(s.tcpPorts) != 0 {
+		t.Errorf("punches not released: %v, %v", s.pending, s.tcpPorts)
+	}
+	// The host stays registered for further clients.
+	if _, ok := s.conns[host.ID]; !ok {
+		t.Error("host unregistered after punch result")
+	}
+
+	// Other clients can't report results for the punch.
+	if _, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID}, client.addr); err != nil {
+		t.Fatal(err)
+	}
+	other := &Conn{ID: 1339, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 11115}, role: roleClient, s: s}
+	s.addConn(other)
+	if _, err := s.Handle(&netpuncher.PunchResult{Header: header, CID: host.ID}, other.addr); err == nil {
+		t.Error("result of another client's punch accepted")
+	}
+
+	// Nor can a client report results long after the punch.
+	now := time.Now().Add(pendingPunchWindow)
+	s.now = func() time.Time { return now }
+	if err := punchResult(true); err == nil {
+		t.Error("expired result accepted")
+	}
+	if len(results) != 2 {
+		t.Errorf("got results %+v, expected %+v", results, expected)
+	}
+}
+
+func TestCReqLimit(t *testing.T) {
+	s, host, client := handleServer()
+	host.version = 1
+	register(s, host)
+	now := time.Unix(1000, 0)
+	s.now = func() time.Time { return now }
+	s.CReqLimit = 5
+	s.CReqLimitWindow = time.Minute
+	dropped := 0
+	s.DropCReq = func(dest net.Addr) {
+		if dest.String() == host.addr.String() {
+			dropped++
+		}
+	}
+	countToHost := func(n int) int {
+		sent := 0
+		for i := 0; i < n; i++ {
+			out, err := s.Handle(&netpuncher.SReq{Header: netpuncher.Header{Version: 1}, CID: host.ID}, client.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			toHost := 0
+			for _, o := range out {
+				if o.Dest == host.addr {
+					toHost++
+				}
+			}
+			// Both parties or neither receive their CReq.
+			if toHost != len(out)-toHost {
+				t.Fatalf("sent %d CReqs to host, %d to client", toHost, len(out)-toHost)
+			}
+			sent += toHost
+		}
+		return sent
+	}
+
+	if sent := countToHost(20); sent != 5 {
+		t.Errorf("sent %d CReqs to victim, expected 5", sent)
+	}
+	if dropped != 15 {
+		t.Errorf("dropped %d CReqs to victim, expected 15", dropped)
+	}
+	now = now.Add(time.Minute)
+	if sent := countToHost(1); sent != 1 {
+		t.Errorf("sent %d CReqs to victim in new window, expected 1", sent)
+	}
+
+	// A zero window defaults to a minute instead of disabling the limit.
+	s.CReqLimitWindow = 0
+	now = now.Add(time.Minute)
+	if sent := countToHost(10); sent != 5 {
+		t.Errorf("sent %d CReqs to victim with zero window, expected 5", sent)
+	}
+	now = now.Add(time.Minute - time.Second)
+	if sent := countToHost(1); sent != 0 {
+		t.Errorf("sent %d CReqs to victim within default window, expected 0", sent)
+	}
+}
+
+// Only peers requesting padding receive padded messages.
+func TestPadding(t *testing.T) {
+	var s Server
+	header := netpuncher.Header{Version: 2}
+	host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: header, Padding: true})
+	defer s.Close()
+	defer host.Close()
+	defer client.Close()
+
+	writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: cid})
+	buf := readDatagram(t, host)
+	if len(buf) != netpuncher.PaddedSize {
+		t.Errorf("host received %d byte, expected %d", len(buf), netpuncher.PaddedSize)
+	}
+	if _, err := netpuncher.UnmarshalPadded(buf); err != nil {
+		t.Errorf("UnmarshalPadded: %v", err)
+	}
+	buf = readDatagram(t, client)
+	if n, err := netpuncher.MessageLen(buf); err != nil || n != len(buf) {
+		t.Errorf("client received %d byte, expected unpadded message (%d, %v)", len(buf), n, err)
+	}
+}
+
+// Only the party which requested it receives checksummed messages.
+func TestChecksum(t *testing.T) {
+	var s Server
+	header := netpuncher.Header{Version: 2}
+	host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: header, Checksum: true})
+	defer s.Close()
+	defer host.Close()
+	defer client.Close()
+
+	writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: cid})
+	buf := readDatagram(t, host)
+	if p, err := netpuncher.UnmarshalChecksummed(buf); err != nil {
+		t.Errorf("UnmarshalChecksummed: %v", err)
+	} else if _, ok := p.(*netpuncher.CReq); !ok {
+		t.Errorf("host received %T, expected CReq", p)
+	}
+	buf = readDatagram(t, client)
+	if n, err := netpuncher.MessageLen(buf); err != nil || n != len(buf) {
+		t.Errorf("client received %d byte, expected message without checksum (%d, %v)", len(buf), n, err)
+	}
+}
+
+// Each party receives ports in the byte order it announced.
+func TestBigEndianPorts(t *testing.T) {
+	var s Server
+	header := netpuncher.Header{Version: 2}
+	host, client, cid := startServer(t, &s, netpuncher.IDReq{Header: header, BigEndianPorts: true})
+	defer s.Close()
+	defer host.Close()
+	defer client.Close()
+
+	writePacket(t, client, &netpuncher.SReqV2{Header: header, CID: cid})
+	hostAddr := host.LocalAddr().(*net.UDPAddr)
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+	if creq, ok := readPacket(t, host).(*netpuncher.CReq); !ok || !creq.BigEndianPorts || creq.Addr.Port != clientAddr.Port {
+		t.Errorf("unexpected message to host: %+v", creq)
+	}
+	if creq, ok := readPacket(t, client).(*netpuncher.CReq); !ok || creq.BigEndianPorts || creq.Addr.Port != hostAddr.Port {
+		t.Errorf("unexpected message to client: %+v", creq)
+	}
+}
+
+func TestMinClientVersion(t *testing.T) {
+	s, host, client := handleServer()
+	s.MinClientVersion = 2
+	var rejected []netpuncher.ProtocolVersion
+	s.UnsupportedVersionErr = func(c *Conn, err *netpuncher.ErrUnsupportedVersion) {
+		rejected = append(rejected, netpuncher.ProtocolVersion(*err))
+	}
+
+	// Version 1 peers can't receive an Error.
+	out, err := s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 1}}, host.addr)
+	if err != nil || len(out) != 0 {
+		t.Errorf("v1 IDReq: got %+v, %v, expected nothing", out, err)
+	}
+	if !reflect.DeepEqual(rejected, []netpuncher.ProtocolVersion{1}) {
+		t.Errorf("UnsupportedVersionErr called for %v", rejected)
+	}
+	if _, ok := s.Registry().Metadata(host.ID); ok {
+		t.Error("v1 host registered")
+	}
+
+	out, err = s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}, host.addr)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("v2 IDReq: got %+v, %v", out, err)
+	}
+	if _, ok := out[0].Packet.(*netpuncher.AssID); !ok {
+		t.Errorf("v2 IDReq: got %T, expected AssID", out[0].Packet)
+	}
+
+	// Newer peers get an Error in their own version.
+	s.MinClientVersion = 3
+	out, err = s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}, host.addr)
+	expected := []Outgoing{{&netpuncher.Error{Header: netpuncher.Header{Version: 2}, Code: netpuncher.ErrorVersionTooOld}, host.addr, nil}}
+	if err != nil || !reflect.DeepEqual(out, expected) {
+		t.Errorf("v2 IDReq with minimum 3: got %+v, %v, expected %+v", out, err, expected)
+	}
+	out, err = s.Handle(&netpuncher.SReqV2{Header: netpuncher.Header{Version: 2}, CID: host.ID}, client.addr)
+	expected = []Outgoing{{&netpuncher.Error{Header: netpuncher.Header{Version: 2}, Code: netpuncher.ErrorVersionTooOld, CID: host.ID}, client.addr, nil}}
+	if err != nil || !reflect.DeepEqual(out, expected) {
+		t.Errorf("v2 SReqV2 with minimum 3: got %+v, %v, expected %+v", out, err, expected)
+	}
+
+	// Only registering and punching is checked, so the host which
+	// registered before can still send heartbeats.
+	out, err = s.Handle(&netpuncher.Heartbeat{Header: netpuncher.Header{Version: 2}, CID: host.ID}, host.addr)
+	if err != nil || len(out) != 0 {
+		t.Errorf("v2 Heartbeat with minimum 3: got %+v, %v, expected nothing", out, err)
+	}
+}
+
+// chanMsgReader is a MsgReader returning the messages sent on its channel.
+type chanMsgReader chan received
+
+func (r chanMsgReader) ReadMsg() (netpuncher.PuncherPacket, net.Addr, error) {
+	m, ok := <-r
+	if !ok {
+		return nil, nil, errors.New("closed")
+	}
+	return m.p, m.src, nil
+}
+
+func TestMsgReader(t *testing.T) {
+	s, host, client := handleServer()
+	s.exitch = make(chan struct{})
+	r := make(chanMsgReader, 2)
+	host.reader = r
+	recv := make(chan received)
+	go host.handlePackets(recv, nil)
+
+	// The reader's source address is passed on, not the connection's.
+	msgs := []received{
+		{host, &netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}, host.addr},
+		{host, &netpuncher.SReq{Header: netpuncher.Header{Version: 1}, CID: host.ID}, client.addr},
+	}
+	for _, m := range msgs {
+		r <- m
+		got := <-recv
+		if !reflect.DeepEqual(got, m) {
+			t.Errorf("received %+v, expected %+v", got, m)
+		}
+	}
+	close(s.exitch)
+	close(r)
+}
+
+// recordWriter records each written datagram, failing if err is set.
+type recordWriter struct {
+	writes [][]byte
+	err    error
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	w.writes = append(w.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func TestPairedSendErr(t *testing.T) {
+	s, host, client := handleServer()
+	register(s, host)
+	host.version = 2
+	hostw := &recordWriter{err: errors.New("send failed")}
+	clientw := &recordWriter{}
+	host.writer, client.writer = hostw, clientw
+	var failed []*Conn
+	s.SendErr = func(c *Conn, err error) { failed = append(failed, c) }
+
+	out, err := s.Handle(&netpuncher.SReqV2{Header: netpuncher.Header{Version: 2}, CID: host.ID, Transport: netpuncher.TransportTCP}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.send(out)
+	if len(failed) != 1 || failed[0] != host {
+		t.Errorf("SendErr called for %v, expected host", failed)
+	}
+	if len(clientw.writes) != 2 {
+		t.Fatalf("client received %d messages, expected CReqTCP and Error", len(clientw.writes))
+	}
+	if p, err := netpuncher.Unmarshal(clientw.writes[0]); err != nil || p.Type() != netpuncher.PID_Puncher_CReqTCP {
+		t.Errorf("first message %+v, %v, expected CReqTCP", p, err)
+	}
+	p, err := netpuncher.Unmarshal(clientw.writes[1])
+	expected := &netpuncher.Error{Header: netpuncher.Header{Type: netpuncher.PID_Puncher_Error, Version: 2}, Code: netpuncher.ErrorPeerUnreachable, CID: host.ID}
+	if err != nil || !reflect.DeepEqual(p, expected) {
+		t.Errorf("second message %+v, %v, expected %+v", p, err, expected)
+	}
+
+	// Without failures, no fallback is sent.
+	hostw.err = nil
+	clientw.writes = nil
+	s.tcpPorts = nil
+	out, _ = s.Handle(&netpuncher.SReqV2{Header: netpuncher.Header{Version: 2}, CID: host.ID, Transport: netpuncher.TransportTCP}, client.addr)
+	s.send(out)
+	if len(hostw.writes) != 1 || len(clientw.writes) != 1 {
+		t.Errorf("got %d messages to host and %d to client, expected one each", len(hostw.writes), len(clientw.writes))
+	}
+}
+
+func TestQueueSize(t *testing.T) {
+	s, host, _ := handleServer()
+	s.exitch = make(chan struct{})
+	s.QueueSize = 2
+	drops := make(chan netpuncher.PuncherPacket, 100)
+	s.DropMessage = func(c *Conn, p netpuncher.PuncherPacket) { drops <- p }
+	const n = 100
+	r := make(chanMsgReader, n)
+	for i := 0; i < n; i++ {
+		r <- received{host, &netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}, host.addr}
+	}
+	host.reader = r
+	goroutines := runtime.NumGoroutine()
+
+	// Nobody processes the queue.
+	recv := make(chan received, s.QueueSize)
+	go host.handlePackets(recv, nil)
+	for i := 0; i < n-s.QueueSize; i++ {
+		select {
+		case <-drops:
+		case <-time.After(time.Second):
+			t.Fatalf("only %d messages dropped, expected %d", i, n-s.QueueSize)
+		}
+	}
+	if g := runtime.NumGoroutine(); g > goroutines+1 {
+		t.Errorf("%d goroutines while flooded, started with %d", g, goroutines)
+	}
+	if len(recv) != s.QueueSize {
+		t.Errorf("%d messages queued, expected %d", len(recv), s.QueueSize)
+	}
+	close(s.exitch)
+	close(r)
+}
+
+func TestAllowDeny(t *testing.T) {
+	s, host, client := handleServer()
+	mustParseCIDR := func(cidr string) net.IPNet {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *n
+	}
+	// host is 2001:db8::1, client 2001:db8::2
+	s.Allow = []net.IPNet{mustParseCIDR("2001:db8::/64")}
+	s.Deny = []net.IPNet{mustParseCIDR("2001:db8::2/128")}
+	var denied []net.Addr
+	s.DenySource = func(src net.Addr) { denied = append(denied, src) }
+
+	idreq := &netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}
+	if out, err := s.Handle(idreq, host.addr); err != nil || len(out) != 1 {
+		t.Errorf("allowed IDReq: got %+v, %v", out, err)
+	}
+	out, err := s.Handle(idreq, client.addr)
+	if err != nil || len(out) != 0 {
+		t.Errorf("denied IDReq: got %+v, %v", out, err)
+	}
+	if _, ok := s.Registry().Metadata(client.ID); ok {
+		t.Error("denied host registered")
+	}
+	if len(denied) != 1 || denied[0] != client.addr {
+		t.Errorf("DenySource called for %v, expected client", denied)
+	}
+
+	s.NotifyDenied = true
+	out, _ = s.Handle(idreq, client.addr)
+	expected := []Outgoing{{&netpuncher.Error{Header: netpuncher.Header{Version: 2}, Code: netpuncher.ErrorDenied}, client.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+
+	// Sources outside of Allow are dropped as well.
+	s.Deny = nil
+	s.Allow = []net.IPNet{mustParseCIDR("192.0.2.0/24")}
+	if out, _ := s.Handle(idreq, host.addr); len(out) != 1 || out[0].Packet.Type() != netpuncher.PID_Puncher_Error {
+		t.Errorf("IDReq outside of Allow: got %+v", out)
+	}
+}
+
+func TestInterceptors(t *testing.T) {
+	s, host, client := handleServer()
+	var calls []string
+	count := func(next Handler) Handler {
+		return HandlerFunc(func(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error) {
+			calls = append(calls, "count")
+			return next.Handle(p, src)
+		})
+	}
+	// Drops punch requests without passing them on.
+	block := func(next Handler) Handler {
+		return HandlerFunc(func(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error) {
+			calls = append(calls, "block")
+			if _, ok := netpuncher.UnifySReq(p); ok {
+				return nil, nil
+			}
+			return next.Handle(p, src)
+		})
+	}
+	s.Use(count, block)
+	registered := false
+	s.RegisterHost = func(*Conn) {
+		calls = append(calls, "handle")
+		registered = true
+	}
+
+	out, err := s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 2}}, host.addr)
+	if err != nil || len(out) != 1 || !registered {
+		t.Fatalf("IDReq: got %+v, %v", out, err)
+	}
+	if expected := []string{"count", "block", "handle"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("IDReq: calls %v, expected %v", calls, expected)
+	}
+
+	calls = nil
+	out, err = s.Handle(&netpuncher.SReqV2{Header: netpuncher.Header{Version: 2}, CID: host.ID}, client.addr)
+	if err != nil || len(out) != 0 {
+		t.Errorf("SReqV2: got %+v, %v, expected nothing", out, err)
+	}
+	if expected := []string{"count", "block"}; !reflect.DeepEqual(calls, expected) {
+		t.Errorf("SReqV2: calls %v, expected %v", calls, expected)
+	}
+}
+
+// Punches towards the server's own address are rejected.
+func TestLocalAddrs(t *testing.T) {
+	s, host, client := handleServer()
+	self := net.UDPAddr{IP: net.ParseIP("2001:db8::ff"), Port: 11113}
+	s.LocalAddrs = []net.UDPAddr{self}
+	header := netpuncher.Header{Version: 2}
+	host.version = 2
+	client.version = 2
+	register(s, host)
+	// The client's preferred address is only used behind the same NAT.
+	delete(s.addrs, client.addr)
+	client.addr = &net.UDPAddr{IP: host.addr.IP, Port: client.addr.Port}
+	s.addConn(client)
+
+	out, err := s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, PreferredAddr: &self}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorAddressUnusable, CID: host.ID}, client.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+
+	// Other preferred addresses work as usual.
+	other := net.UDPAddr{IP: self.IP, Port: 11114}
+	out, err = s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, PreferredAddr: &other}, client.addr)
+	if err != nil || len(out) != 3 {
+		t.Errorf("got %+v, %v, expected three CReqs", out, err)
+	}
+
+	// The same applies to the generated TCP endpoints.
+	host.transports = netpuncher.TransportsUDP | netpuncher.TransportsTCP
+	s.PortGenerator = FixedPorts{HostPort: 40000, ClientPort: 40001}
+	// Only the IP matters, as the TCP ports are unrelated to the UDP ports
+	// the server listens on.
+	for _, local := range []net.UDPAddr{{IP: client.addr.IP, Port: 40001}, {IP: host.addr.IP, Port: 11113}} {
+		s.LocalAddrs = []net.UDPAddr{local}
+		s.tcpPorts = nil
+		out, err = s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, Transport: netpuncher.TransportTCP}, client.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, expected) {
+			t.Errorf("TCP towards %v: got %+v, expected %+v", &local, out, expected)
+		}
+	}
+
+	var ls Server
+	ls.DetectLocalAddrs = true
+	if err := ls.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Fatal(err)
+	}
+	defer ls.Close()
+	if !ls.isLocalAddr(*ls.Addr().(*net.UDPAddr)) {
+		t.Errorf("listening address %v not detected", ls.Addr())
+	}
+}
+
+func TestRequireNonce(t *testing.T) {
+	s, host, client := handleServer()
+	s.RequireNonce = true
+	header := netpuncher.Header{Version: 2}
+	out, err := s.Handle(&netpuncher.IDReq{Header: header}, host.addr)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("IDReq: got %+v, %v", out, err)
+	}
+	hostNonce := out[0].Packet.(*netpuncher.AssID).Nonce
+	if hostNonce == 0 {
+		t.Error("host didn't receive a nonce")
+	}
+	// The host is only registered once it echoes the nonce.
+	if _, ok := s.Registry().Metadata(host.ID); ok {
+		t.Error("host registered without echoing the nonce")
+	}
+	out, err = s.Handle(&netpuncher.IDReq{Header: header, Nonce: hostNonce + 1}, host.addr)
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorBadNonce}, host.addr, nil}}
+	if err != nil || !reflect.DeepEqual(out, expected) {
+		t.Errorf("IDReq with mismatched nonce: got %+v, %v, expected %+v", out, err, expected)
+	}
+	out, err = s.Handle(&netpuncher.IDReq{Header: header, Nonce: hostNonce}, host.addr)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("IDReq with nonce: got %+v, %v", out, err)
+	}
+	if assid := out[0].Packet.(*netpuncher.AssID); assid.Nonce != hostNonce {
+		t.Errorf("IDReq with nonce: got nonce %x, expected %x", assid.Nonce, hostNonce)
+	}
+	if _, ok := s.Registry().Metadata(host.ID); !ok {
+		t.Error("host not registered after echoing the nonce")
+	}
+
+	// Nonces depend on the address only.
+	same := &Conn{ID: 1339, addr: &net.UDPAddr{IP: host.addr.IP, Port: host.addr.Port}, version: 2, s: s}
+	other := &Conn{ID: 1340, addr: &net.UDPAddr{IP: host.addr.IP, Port: host.addr.Port + 1}, version: 2, s: s}
+	if s.nonceOf(same) != hostNonce || s.nonceOf(other) == hostNonce {
+		t.Errorf("got nonces %x and %x, expected %x and another one", s.nonceOf(same), s.nonceOf(other), hostNonce)
+	}
+
+	// Without nonce, the client learns it first.
+	out, err = s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID}, client.addr)
+	if err != nil || len(out) != 1 {
+		t.Fatalf("SReqV2 without nonce: got %+v, %v", out, err)
+	}
+	assid, ok := out[0].Packet.(*netpuncher.AssID)
+	if !ok || assid.CID != client.ID || assid.Nonce == 0 || out[0].Dest != client.addr {
+		t.Fatalf("SReqV2 without nonce: got %+v, expected AssID to client", out)
+	}
+	clientNonce := assid.Nonce
+
+	out, err = s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, Nonce: clientNonce}, client.addr)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("SReqV2 with nonce: got %+v, %v", out, err)
+	}
+	for _, o := range out {
+		expected := hostNonce
+		if o.Dest == client.addr {
+			expected = clientNonce
+		}
+		if creq, ok := o.Packet.(*netpuncher.CReq); !ok || creq.Nonce != expected {
+			t.Errorf("SReqV2 with nonce: got %+v to %v, expected CReq with nonce %x", o.Packet, o.Dest, expected)
+		}
+	}
+
+	out, err = s.Handle(&netpuncher.SReqV2{Header: header, CID: host.ID, Nonce: clientNonce + 1}, client.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorBadNonce, CID: host.ID}, client.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("mismatched nonce: got %+v, expected %+v", out, expected)
+	}
+
+	// Messages without nonce field can't be served.
+	for _, p := range []netpuncher.PuncherPacket{&netpuncher.SReq{Header: header, CID: host.ID}, &netpuncher.SReqTCP{Header: header, CID: host.ID}} {
+		out, err = s.Handle(p, client.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(out, expected) {
+			t.Errorf("%T: got %+v, expected %+v", p, out, expected)
+		}
+	}
+}
+
+func TestIdentityKey(t *testing.T) {
+	s, host, client := handleServer()
+	s.IdentityKey = []byte("server key")
+	idreq := &netpuncher.IDReq{Header: netpuncher.Header{Version: 2}, Identity: []byte("host secret")}
+
+	// The CID only depends on key and identity.
+	other, _, _ := handleServer()
+	other.IdentityKey = s.IdentityKey
+	expected := other.identityID(&Conn{}, idreq.Identity)
+	if id := other.identityID(&Conn{}, []byte("other secret")); id == expected {
+		t.Errorf("different identities got the same ID %d", id)
+	}
+	out, err := s.Handle(idreq, host.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assid := out[0].Packet.(*netpuncher.AssID); assid.CID != expected || host.ID != expected || s.conns[expected] != host {
+		t.Errorf("host got ID %d, expected %d", assid.CID, expected)
+	}
+	if _, ok := s.conns[1337]; ok {
+		t.Error("previous ID still in use")
+	}
+	if _, ok := s.Registry().Metadata(expected); !ok {
+		t.Error("host not registered with derived ID")
+	}
+
+	// Reconnecting from a different address takes the ID over.
+	reconnect := &Conn{ID: 1339, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 11113}, s: s}
+	s.addConn(reconnect)
+	if _, err := s.Handle(idreq, reconnect.addr); err != nil {
+		t.Fatal(err)
+	}
+	if reconnect.ID != expected || s.conns[expected] != reconnect {
+		t.Errorf("reconnecting host got ID %d, expected %d", reconnect.ID, expected)
+	}
+
+	// Another host colliding with the ID gets the next one.
+	s.changeID(client, expected)
+	if _, err := s.Handle(idreq, host.addr); err != nil {
+		t.Fatal(err)
+	}
+	if host.ID != expected+1 || s.conns[expected] != client {
+		t.Errorf("colliding host got ID %d, expected %d", host.ID, expected+1)
+	}
+
+	// Without key, the identity is ignored.
+	s, host, _ = handleServer()
+	if _, err := s.Handle(idreq, host.addr); err != nil || host.ID != 1337 {
+		t.Errorf("without key: host got ID %d, %v", host.ID, err)
+	}
+}
+
+func TestOnAnnounce(t *testing.T) {
+	s, host, client := handleServer()
+	header := netpuncher.Header{Version: 2}
+	var announced []uint32
+	var fail error
+	s.OnAnnounce = func(cid uint32, addr net.Addr) error {
+		if addr.String() != host.addr.String() {
+			t.Errorf("OnAnnounce called with address %v, expected %v", addr, host.addr)
+		}
+		announced = append(announced, cid)
+		return fail
+	}
+	out, err := s.Handle(&netpuncher.IDReq{Header: header}, host.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 1 || out[0].Packet.(*netpuncher.AssID).CID != host.ID {
+		t.Errorf("got %+v, expected AssID", out)
+	}
+	if _, ok := s.Registry().Metadata(host.ID); !ok || !reflect.DeepEqual(announced, []uint32{host.ID}) {
+		t.Errorf("host not announced: %v", announced)
+	}
+
+	// Failing to announce rolls the registration back.
+	fail = errors.New("master server unreachable")
+	registered := false
+	s.RegisterHost = func(*Conn) { registered = true }
+	out, err = s.Handle(&netpuncher.IDReq{Header: header}, host.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorAnnounceFailed, CID: host.ID}, host.addr, nil}}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("failed announce: got %+v, expected %+v", out, expected)
+	}
+	if _, ok := s.Registry().Metadata(host.ID); ok || registered {
+		t.Error("host still registered after failed announce")
+	}
+	for _, p := range []netpuncher.PuncherPacket{&netpuncher.SReqV2{Header: header, CID: host.ID}, &netpuncher.SReq{Header: header, CID: host.ID}} {
+		out, err = s.Handle(p, client.addr)
+		expected := []Outgoing{{&netpuncher.Error{Header: header, Code: netpuncher.ErrorUnknownHost, CID: host.ID}, client.addr, nil}}
+		if err != nil || !reflect.DeepEqual(out, expected) {
+			t.Errorf("%T after failed announce: got %+v, %v, expected %+v", p, out, err, expected)
+		}
+	}
+
+	// Version 1 hosts don't get an answer.
+	if out, err := s.Handle(&netpuncher.IDReq{Header: netpuncher.Header{Version: 1}}, host.addr); err != nil || len(out) != 0 {
+		t.Errorf("failed announce with version 1: got %+v, %v", out, err)
+	}
+}
+
+func TestRewriteTargetAddr(t *testing.T) {
+	s, host, client := handleServer()
+	host.version = 1
+	balancer := &net.UDPAddr{IP: net.ParseIP("2001:db8::ba1"), Port: 11113}
+	rewritten := &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 11115}
+	clientAddr := *client.addr
+	client.addr = balancer
+	s.addrs = map[net.Addr]*Conn{host.addr: host, balancer: client}
+	s.RewriteTargetAddr = func(observed net.Addr) net.Addr {
+		if observed.String() == balancer.String() {
+			return rewritten
+		}
+		return observed
+	}
+	register(s, host)
+	header := netpuncher.Header{Version: 1}
+	out, err := s.Handle(&netpuncher.SReq{Header: header, CID: host.ID}, balancer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Outgoing{
+		{&netpuncher.CReq{Header: header, Addr: *rewritten}, host.addr, nil},
+		{&netpuncher.CReq{Header: header, Addr: *host.addr}, balancer, nil},
+	}
+	if !reflect.DeepEqual(out, expected) {
+		t.Errorf("got %+v, expected %+v", out, expected)
+	}
+
+	out, err = s.Handle(&netpuncher.SReqTCP{Header: header, CID: host.ID}, balancer)
+	if err != nil || len(out) != 2 {
+		t.Fatalf("SReqTCP: got %+v, %v", out, err)
+	}
+	if creq := out[0].Packet.(*netpuncher.CReqTCP); !creq.DestAddr.IP.Equal(rewritten.IP) {
+		t.Errorf("CReqTCP to host targets %v, expected %v", &creq.DestAddr, rewritten.IP)
+	}
+
+	// Results other than *net.UDPAddr are ignored.
+	s.RewriteTargetAddr = func(net.Addr) net.Addr { return nil }
+	client.addr = &clientAddr
+	s.addrs[client.addr] = client
+	out, err = s.Handle(&netpuncher.SReq{Header: header, CID: host.ID}, client.addr)
+	if err != nil || len(out) != 2 || out[0].Packet.(*netpuncher.CReq).Addr.String() != clientAddr.String() {
+		t.Errorf("nil rewrite: got %+v, %v", out, err)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	// The self-test peers don't show up as hosts.
+	var callbacks int32
+	called := func() { atomic.AddInt32(&callbacks, 1) }
+	s := Server{
+		AcceptConn:   func(*Conn, error) { called() },
+		RegisterHost: func(*Conn) { called() },
+		OnAnnounce:   func(uint32, net.Addr) error { called(); return nil },
+		CReq:         func(host, client *Conn) { called() },
+	}
+	if err := s.SelfTest(context.Background()); err == nil {
+		t.Error("expected error before Listen")
+	}
+	if err := s.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.SelfTest(ctx); err != nil {
+		t.Errorf("healthy server: %v", err)
+	}
+	if n := atomic.LoadInt32(&callbacks); n != 0 {
+		t.Errorf("self-test peers triggered %d callbacks", n)
+	}
+	if snapshot := s.Registry().Snapshot(); len(snapshot) != 0 {
+		t.Errorf("self-test host listed: %+v", snapshot)
+	}
+
+	// A server which drops punch requests fails waiting for the CReq.
+	var broken Server
+	broken.Use(func(next Handler) Handler {
+		return HandlerFunc(func(p netpuncher.PuncherPacket, src net.Addr) ([]Outgoing, error) {
+			if _, ok := netpuncher.UnifySReq(p); ok {
+				return nil, nil
+			}
+			return next.Handle(p, src)
+		})
+	})
+	if err := broken.Listen("udp", &net.UDPAddr{IP: net.IPv6loopback}); err != nil {
+		t.Fatal(err)
+	}
+	defer broken.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err := broken.SelfTest(ctx)
+	if err == nil || !strings.Contains(err.Error(), "waiting for CReq") {
+		t.Errorf("broken server: got %v, expected CReq timeout", err)
+	}
+}
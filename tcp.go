@@ -0,0 +1,88 @@
+package netpuncher
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Interval between connection attempts of SimultaneousOpen.
+const simultaneousOpenInterval = 100 * time.Millisecond
+
+// SimultaneousOpen connects from local to remote while the peer does the
+// same in the opposite direction, as instructed by a CReqTCP pair. The local
+// port is also listened on, so that the connection is established as well if
+// the peer's attempt arrives first, e.g. on a LAN where the attempts are
+// refused instead of dropped. Both sides end up with the same connection.
+// Attempts are repeated until one succeeds or ctx is done.
+func SimultaneousOpen(ctx context.Context, local, remote net.TCPAddr) (net.Conn, error) {
+	return simultaneousOpen(ctx, local, remote, -1, simultaneousOpenInterval)
+}
+
+// Dial performs the simultaneous open for p, see SimultaneousOpen. The
+// number of attempts and their interval follow the server's retry hint,
+// falling back to trying until ctx is done.
+func (p *CReqTCP) Dial(ctx context.Context) (net.Conn, error) {
+	retries, interval := p.RetryParams(-1, simultaneousOpenInterval)
+	return simultaneousOpen(ctx, p.LocalListenAddr(), p.DestAddr, retries, interval)
+}
+
+// simultaneousOpen tries to connect up to retries+1 times, or indefinitely if
+// retries is negative.
+func simultaneousOpen(ctx context.Context, local, remote net.TCPAddr, retries int, interval time.Duration) (net.Conn, error) {
+	accepted := make(chan net.Conn, 1)
+	lc := net.ListenConfig{Control: reuseAddr}
+	// Without a listener, only our own attempts can succeed.
+	if l, err := lc.Listen(ctx, "tcp", local.String()); err == nil {
+		done := make(chan struct{})
+		go acceptFrom(l, remote, accepted, done)
+		defer func() {
+			l.Close()
+			<-done
+			select {
+			case c := <-accepted:
+				c.Close()
+			default:
+			}
+		}()
+	}
+
+	d := net.Dialer{LocalAddr: &local, Control: reuseAddr}
+	for i := 0; ; i++ {
+		conn, err := d.DialContext(ctx, "tcp", remote.String())
+		if err == nil {
+			return conn, nil
+		}
+		if retries >= 0 && i >= retries {
+			select {
+			case conn = <-accepted:
+				return conn, nil
+			default:
+				return nil, err
+			}
+		}
+		select {
+		case conn = <-accepted:
+			return conn, nil
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(interval):
+		}
+	}
+}
+
+// acceptFrom sends the first connection from remote accepted by l.
+func acceptFrom(l net.Listener, remote net.TCPAddr, accepted chan<- net.Conn, done chan<- struct{}) {
+	defer close(done)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && addr.Port == remote.Port && addr.IP.Equal(remote.IP) {
+			accepted <- c
+			return
+		}
+		c.Close()
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package netpuncher
+
+import "syscall"
+
+// reuseAddr does nothing on platforms without SO_REUSEPORT. The listener of
+// SimultaneousOpen may then fail, so that it only connects actively.
+func reuseAddr(network, address string, c syscall.RawConn) error {
+	return nil
+}
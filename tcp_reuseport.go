@@ -0,0 +1,8 @@
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || (linux && !386 && !amd64 && !arm)
+// +build aix darwin dragonfly freebsd netbsd openbsd linux,!386,!amd64,!arm
+
+package netpuncher
+
+import "syscall"
+
+const soReusePort = syscall.SO_REUSEPORT
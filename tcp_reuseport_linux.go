@@ -0,0 +1,7 @@
+//go:build (linux && 386) || (linux && amd64) || (linux && arm)
+// +build linux,386 linux,amd64 linux,arm
+
+package netpuncher
+
+// The syscall package lacks SO_REUSEPORT on these platforms.
+const soReusePort = 0xf
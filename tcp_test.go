@@ -0,0 +1,57 @@
+package netpuncher
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// freePort returns a TCP port on the loopback interface that is currently
+// unused.
+func freePort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestSimultaneousOpen(t *testing.T) {
+	a := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: freePort(t)}
+	b := net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: freePort(t)}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := SimultaneousOpen(ctx, b, a)
+		ch <- result{conn, err}
+	}()
+	creq := CReqTCP{SourceAddr: a, DestAddr: b, Retry: &RetryHint{100, 10 * time.Millisecond}}
+	conn, err := creq.Dial(ctx)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer conn.Close()
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("SimultaneousOpen: %v", r.err)
+	}
+	defer r.conn.Close()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	r.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.conn.Read(buf); err != nil || string(buf) != "hello" {
+		t.Errorf("read %q, %v", buf, err)
+	}
+}
@@ -0,0 +1,62 @@
+package netpuncher
+
+// DecodeVerbose decodes the message at the start of b like Unmarshal, but
+// continues past defects and returns all of them together with the partially
+// decoded packet. Missing fields are left zero. The packet is nil if the type
+// is unknown. This is meant for diagnostic tooling only, use Unmarshal or a
+// Decoder otherwise.
+func DecodeVerbose(b []byte) (PuncherPacket, []error) {
+	if len(b) < HeaderSize {
+		return nil, []error{ErrNotReadEnough(len(b))}
+	}
+	var errs []error
+	h := Header{b[0], ProtocolVersion(b[1])}
+	min, known := minVersion(h.Type)
+	if !known {
+		errs = append(errs, ErrUnknownType(h.Type))
+	}
+	// Continue with the closest supported version to check the remaining
+	// fields.
+	v := h.Version
+	if !v.Supported() || v < min {
+		errs = append(errs, ErrUnsupportedVersion(v))
+		if v > NewestProtocolVersion {
+			v = NewestProtocolVersion
+		} else {
+			v = min
+		}
+	}
+	if !known {
+		return nil, errs
+	}
+
+	// Pad with zeros so that missing flags are unset and missing fields zero.
+	var buf [MaxPacketSize]byte
+	n := copy(buf[:], b[:HeaderSize])
+	buf[1] = byte(v)
+	if h.Version < 2 && v >= 2 {
+		// The address family was only added in version 2.
+		buf[n] = byte(familyIPv6)
+		n++
+	}
+	n += copy(buf[n:], b[HeaderSize:])
+	if v >= 2 {
+		if err := addrFamily(buf[HeaderSize]).validate(); err != nil {
+			errs = append(errs, err)
+			buf[HeaderSize] = byte(familyIPv6)
+		}
+	}
+	l, err := MessageLen(buf[:])
+	if err != nil {
+		return nil, append(errs, err)
+	}
+	if n < l {
+		errs = append(errs, ErrNotReadEnough(len(b)))
+	}
+	p, _ := newPacket(h.Type)
+	if err := p.UnmarshalBinary(buf[:l]); err != nil {
+		errs = append(errs, err)
+	}
+	*p.(headerPacket).header() = h
+	return p, errs
+}
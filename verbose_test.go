@@ -0,0 +1,70 @@
+package netpuncher
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeVerboseValid(t *testing.T) {
+	for _, pkt := range samplePackets {
+		buf, _ := pkt.MarshalBinary()
+		p, errs := DecodeVerbose(buf)
+		if len(errs) > 0 {
+			t.Errorf("%T: unexpected errors %v", pkt, errs)
+		}
+		if !reflect.DeepEqual(p, pkt) {
+			t.Errorf("packets not equal: %+v != %+v", p, pkt)
+		}
+	}
+}
+
+func TestDecodeVerboseDefects(t *testing.T) {
+	creq, _ := CReq{Header: Header{Version: 2}, Addr: net.UDPAddr{Port: 0xff11, IP: net.ParseIP("2001:db8::1337")}}.MarshalBinary()
+	// Unsupported version and truncated address
+	short := append([]byte(nil), creq[:11]...)
+	short[1] = 7
+	p, errs := DecodeVerbose(short)
+	expected := []error{ErrUnsupportedVersion(7), ErrNotReadEnough(11)}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("got errors %v, expected %v", errs, expected)
+	}
+	if c, ok := p.(*CReq); !ok {
+		t.Errorf("got %T, expected partial *CReq", p)
+	} else if c.Header.Version != 7 || c.Addr.Port != 0xff11 {
+		t.Errorf("unexpected partial packet %+v", c)
+	}
+
+	// Unknown address family and missing flags
+	bad := append([]byte(nil), creq[:len(creq)-1]...)
+	bad[HeaderSize] = 0x42
+	p, errs = DecodeVerbose(bad)
+	expected = []error{InvalidMessageError{Err: errors.New("unknown address family 66")}, ErrNotReadEnough(len(bad))}
+	if len(errs) != 2 || errs[0].Error() != expected[0].Error() || errs[1] != expected[1] {
+		t.Errorf("got errors %v, expected %v", errs, expected)
+	}
+	if c, ok := p.(*CReq); !ok || !c.Addr.IP.Equal(net.ParseIP("2001:db8::1337")) {
+		t.Errorf("unexpected partial packet %+v", p)
+	}
+
+	// Unknown type and unsupported version
+	p, errs = DecodeVerbose([]byte{0x42, 0})
+	expected = []error{ErrUnknownType(0x42), ErrUnsupportedVersion(0)}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("got errors %v, expected %v", errs, expected)
+	}
+	if p != nil {
+		t.Errorf("unknown type: got packet %+v", p)
+	}
+
+	// v2-only type with version 1 and truncated CID
+	p, errs = DecodeVerbose([]byte{PID_Puncher_SReqV2, 1, 0x39, 0x05})
+	expected = []error{ErrUnsupportedVersion(1), ErrNotReadEnough(4)}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("got errors %v, expected %v", errs, expected)
+	}
+	if _, ok := p.(*SReqV2); !ok {
+		t.Errorf("got %T, expected partial *SReqV2", p)
+	}
+}